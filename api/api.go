@@ -14,14 +14,16 @@ import (
 	"github.com/netlify/git-gateway/conf"
 	"github.com/netlify/git-gateway/storage"
 	"github.com/netlify/git-gateway/storage/dial"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/sebest/xff"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	audHeaderName  = "X-JWT-AUD"
-	defaultVersion = "unknown version"
+	audHeaderName       = "X-JWT-AUD"
+	requestIDHeaderName = "X-Request-ID"
+	defaultVersion      = "unknown version"
 )
 
 var bearerRegexp = regexp.MustCompile(`^(?:B|b)earer (\S+$)`)
@@ -32,6 +34,8 @@ type API struct {
 	db      storage.Connection
 	config  *conf.GlobalConfiguration
 	version string
+	jwks    *jwksCache
+	replay  *replayCache
 }
 
 type GatewayClaims struct {
@@ -41,6 +45,12 @@ type GatewayClaims struct {
 	UserMetaData map[string]interface{} `json:"user_metadata"`
 }
 
+// conn returns the database connection, tracing its calls as part of the
+// request in ctx.
+func (a *API) conn(ctx context.Context) storage.Connection {
+	return storage.WithContext(ctx, a.db)
+}
+
 // ListenAndServe starts the REST API
 func (a *API) ListenAndServe(hostAndPort string) {
 	log := logrus.WithField("component", "api")
@@ -49,16 +59,32 @@ func (a *API) ListenAndServe(hostAndPort string) {
 		Addr:    hostAndPort,
 		Handler: a.handler,
 	}
+	servers := []*http.Server{server}
+	if addr := a.config.Metrics.Address; addr != "" {
+		metrics := &http.Server{
+			Addr:    addr,
+			Handler: newMetricsHandler(),
+		}
+		servers = append(servers, metrics)
+		go func() {
+			log.Infof("Metrics served on: %s", addr)
+			if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.WithError(err).Fatal("Metrics server failed")
+			}
+		}()
+	}
 	done := make(chan struct{})
 	defer close(done)
 	go func() {
 		waitForTermination(log, done)
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 		defer cancel()
-		server.Shutdown(ctx)
+		for _, s := range servers {
+			s.Shutdown(ctx)
+		}
 	}()
 
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.WithError(err).Fatal("API server failed")
 	}
 }
@@ -82,27 +108,36 @@ func NewAPI(globalConfig *conf.GlobalConfiguration, db storage.Connection) *API
 
 // NewAPIWithVersion creates a new REST API using the specified version
 func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfiguration, db storage.Connection, version string) *API {
-	api := &API{config: globalConfig, db: db, version: version}
+	api := &API{config: globalConfig, db: db, version: version, jwks: newJWKSCache(), replay: newReplayCache()}
 
 	xffmw, _ := xff.Default()
 
 	r := newRouter()
 	r.UseBypass(xffmw.Handler)
-	r.Use(addRequestID)
+	r.UseBypass(traceRequest)
+	r.Use(traced("addRequestID", addRequestID))
 	r.UseBypass(newStructuredLogger(logrus.StandardLogger()))
 	r.Use(recoverer)
 
 	r.Get("/health", api.HealthCheck)
+	if globalConfig.Metrics.Address == "" {
+		// metrics label requests by instance, they aren't public
+		r.With(api.verifyOperatorRequest).Mount("/metrics", promhttp.Handler())
+	}
 
+	requireAuthentication := traced("requireAuthentication", api.requireAuthentication)
 	r.Route("/", func(r *router) {
 		if globalConfig.MultiInstanceMode {
 			r.Use(api.loadJWSSignatureHeader)
-			r.Use(api.loadInstanceConfig)
+			r.Use(traced("loadInstanceConfig", api.loadInstanceConfig))
 		}
-		r.With(api.requireAuthentication).Mount("/github", NewGitHubGateway())
-		r.With(api.requireAuthentication).Mount("/gitlab", NewGitLabGateway())
-		r.With(api.requireAuthentication).Mount("/bitbucket", NewBitBucketGateway())
-		r.With(api.requireAuthentication).Get("/settings", api.Settings)
+		r.WithBypass(instrumentGateway("github", githubEndpointGroup)).With(requireAuthentication).
+			Mount("/github", api.auditHandler("github", githubBranchUpdate, NewGitHubGateway()))
+		r.WithBypass(instrumentGateway("gitlab", gitlabEndpointGroup)).With(requireAuthentication).
+			Mount("/gitlab", api.auditHandler("gitlab", gitlabBranchUpdate, NewGitLabGateway()))
+		r.WithBypass(instrumentGateway("bitbucket", bitbucketEndpointGroup)).With(requireAuthentication).
+			Mount("/bitbucket", api.auditHandler("bitbucket", bitbucketBranchUpdate, NewBitBucketGateway()))
+		r.With(requireAuthentication).Get("/settings", api.Settings)
 	})
 
 	if globalConfig.MultiInstanceMode {
@@ -111,20 +146,28 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 		r.Route("/instances", func(r *router) {
 			r.Use(api.verifyOperatorRequest)
 
+			r.Get("/", api.ListInstances)
 			r.Post("/", api.CreateInstance)
 			r.Route("/{instance_id}", func(r *router) {
 				r.Use(api.loadInstance)
 
 				r.Get("/", api.GetInstance)
 				r.Put("/", api.UpdateInstance)
+				r.Patch("/", api.PatchInstance)
 				r.Delete("/", api.DeleteInstance)
+				r.Post("/suspend", api.SuspendInstance)
+				r.Post("/resume", api.ResumeInstance)
+				r.Post("/restore", api.RestoreInstance)
+				r.Get("/audit", api.ListAuditEntries)
+				r.Get("/revisions", api.ListInstanceRevisions)
+				r.Post("/revisions/{revision}/restore", api.RestoreInstanceRevision)
 			})
 		})
 	}
 
 	corsHandler := cors.New(cors.Options{
 		AllowedMethods:   []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Private-Token", "Content-Type", audHeaderName},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Private-Token", "Content-Type", audHeaderName, requestIDHeaderName, "traceparent", "tracestate"},
 		AllowCredentials: true,
 		MaxAge:           86400,
 	})
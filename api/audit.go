@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/netlify/git-gateway/models"
+	"github.com/pborman/uuid"
+)
+
+// maxAuditResponseSize limits how much of a response is kept to look for the
+// resulting commit.
+const maxAuditResponseSize = 1 << 20
+
+var commitSHARegexp = regexp.MustCompile("^[0-9a-f]{40}([0-9a-f]{24})?$")
+var commitLocationRegexp = regexp.MustCompile("/commit/([0-9a-f]{40}([0-9a-f]{24})?)$")
+
+// auditHandler records every mutating request proxied through a gateway.
+func (a *API) auditHandler(provider string, branches branchUpdateFunc, gateway http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWriteMethod(r.Method) {
+			gateway.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		entry := &models.AuditEntry{
+			ID:         uuid.NewRandom().String(),
+			InstanceID: getInstanceID(ctx),
+			Provider:   provider,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+		}
+		if claims := getClaims(ctx); claims != nil {
+			entry.UserID = claims.Subject
+			entry.Email = claims.Email
+		}
+		// the body must be read before it's consumed by the proxy
+		if update, err := branches(r); err == nil && update != nil && len(update.Branches) > 0 {
+			entry.Branch = update.Branches[0]
+			if entry.Branch == "" {
+				entry.Branch = getConfig(ctx).Branches.DefaultBranch
+			}
+		}
+
+		rw := &auditResponseWriter{ResponseWriter: w}
+		gateway.ServeHTTP(rw, r)
+
+		entry.Status = rw.statusCode()
+		if entry.Status < http.StatusBadRequest {
+			entry.CommitSHA = rw.commitSHA()
+		}
+		entry.CreatedAt = time.Now()
+		if err := a.conn(r.Context()).CreateAuditEntry(entry); err != nil {
+			getLogEntry(r).WithError(err).Error("Failed storing audit entry")
+		}
+	})
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := maxAuditResponseSize - w.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		w.body.Write(b[:room])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *auditResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// commitSHA looks for the commit created by the request in the provider
+// response.
+func (w *auditResponseWriter) commitSHA() string {
+	if m := commitLocationRegexp.FindStringSubmatch(w.Header().Get("Location")); m != nil {
+		return m[1]
+	}
+
+	body := w.body.Bytes()
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return ""
+		}
+		defer reader.Close()
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			return ""
+		}
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return ""
+	}
+
+	// GitHub names commits "sha", GitLab "id" and Bitbucket "hash"
+	candidates := []interface{}{data["merge_commit_sha"], data["sha"], data["id"], data["hash"]}
+	for _, nested := range []string{"commit", "object", "merge_commit", "target"} {
+		if obj, ok := data[nested].(map[string]interface{}); ok {
+			candidates = append(candidates, obj["sha"], obj["hash"])
+		}
+	}
+	for _, c := range candidates {
+		if sha, ok := c.(string); ok && commitSHARegexp.MatchString(sha) {
+			return sha
+		}
+	}
+	return ""
+}
+
+// ListAuditEntries returns the audit entries of an instance, filtered by the
+// user, from, to and path query parameters.
+func (a *API) ListAuditEntries(w http.ResponseWriter, r *http.Request) error {
+	i := getInstance(r.Context())
+	params := r.URL.Query()
+
+	pagination, err := paginate(r)
+	if err != nil {
+		return err
+	}
+
+	filter := &models.AuditFilter{
+		User: params.Get("user"),
+		Path: params.Get("path"),
+	}
+	if v := params.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return badRequestError("Invalid from time, expected RFC3339: %v", err)
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return badRequestError("Invalid to time, expected RFC3339: %v", err)
+		}
+	}
+
+	entries, err := a.conn(r.Context()).FindAuditEntries(i.ID, filter, pagination)
+	if err != nil {
+		return internalServerError("Database error finding audit entries").WithInternalError(err)
+	}
+
+	addPaginationHeaders(w, r, pagination)
+	return sendJSON(w, http.StatusOK, entries)
+}
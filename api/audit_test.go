@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSHA(n int) string {
+	return fmt.Sprintf("%040x", n)
+}
+
+func TestAuditHandler(t *testing.T) {
+	api := &API{db: memory.New()}
+	config := &conf.Configuration{Branches: conf.BranchProtection{DefaultBranch: "main"}}
+
+	type upstream func(w http.ResponseWriter, r *http.Request)
+	respondJSON := func(status int, body string) upstream {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}
+	}
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	gz.Write([]byte(`{"commit":{"sha":"` + testSHA(7) + `"}}`))
+	require.NoError(t, gz.Close())
+
+	cases := []struct {
+		name        string
+		provider    string
+		branches    branchUpdateFunc
+		method      string
+		path        string
+		contentType string
+		body        string
+		upstream    upstream
+		status      int
+		sha         string
+		branch      string
+	}{
+		{"GitHubContents", "github", githubBranchUpdate, http.MethodPut, "/github/contents/post.md", "application/json", `{"branch":"cms/post"}`,
+			respondJSON(http.StatusCreated, `{"content":{"sha":"blob"},"commit":{"sha":"`+testSHA(1)+`"}}`), http.StatusCreated, testSHA(1), "cms/post"},
+		{"GitHubPullMerge", "github", githubBranchUpdate, http.MethodPut, "/github/pulls/1/merge", "application/json", ``,
+			respondJSON(http.StatusOK, `{"sha":"`+testSHA(2)+`","merged":true}`), http.StatusOK, testSHA(2), ""},
+		{"GitHubGzip", "github", githubBranchUpdate, http.MethodDelete, "/github/contents/old.md", "application/json", `{}`,
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(gzipped.Bytes())
+			}, http.StatusOK, testSHA(7), "main"},
+		{"GitLabCommit", "gitlab", gitlabBranchUpdate, http.MethodPost, "/gitlab/repository/commits", "application/json", `{"branch":"cms/post","actions":[]}`,
+			respondJSON(http.StatusCreated, `{"id":"`+testSHA(3)+`","short_id":"abc"}`), http.StatusCreated, testSHA(3), "cms/post"},
+		{"GitLabMerge", "gitlab", gitlabBranchUpdate, http.MethodPut, "/gitlab/merge_requests/2/merge", "application/json", ``,
+			respondJSON(http.StatusOK, `{"id":12,"merge_commit_sha":"`+testSHA(4)+`"}`), http.StatusOK, testSHA(4), ""},
+		{"BitBucketSrc", "bitbucket", bitbucketBranchUpdate, http.MethodPost, "/bitbucket/src", "application/x-www-form-urlencoded", `branch=cms%2Fpost&post.md=hello`,
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Location", "https://api.bitbucket.org/2.0/repositories/owner/repo/commit/"+testSHA(5))
+				w.WriteHeader(http.StatusCreated)
+			}, http.StatusCreated, testSHA(5), "cms/post"},
+		{"UpstreamRejected", "github", githubBranchUpdate, http.MethodPut, "/github/contents/conflict.md", "application/json", `{"branch":"cms/post"}`,
+			respondJSON(http.StatusConflict, `{"message":"conflict","sha":"`+testSHA(9)+`"}`), http.StatusConflict, "", "cms/post"},
+		{"UpstreamUnreachable", "gitlab", gitlabBranchUpdate, http.MethodPost, "/gitlab/repository/files/post.md", "application/json", `{"branch":"cms/post"}`,
+			func(w http.ResponseWriter, r *http.Request) {
+				proxyErrorHandler(w, r, errors.New("connection refused"))
+			}, http.StatusBadGateway, "", "cms/post"},
+	}
+
+	serve := func(provider string, branches branchUpdateFunc, method, path, contentType, body string, gateway upstream) *httptest.ResponseRecorder {
+		ctx := withConfig(context.Background(), config)
+		ctx = withInstanceID(ctx, "instance-1")
+		ctx = withToken(ctx, &jwt.Token{Claims: testClaims()})
+		r := httptest.NewRequest(method, path, strings.NewReader(body)).WithContext(ctx)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		api.auditHandler(provider, branches, http.HandlerFunc(gateway)).ServeHTTP(w, r)
+		return w
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := serve(c.provider, c.branches, c.method, c.path, c.contentType, c.body, c.upstream)
+			assert.Equal(t, c.status, w.Code, "the response reaches the client")
+
+			entries, err := api.db.FindAuditEntries("instance-1", &models.AuditFilter{Path: c.path}, nil)
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			e := entries[0]
+			assert.Equal(t, c.provider, e.Provider)
+			assert.Equal(t, c.method, e.Method)
+			assert.Equal(t, c.status, e.Status)
+			assert.Equal(t, c.sha, e.CommitSHA)
+			assert.Equal(t, c.branch, e.Branch)
+			assert.Equal(t, "user", e.UserID)
+			assert.Equal(t, "user@example.com", e.Email)
+		})
+	}
+
+	t.Run("ReadsAreNotRecorded", func(t *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions} {
+			w := serve("github", githubBranchUpdate, method, "/github/contents/read.md", "", "", respondJSON(http.StatusOK, `{"sha":"`+testSHA(10)+`"}`))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+		entries, err := api.db.FindAuditEntries("instance-1", &models.AuditFilter{Path: "/github/contents/read.md"}, nil)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestListAuditEntries(t *testing.T) {
+	api := newOperatorAPI(t)
+	instance := createTestInstance(t, api, "uuid-1", &conf.Configuration{JWT: testJWT})
+	other := createTestInstance(t, api, "uuid-2", &conf.Configuration{JWT: testJWT})
+
+	for i, e := range []models.AuditEntry{
+		{UserID: "user-1", Email: "jane@example.com", Path: "/github/contents/a.md"},
+		{UserID: "user-1", Email: "jane@example.com", Path: "/github/contents/b.md"},
+		{UserID: "user-2", Email: "joe@example.com", Path: "/github/git/refs"},
+		{UserID: "user-2", Email: "joe@example.com", Path: "/github/contents/c.md"},
+	} {
+		e.ID = fmt.Sprintf("entry-%d", i)
+		e.InstanceID = instance.ID
+		require.NoError(t, api.db.CreateAuditEntry(&e))
+	}
+	require.NoError(t, api.db.CreateAuditEntry(&models.AuditEntry{ID: "other", InstanceID: other.ID, UserID: "user-1"}))
+
+	list := func(query string) ([]*models.AuditEntry, *httptest.ResponseRecorder) {
+		w := operatorRequest(t, api, http.MethodGet, "/instances/"+instance.ID+"/audit"+query, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		entries := []*models.AuditEntry{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		return entries, w
+	}
+	paths := func(entries []*models.AuditEntry) []string {
+		found := []string{}
+		for _, e := range entries {
+			found = append(found, e.Path)
+		}
+		return found
+	}
+
+	entries, w := list("")
+	assert.Len(t, entries, 4)
+	assert.Equal(t, "4", w.Header().Get("X-Total-Count"))
+
+	entries, _ = list("?user=user-1")
+	assert.ElementsMatch(t, []string{"/github/contents/a.md", "/github/contents/b.md"}, paths(entries))
+	entries, _ = list("?user=joe@example.com")
+	assert.ElementsMatch(t, []string{"/github/git/refs", "/github/contents/c.md"}, paths(entries))
+	entries, _ = list("?path=/github/contents")
+	assert.Len(t, entries, 3)
+	entries, _ = list("?user=user-2&path=/github/contents")
+	assert.Equal(t, []string{"/github/contents/c.md"}, paths(entries))
+
+	hourAgo := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	inAnHour := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	entries, _ = list("?from=" + hourAgo + "&to=" + inAnHour)
+	assert.Len(t, entries, 4)
+	entries, _ = list("?from=" + inAnHour)
+	assert.Empty(t, entries)
+	entries, _ = list("?to=" + hourAgo)
+	assert.Empty(t, entries)
+
+	first, w := list("?per_page=3")
+	assert.Len(t, first, 3)
+	assert.Equal(t, "4", w.Header().Get("X-Total-Count"))
+	assert.Contains(t, w.Header().Get("Link"), `rel="next"`)
+	second, w := list("?per_page=3&page=2")
+	assert.Len(t, second, 1)
+	assert.NotContains(t, w.Header().Get("Link"), `rel="next"`)
+	assert.ElementsMatch(t, []string{"/github/contents/a.md", "/github/contents/b.md", "/github/git/refs", "/github/contents/c.md"}, paths(append(first, second...)))
+
+	w = operatorRequest(t, api, http.MethodGet, "/instances/"+instance.ID+"/audit?from=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = operatorRequest(t, api, http.MethodGet, "/instances/"+instance.ID+"/audit?page=0", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
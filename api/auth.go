@@ -2,9 +2,13 @@ package api
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
 	"net/http"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
 	"github.com/sirupsen/logrus"
 )
 
@@ -13,10 +17,11 @@ func (a *API) requireAuthentication(w http.ResponseWriter, r *http.Request) (con
 	logrus.Info("Getting auth token")
 	token, err := a.extractBearerToken(w, r)
 	if err != nil {
+		observeAuthFailure("missing_token")
 		return nil, err
 	}
 
-	logrus.Infof("Parsing JWT claims: %v", token)
+	logrus.Info("Parsing JWT claims")
 	return a.parseJWTClaims(token, r)
 }
 
@@ -36,13 +41,108 @@ func (a *API) extractBearerToken(w http.ResponseWriter, r *http.Request) (string
 
 func (a *API) parseJWTClaims(bearer string, r *http.Request) (context.Context, error) {
 	config := getConfig(r.Context())
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
+	p := jwt.Parser{ValidMethods: validSigningMethods(&config.JWT)}
 	token, err := p.ParseWithClaims(bearer, &GatewayClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT.Secret), nil
+		return a.verificationKey(&config.JWT, token)
 	})
 	if err != nil {
+		observeAuthFailure("invalid_token")
 		return nil, unauthorizedError("Invalid token: %v", err)
 	}
 
+	claims := token.Claims.(*GatewayClaims)
+	if err := verifyIssuer(&config.JWT, claims); err != nil {
+		observeAuthFailure("issuer")
+		return nil, err
+	}
+	if err := verifyAudience(&config.JWT, claims, r.Header.Get(audHeaderName)); err != nil {
+		observeAuthFailure("audience")
+		return nil, err
+	}
+
 	return withToken(r.Context(), token), nil
 }
+
+// verifyIssuer checks the iss claim against the configured issuers.
+func verifyIssuer(config *conf.JWTConfiguration, claims *GatewayClaims) error {
+	if len(config.Issuers) == 0 {
+		return nil
+	}
+	for _, iss := range config.Issuers {
+		if claims.Issuer == iss {
+			return nil
+		}
+	}
+	return unauthorizedError("Invalid token: issuer %q is not accepted", claims.Issuer)
+}
+
+// verifyAudience checks the aud claim against the audience requested with
+// the X-JWT-AUD header, or any configured audience when none is requested.
+func verifyAudience(config *conf.JWTConfiguration, claims *GatewayClaims, requested string) error {
+	if len(config.Audiences) == 0 {
+		return nil
+	}
+
+	if requested != "" {
+		if !containsString(config.Audiences, requested) {
+			return unauthorizedError("Invalid token: audience %q requested in %s is not allowed", requested, audHeaderName)
+		}
+		if claims.Audience != requested {
+			return unauthorizedError("Invalid token: audience %q does not match requested audience %q", claims.Audience, requested)
+		}
+		return nil
+	}
+
+	if !containsString(config.Audiences, claims.Audience) {
+		return unauthorizedError("Invalid token: audience %q is not accepted", claims.Audience)
+	}
+	return nil
+}
+
+// validSigningMethods lists the algorithms accepted with the given configuration.
+func validSigningMethods(config *conf.JWTConfiguration) []string {
+	methods := []string{}
+	if config.Secret != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Name)
+	}
+	if config.JWKSSource() != "" {
+		methods = append(methods, jwt.SigningMethodRS256.Name, jwt.SigningMethodES256.Name)
+	}
+	return methods
+}
+
+// verificationKey returns the key used to verify the token signature: the
+// shared secret for HS256, or the matching JWKS key for RS256/ES256.
+func (a *API) verificationKey(config *conf.JWTConfiguration, token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return []byte(config.Secret), nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		// instance configs are set through the operator API, they must not
+		// reach files or internal services of the gateway host
+		var check jwksURLCheck
+		if a.config != nil && a.config.MultiInstanceMode {
+			if err := a.config.ValidateInstanceJWKS(config); err != nil {
+				return nil, err
+			}
+			check = a.config.CheckInstanceJWKSURL
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, err := a.jwks.lookupKey(config, kid, check)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("key %q does not match signing method %s", kid, token.Method.Alg())
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
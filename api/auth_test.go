@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJWTClaimsAudienceAndIssuer(t *testing.T) {
+	a := &API{jwks: newJWKSCache()}
+	config := &conf.Configuration{JWT: conf.JWTConfiguration{
+		Secret:    "secret",
+		Issuers:   []string{"https://identity.example.com"},
+		Audiences: []string{"cms", "preview"},
+	}}
+
+	cases := []struct {
+		name   string
+		iss    string
+		aud    string
+		header string
+		code   int
+	}{
+		{"Valid", "https://identity.example.com", "cms", "", 0},
+		{"ValidRequested", "https://identity.example.com", "preview", "preview", 0},
+		{"WrongIssuer", "https://other.example.com", "cms", "", http.StatusUnauthorized},
+		{"WrongAudience", "https://identity.example.com", "other", "", http.StatusUnauthorized},
+		{"RequestedNotAllowed", "https://identity.example.com", "other", "other", http.StatusUnauthorized},
+		{"RequestedMismatch", "https://identity.example.com", "cms", "preview", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims := testClaims()
+			claims.Issuer = c.iss
+			claims.Audience = c.aud
+			req := signedRequestWithClaims(t, config, jwt.SigningMethodHS256, "", []byte("secret"), claims)
+			if c.header != "" {
+				req.Header.Set(audHeaderName, c.header)
+			}
+
+			_, err := a.requireAuthentication(httptest.NewRecorder(), req)
+			if c.code == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.IsType(t, &HTTPError{}, err)
+			assert.Equal(t, c.code, err.(*HTTPError).Code)
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/netlify/git-gateway/conf"
+)
+
+// commitAuthor is the identity of the editor commits are attributed to.
+type commitAuthor struct {
+	Name  string
+	Email string
+}
+
+func (a *commitAuthor) String() string {
+	return fmt.Sprintf("%s <%s>", a.Name, a.Email)
+}
+
+func (a *commitAuthor) trailer() string {
+	return "Co-authored-by: " + a.String()
+}
+
+// editorIdentity builds the commit identity of the authenticated editor from
+// the email and the user_metadata full_name of the claims.
+func editorIdentity(claims *GatewayClaims) *commitAuthor {
+	if claims == nil || claims.Email == "" {
+		return nil
+	}
+	name, _ := claims.UserMetaData["full_name"].(string)
+	if name == "" {
+		name = claims.Email
+	}
+	return &commitAuthor{Name: name, Email: claims.Email}
+}
+
+// withCoAuthor appends a Co-authored-by trailer to message unless it's
+// already present.
+func withCoAuthor(message string, author *commitAuthor) string {
+	trailer := author.trailer()
+	if strings.Contains(message, trailer) {
+		return message
+	}
+	return strings.TrimRight(message, "\n") + "\n\n" + trailer
+}
+
+type authorRewriteFunc func(r *http.Request, author *commitAuthor, policy string) error
+
+// rewriteCommitAuthor applies the configured commit author policy to the
+// request body.
+func rewriteCommitAuthor(r *http.Request, rewrite authorRewriteFunc) error {
+	ctx := r.Context()
+	policy := getConfig(ctx).CommitAuthor
+	if policy == "" || !isWriteMethod(r.Method) {
+		return nil
+	}
+	author := editorIdentity(getClaims(ctx))
+	if author == nil {
+		return nil
+	}
+	return rewrite(r, author, policy)
+}
+
+// setRequestBody replaces the body of r, keeping its length in sync.
+func setRequestBody(r *http.Request, body []byte) {
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// rewriteJSONBody lets fn modify the JSON object in the body of r.
+func rewriteJSONBody(r *http.Request, fn func(body map[string]interface{})) error {
+	data, err := readRequestBody(r)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{}
+	if len(data) > 0 {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&body); err != nil {
+			return err
+		}
+	}
+	fn(body)
+	data, err = json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	setRequestBody(r, data)
+	return nil
+}
+
+// githubCommitAuthor rewrites the author and committer of the contents and
+// git commits APIs.
+func githubCommitAuthor(r *http.Request, author *commitAuthor, policy string) error {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	contents := strings.HasPrefix(path, "/github/contents") && (r.Method == http.MethodPut || r.Method == http.MethodDelete)
+	commits := path == "/github/git/commits" && r.Method == http.MethodPost
+	if !contents && !commits {
+		return nil
+	}
+
+	return rewriteJSONBody(r, func(body map[string]interface{}) {
+		person := func() map[string]interface{} {
+			return map[string]interface{}{"name": author.Name, "email": author.Email}
+		}
+		switch policy {
+		case conf.CommitAuthorOverride:
+			body["author"] = person()
+			body["committer"] = person()
+		case conf.CommitAuthorFillMissing:
+			if body["author"] == nil {
+				body["author"] = person()
+			}
+		case conf.CommitAuthorCoAuthor:
+			message, _ := body["message"].(string)
+			body["message"] = withCoAuthor(message, author)
+		}
+	})
+}
+
+// gitlabCommitAuthor rewrites the author of the files and commits APIs.
+func gitlabCommitAuthor(r *http.Request, author *commitAuthor, policy string) error {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	files := strings.HasPrefix(path, "/gitlab/repository/files")
+	commits := path == "/gitlab/repository/commits" && r.Method == http.MethodPost
+	if !files && !commits {
+		return nil
+	}
+
+	return rewriteJSONBody(r, func(body map[string]interface{}) {
+		switch policy {
+		case conf.CommitAuthorOverride:
+			body["author_name"] = author.Name
+			body["author_email"] = author.Email
+		case conf.CommitAuthorFillMissing:
+			if body["author_email"] == nil {
+				body["author_name"] = author.Name
+				body["author_email"] = author.Email
+			}
+		case conf.CommitAuthorCoAuthor:
+			message, _ := body["commit_message"].(string)
+			body["commit_message"] = withCoAuthor(message, author)
+		}
+	})
+}
+
+// bitbucketCommitAuthor rewrites the author of src form posts.
+func bitbucketCommitAuthor(r *http.Request, author *commitAuthor, policy string) error {
+	return rewriteForm(r, func(form url.Values) {
+		switch policy {
+		case conf.CommitAuthorOverride:
+			form.Set("author", author.String())
+		case conf.CommitAuthorFillMissing:
+			if form.Get("author") == "" {
+				form.Set("author", author.String())
+			}
+		case conf.CommitAuthorCoAuthor:
+			form.Set("message", withCoAuthor(form.Get("message"), author))
+		}
+	})
+}
+
+// rewriteForm lets fn modify the plain fields of the url encoded or
+// multipart form in the body of r. File parts are copied as they are.
+func rewriteForm(r *http.Request, fn func(form url.Values)) error {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		data, err := readRequestBody(r)
+		if err != nil {
+			return err
+		}
+		form, err := url.ParseQuery(string(data))
+		if err != nil {
+			return err
+		}
+		fn(form)
+		setRequestBody(r, []byte(form.Encode()))
+		return nil
+	}
+
+	data, err := readRequestBody(r)
+	if err != nil {
+		return err
+	}
+	reader := multipart.NewReader(bytes.NewReader(data), params["boundary"])
+
+	// collect the plain fields first, so fn sees the whole form
+	fields := url.Values{}
+	fieldOrder := []string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(part)
+			if err != nil {
+				return err
+			}
+			if _, ok := fields[part.FormName()]; !ok {
+				fieldOrder = append(fieldOrder, part.FormName())
+			}
+			fields.Add(part.FormName(), string(value))
+		}
+	}
+	fn(fields)
+	for name := range fields {
+		if !containsString(fieldOrder, name) {
+			fieldOrder = append(fieldOrder, name)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	writer := multipart.NewWriter(out)
+	if err := writer.SetBoundary(params["boundary"]); err != nil {
+		return err
+	}
+	for _, name := range fieldOrder {
+		for _, value := range fields[name] {
+			if err := writer.WriteField(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	reader = multipart.NewReader(bytes.NewReader(data), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		w, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, part); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	setRequestBody(r, out.Bytes())
+	return nil
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func authorRequest(policy, method, path, contentType string, body []byte) *http.Request {
+	claims := testClaims()
+	claims.UserMetaData = map[string]interface{}{"full_name": "Jane Editor"}
+	ctx := withConfig(context.Background(), &conf.Configuration{CommitAuthor: policy})
+	ctx = withToken(ctx, &jwt.Token{Claims: claims})
+
+	r := httptest.NewRequest(method, path, bytes.NewReader(body)).WithContext(ctx)
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+func decodeBody(t *testing.T, r *http.Request) map[string]interface{} {
+	data, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), r.ContentLength)
+	body := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &body))
+	return body
+}
+
+func TestGitHubCommitAuthor(t *testing.T) {
+	body := []byte(`{"message":"Update post","content":"aGVsbG8=","author":{"name":"Someone","email":"someone@example.com"}}`)
+
+	r := authorRequest(conf.CommitAuthorOverride, http.MethodPut, "/github/contents/post.md", "application/json", body)
+	require.NoError(t, rewriteCommitAuthor(r, githubCommitAuthor))
+	out := decodeBody(t, r)
+	assert.Equal(t, map[string]interface{}{"name": "Jane Editor", "email": "user@example.com"}, out["author"])
+	assert.Equal(t, map[string]interface{}{"name": "Jane Editor", "email": "user@example.com"}, out["committer"])
+	assert.Equal(t, "aGVsbG8=", out["content"])
+
+	r = authorRequest(conf.CommitAuthorFillMissing, http.MethodPost, "/github/git/commits", "application/json", body)
+	require.NoError(t, rewriteCommitAuthor(r, githubCommitAuthor))
+	out = decodeBody(t, r)
+	assert.Equal(t, "Someone", out["author"].(map[string]interface{})["name"])
+
+	r = authorRequest(conf.CommitAuthorCoAuthor, http.MethodPost, "/github/git/commits", "application/json", body)
+	require.NoError(t, rewriteCommitAuthor(r, githubCommitAuthor))
+	out = decodeBody(t, r)
+	assert.Equal(t, "Update post\n\nCo-authored-by: Jane Editor <user@example.com>", out["message"])
+}
+
+func TestGitLabCommitAuthor(t *testing.T) {
+	body := []byte(`{"branch":"master","commit_message":"Update post","actions":[]}`)
+
+	r := authorRequest(conf.CommitAuthorFillMissing, http.MethodPost, "/gitlab/repository/commits", "application/json", body)
+	require.NoError(t, rewriteCommitAuthor(r, gitlabCommitAuthor))
+	out := decodeBody(t, r)
+	assert.Equal(t, "Jane Editor", out["author_name"])
+	assert.Equal(t, "user@example.com", out["author_email"])
+}
+
+func TestBitBucketCommitAuthor(t *testing.T) {
+	data := &bytes.Buffer{}
+	w := multipart.NewWriter(data)
+	require.NoError(t, w.WriteField("message", "Update post"))
+	fw, err := w.CreateFormFile("content/post.md", "post.md")
+	require.NoError(t, err)
+	fw.Write([]byte("hello"))
+	require.NoError(t, w.Close())
+
+	r := authorRequest(conf.CommitAuthorOverride, http.MethodPost, "/bitbucket/src", w.FormDataContentType(), data.Bytes())
+	require.NoError(t, rewriteCommitAuthor(r, bitbucketCommitAuthor))
+	require.NoError(t, r.ParseMultipartForm(maxFormMemory))
+	assert.Equal(t, "Jane Editor <user@example.com>", r.MultipartForm.Value["author"][0])
+	assert.Equal(t, "Update post", r.MultipartForm.Value["message"][0])
+	require.Len(t, r.MultipartForm.File["content/post.md"], 1)
+	f, err := r.MultipartForm.File["content/post.md"][0].Open()
+	require.NoError(t, err)
+	content, _ := ioutil.ReadAll(f)
+	assert.Equal(t, "hello", string(content))
+}
@@ -5,7 +5,6 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
-	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -103,12 +102,15 @@ func bitbucketDirector(r *http.Request) {
 		r.Header.Set("User-Agent", "")
 	}
 
+	if id := getRequestID(ctx); id != "" {
+		r.Header.Set(requestIDHeaderName, id)
+	}
 	if r.Method != http.MethodOptions {
 		r.Header.Set("Authorization", "Bearer "+accessToken)
 	}
 
 	log := getLogEntry(r)
-	log.Infof("Proxying to BitBucket: %v", r.URL.String(), r.Header.Get("Authorization"))
+	log.Infof("Proxying to BitBucket: %v", r.URL.String())
 }
 
 func (bb *BitBucketGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -120,7 +122,13 @@ func (bb *BitBucketGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := bb.authenticate(w, r); err != nil {
-		handleError(unauthorizedError(err.Error()), w, r)
+		observeAuthFailure(accessDeniedReason(err))
+		handleError(accessDeniedHTTPError(err), w, r)
+		return
+	}
+
+	if err := rewriteCommitAuthor(r, bitbucketCommitAuthor); err != nil {
+		handleError(badRequestError("Unable to set commit author: %v", err), w, r)
 		return
 	}
 
@@ -146,34 +154,32 @@ func (bb *BitBucketGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (bb *BitBucketGateway) authenticate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	claims := getClaims(ctx)
-	config := getConfig(ctx)
 
 	if claims == nil {
-		return errors.New("Access to endpoint not allowed: no claims found in Bearer token")
+		return accessDenied("no_claims", "Access to endpoint not allowed: no claims found in Bearer token")
 	}
 
 	if !bitbucketAllowedRegexp.MatchString(r.URL.Path) {
-		return errors.New("Access to endpoint not allowed: this part of BitBucket's API has been restricted")
+		return accessDenied("endpoint", "Access to endpoint not allowed: this part of BitBucket's API has been restricted")
 	}
 
-	if len(config.Roles) == 0 {
-		return nil
+	if err := authorizeRoles(r, bitbucketEndpointGroup(r.URL.Path)); err != nil {
+		return err
 	}
 
-	roles, ok := claims.AppMetaData["roles"]
-	if ok {
-		roleStrings, _ := roles.([]interface{})
-		for _, data := range roleStrings {
-			role, _ := data.(string)
-			for _, adminRole := range config.Roles {
-				if role == adminRole {
-					return nil
-				}
-			}
-		}
+	if err := authorizePaths(r, bitbucketWrittenPaths); err != nil {
+		return err
 	}
 
-	return errors.New("Access to endpoint not allowed: your role doesn't allow access")
+	return authorizeBranches(r, bitbucketBranchUpdate)
+}
+
+// bitbucketEndpointGroup maps an allowed BitBucket path to its endpoint group.
+func bitbucketEndpointGroup(path string) string {
+	if !bitbucketAllowedRegexp.MatchString(path) {
+		return endpointOther
+	}
+	return endpointContents
 }
 
 func rewriteBitBucketLink(link, endpointAPIURL, proxyAPIURL string) string {
@@ -235,7 +241,7 @@ type BitBucketTransport struct{}
 func (t *BitBucketTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	ctx := r.Context()
 	config := getConfig(ctx)
-	resp, err := http.DefaultTransport.RoundTrip(r)
+	resp, err := tracedRoundTrip("bitbucket", r)
 	if err != nil {
 		return resp, err
 	}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const refsHeadsPrefix = "refs/heads/"
+
+// branchUpdate lists the branches written by a request. An empty branch name
+// stands for the default branch. Merge is set when the request merges a pull
+// or merge request. Merges that don't name their target are checked against
+// the default branch.
+type branchUpdate struct {
+	Branches []string
+	Merge    bool
+}
+
+type branchUpdateFunc func(r *http.Request) (*branchUpdate, error)
+
+// authorizeBranches checks the branches written by the request against the
+// configured branch protection.
+func authorizeBranches(r *http.Request, extract branchUpdateFunc) error {
+	ctx := r.Context()
+	config := getConfig(ctx)
+	protection := config.Branches
+	if len(protection.Rules) == 0 && len(protection.MergeRoles) == 0 {
+		return nil
+	}
+	if !isWriteMethod(r.Method) {
+		return nil
+	}
+
+	update, err := extract(r)
+	if err != nil {
+		return unreadableRequest(err)
+	}
+	if update == nil {
+		return nil
+	}
+
+	roles := userRoles(getClaims(ctx))
+	if update.Merge && len(protection.MergeRoles) > 0 && !hasAnyRole(roles, protection.MergeRoles) {
+		return accessDenied("merge", "Access to branch not allowed: your role can't merge pull requests")
+	}
+
+	if len(protection.Rules) == 0 {
+		return nil
+	}
+	branches := update.Branches
+	if update.Merge && len(branches) == 0 {
+		branches = []string{""}
+	}
+	for _, branch := range branches {
+		if branch == "" {
+			branch = protection.DefaultBranch
+		}
+		if branch == "" {
+			return accessDenied("branch", "Access to branch not allowed: the request doesn't name a branch and no default branch is configured")
+		}
+		if !protection.Rules.AllowsWrite(roles, branch) {
+			return accessDenied("branch", "Access to branch not allowed: your role can't write to branch %q", branch)
+		}
+	}
+	return nil
+}
+
+// readJSONBody decodes the JSON body of r into v without consuming it. An
+// empty body leaves v untouched.
+func readJSONBody(r *http.Request, v interface{}) error {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+func branchFromRef(ref string) string {
+	return strings.TrimPrefix(strings.Trim(ref, "/"), refsHeadsPrefix)
+}
+
+var githubRefRegexp = regexp.MustCompile("^/github/git/refs/(.+)$")
+var githubBranchRenameRegexp = regexp.MustCompile("^/github/branches/(.+)/rename$")
+
+type githubBranchParams struct {
+	Ref     string `json:"ref"`
+	Branch  string `json:"branch"`
+	Base    string `json:"base"`
+	NewName string `json:"new_name"`
+}
+
+// githubBranchUpdate finds the branch written through the refs, contents,
+// merges and branch rename APIs. A rename writes to both the old and the new
+// branch name.
+func githubBranchUpdate(r *http.Request) (*branchUpdate, error) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case githubPullMergeRegexp.MatchString(r.URL.Path):
+		return &branchUpdate{Merge: true}, nil
+	case path == "/github/git/refs" && r.Method == http.MethodPost:
+		params := githubBranchParams{}
+		if err := readJSONBody(r, &params); err != nil {
+			return nil, err
+		}
+		if params.Ref == "" {
+			return nil, errors.New("missing ref")
+		}
+		return &branchUpdate{Branches: []string{branchFromRef(params.Ref)}}, nil
+	case githubRefRegexp.MatchString(path):
+		ref := "refs/" + githubRefRegexp.FindStringSubmatch(path)[1]
+		return &branchUpdate{Branches: []string{branchFromRef(ref)}}, nil
+	case strings.HasPrefix(path, "/github/contents"):
+		params := githubBranchParams{}
+		if err := readJSONBody(r, &params); err != nil {
+			return nil, err
+		}
+		if params.Branch == "" {
+			params.Branch = r.URL.Query().Get("branch")
+		}
+		return &branchUpdate{Branches: []string{params.Branch}}, nil
+	case path == "/github/merges":
+		params := githubBranchParams{}
+		if err := readJSONBody(r, &params); err != nil {
+			return nil, err
+		}
+		if params.Base == "" {
+			return nil, errors.New("missing base branch")
+		}
+		return &branchUpdate{Branches: []string{params.Base}, Merge: true}, nil
+	case githubBranchRenameRegexp.MatchString(path):
+		params := githubBranchParams{}
+		if err := readJSONBody(r, &params); err != nil {
+			return nil, err
+		}
+		if params.NewName == "" {
+			return nil, errors.New("missing new branch name")
+		}
+		branch := githubBranchRenameRegexp.FindStringSubmatch(path)[1]
+		return &branchUpdate{Branches: []string{branch, params.NewName}}, nil
+	}
+	return nil, nil
+}
+
+var gitlabBranchRegexp = regexp.MustCompile("^/gitlab/repository/branches/(.+)$")
+var gitlabCommitActionRegexp = regexp.MustCompile("^/gitlab/repository/commits/[^/]+/(cherry_pick|revert)$")
+
+type gitlabBranchParams struct {
+	Branch string `json:"branch"`
+}
+
+// gitlabBranchUpdate finds the branch written through the files, commits,
+// cherry pick, revert, branches and merge request APIs.
+func gitlabBranchUpdate(r *http.Request) (*branchUpdate, error) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case gitlabMergeRequestMergeRegexp.MatchString(r.URL.Path):
+		return &branchUpdate{Merge: true}, nil
+	case gitlabBranchRegexp.MatchString(path):
+		return &branchUpdate{Branches: []string{gitlabBranchRegexp.FindStringSubmatch(path)[1]}}, nil
+	case strings.HasPrefix(path, "/gitlab/repository/files"),
+		path == "/gitlab/repository/commits" && r.Method == http.MethodPost,
+		gitlabCommitActionRegexp.MatchString(path) && r.Method == http.MethodPost,
+		path == "/gitlab/repository/branches" && r.Method == http.MethodPost:
+		params := gitlabBranchParams{}
+		if err := readJSONBody(r, &params); err != nil {
+			return nil, err
+		}
+		if params.Branch == "" {
+			params.Branch = r.URL.Query().Get("branch")
+		}
+		if params.Branch == "" {
+			return nil, errors.New("missing branch")
+		}
+		return &branchUpdate{Branches: []string{params.Branch}}, nil
+	}
+	return nil, nil
+}
+
+// bitbucketBranchUpdate finds the branch written through the src API, which
+// defaults to the main branch.
+func bitbucketBranchUpdate(r *http.Request) (*branchUpdate, error) {
+	form, err := parseFormCopy(r)
+	if err != nil {
+		return nil, err
+	}
+	branch := ""
+	if values := form["branch"]; len(values) > 0 {
+		branch = values[0]
+	}
+	return &branchUpdate{Branches: []string{branch}}, nil
+}
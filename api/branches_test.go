@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBranchProtection(t *testing.T) {
+	config := &conf.Configuration{
+		Branches: conf.BranchProtection{
+			Rules: conf.BranchRules{
+				{Pattern: "cms/**", Roles: []string{"editor", "publisher"}},
+				{Pattern: "main", Roles: []string{"publisher"}},
+			},
+			MergeRoles:    []string{"publisher"},
+			DefaultBranch: "main",
+		},
+	}
+
+	cases := []branchCase{
+		{"CreateCMSRef", http.MethodPost, "/github/git/refs", `{"ref":"refs/heads/cms/posts/hello","sha":"abc"}`, "editor", true},
+		{"CreateOtherRef", http.MethodPost, "/github/git/refs", `{"ref":"refs/heads/feature","sha":"abc"}`, "editor", false},
+		{"UpdateCMSRef", http.MethodPatch, "/github/git/refs/heads/cms/posts/hello", `{"sha":"abc"}`, "editor", true},
+		{"UpdateDefaultRef", http.MethodPatch, "/github/git/refs/heads/main", `{"sha":"abc"}`, "editor", false},
+		{"PublisherDefaultRef", http.MethodPatch, "/github/git/refs/heads/main", `{"sha":"abc"}`, "publisher", true},
+		{"ContentsDefaultBranch", http.MethodPut, "/github/contents/README.md", `{"message":"m","content":""}`, "editor", false},
+		{"ContentsCMSBranch", http.MethodPut, "/github/contents/README.md", `{"message":"m","branch":"cms/posts/hello"}`, "editor", true},
+		{"EditorPullMerge", http.MethodPut, "/github/pulls/3/merge", ``, "editor", false},
+		{"PublisherPullMerge", http.MethodPut, "/github/pulls/3/merge", ``, "publisher", true},
+		{"EditorMerges", http.MethodPost, "/github/merges", `{"base":"cms/posts/hello","head":"main"}`, "editor", false},
+		{"GitLabFile", http.MethodPost, "/gitlab/repository/files/README.md", `{"branch":"cms/posts/hello"}`, "editor", true},
+		{"GitLabCommit", http.MethodPost, "/gitlab/repository/commits", `{"branch":"main","actions":[]}`, "editor", false},
+		{"GitLabMerge", http.MethodPut, "/gitlab/merge_requests/4/merge", ``, "editor", false},
+		{"GitLabCherryPick", http.MethodPost, "/gitlab/repository/commits/abc123/cherry_pick", `{"branch":"main"}`, "editor", false},
+		{"GitLabCherryPickCMS", http.MethodPost, "/gitlab/repository/commits/abc123/cherry_pick", `{"branch":"cms/posts/hello"}`, "editor", true},
+		{"GitLabRevert", http.MethodPost, "/gitlab/repository/commits/abc123/revert?branch=main", ``, "editor", false},
+		{"GitLabRevertNoBranch", http.MethodPost, "/gitlab/repository/commits/abc123/revert", ``, "editor", false},
+		{"GitHubRenameMain", http.MethodPost, "/github/branches/main/rename", `{"new_name":"cms/posts/main"}`, "editor", false},
+		{"GitHubRenameToMain", http.MethodPost, "/github/branches/cms/posts/hello/rename", `{"new_name":"main"}`, "editor", false},
+		{"GitHubRenameCMS", http.MethodPost, "/github/branches/cms/posts/hello/rename", `{"new_name":"cms/posts/bye"}`, "editor", true},
+		{"ReadAnyBranch", http.MethodGet, "/github/contents/README.md?ref=main", ``, "editor", true},
+	}
+
+	runBranchCases(t, config, cases)
+}
+
+func TestBranchProtectionMergeWithoutMergeRoles(t *testing.T) {
+	config := &conf.Configuration{
+		Branches: conf.BranchProtection{
+			Rules: conf.BranchRules{
+				{Pattern: "cms/**", Roles: []string{"editor", "publisher"}},
+				{Pattern: "main", Roles: []string{"publisher"}},
+			},
+			DefaultBranch: "main",
+		},
+	}
+	runBranchCases(t, config, []branchCase{
+		{"EditorPullMerge", http.MethodPut, "/github/pulls/3/merge", ``, "editor", false},
+		{"PublisherPullMerge", http.MethodPut, "/github/pulls/3/merge", ``, "publisher", true},
+		{"EditorGitLabMerge", http.MethodPut, "/gitlab/merge_requests/4/merge", ``, "editor", false},
+		{"EditorMergesIntoCMS", http.MethodPost, "/github/merges", `{"base":"cms/posts/hello","head":"main"}`, "editor", true},
+		{"EditorMergesIntoMain", http.MethodPost, "/github/merges", `{"base":"main","head":"cms/posts/hello"}`, "editor", false},
+	})
+
+	// without a default branch the target of a merge can't be checked
+	config.Branches.DefaultBranch = ""
+	runBranchCases(t, config, []branchCase{
+		{"PublisherPullMergeNoDefault", http.MethodPut, "/github/pulls/3/merge", ``, "publisher", false},
+	})
+}
+
+type branchCase struct {
+	name    string
+	method  string
+	path    string
+	body    string
+	role    string
+	allowed bool
+}
+
+func runBranchCases(t *testing.T, config *conf.Configuration, cases []branchCase) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims := testClaims()
+			claims.AppMetaData = map[string]interface{}{"roles": []interface{}{c.role}}
+			ctx := withConfig(context.Background(), config)
+			ctx = withToken(ctx, &jwt.Token{Claims: claims})
+			r := httptest.NewRequest(c.method, c.path, bytes.NewBufferString(c.body)).WithContext(ctx)
+
+			extract := githubBranchUpdate
+			if strings.HasPrefix(c.path, "/gitlab") {
+				extract = gitlabBranchUpdate
+			}
+			err := authorizeBranches(r, extract)
+			assert.Equal(t, c.allowed, err == nil, "unexpected result: %v", err)
+		})
+	}
+}
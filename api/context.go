@@ -29,6 +29,8 @@ const (
 	proxyTargetKey = contextKey("target")
 	signatureKey   = contextKey("signature")
 	netlifyIDKey   = contextKey("netlify_id")
+	providerKey    = contextKey("provider")
+	operatorKey    = contextKey("operator")
 )
 
 // withToken adds the JWT token to the context.
@@ -154,3 +156,31 @@ func getNetlifyID(ctx context.Context) string {
 
 	return obj.(string)
 }
+
+func withProvider(ctx context.Context, provider string) context.Context {
+	return context.WithValue(ctx, providerKey, provider)
+}
+
+func getProvider(ctx context.Context) string {
+	obj := ctx.Value(providerKey)
+	if obj == nil {
+		return ""
+	}
+
+	return obj.(string)
+}
+
+// withOperator adds the name of the operator credential used for the
+// request to the context.
+func withOperator(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, operatorKey, name)
+}
+
+func getOperator(ctx context.Context) string {
+	obj := ctx.Value(operatorKey)
+	if obj == nil {
+		return ""
+	}
+
+	return obj.(string)
+}
@@ -64,10 +64,77 @@ func unauthorizedError(fmtString string, args ...interface{}) *HTTPError {
 	return httpError(http.StatusUnauthorized, fmtString, args...)
 }
 
+func forbiddenError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusForbidden, fmtString, args...)
+}
+
+func conflictError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusConflict, fmtString, args...)
+}
+
+func goneError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusGone, fmtString, args...)
+}
+
+func preconditionFailedError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusPreconditionFailed, fmtString, args...)
+}
+
 func unprocessableEntityError(fmtString string, args ...interface{}) *HTTPError {
 	return httpError(http.StatusUnprocessableEntity, fmtString, args...)
 }
 
+// accessDeniedError is returned when a gateway refuses a request. Reason is
+// a short machine readable cause used to label metrics.
+type accessDeniedError struct {
+	Reason  string
+	Message string
+}
+
+func (e *accessDeniedError) Error() string {
+	return e.Message
+}
+
+func accessDenied(reason string, fmtString string, args ...interface{}) error {
+	return &accessDeniedError{Reason: reason, Message: fmt.Sprintf(fmtString, args...)}
+}
+
+// unreadableRequest refuses a gateway request whose body can't be checked.
+func unreadableRequest(err error) error {
+	if err == errRequestBodyTooLarge {
+		return accessDenied("too_large", "Access to endpoint not allowed: %v", err)
+	}
+	return accessDenied("bad_request", "Access to endpoint not allowed: unable to read request: %v", err)
+}
+
+// accessDeniedHTTPError maps an error refusing a gateway request to its
+// response: 400 when the request can't be read, 413 when its body is too
+// large, 401 without a user token and 403 when the token's roles aren't
+// allowed.
+func accessDeniedHTTPError(err error) *HTTPError {
+	e, ok := err.(*accessDeniedError)
+	if !ok {
+		return forbiddenError("%s", err.Error())
+	}
+	switch e.Reason {
+	case "bad_request":
+		return badRequestError("%s", e.Message)
+	case "too_large":
+		return httpError(http.StatusRequestEntityTooLarge, "%s", e.Message)
+	case "no_claims":
+		return unauthorizedError("%s", e.Message)
+	}
+	return forbiddenError("%s", e.Message)
+}
+
+// accessDeniedReason returns the reason of an access denied error.
+func accessDeniedReason(err error) string {
+	if e, ok := err.(*accessDeniedError); ok {
+		return e.Reason
+	}
+	return "unknown"
+}
+
 // HTTPError is an error with a message and an HTTP status code.
 type HTTPError struct {
 	Code            int    `json:"code"`
@@ -75,6 +142,8 @@ type HTTPError struct {
 	InternalError   error  `json:"-"`
 	InternalMessage string `json:"-"`
 	ErrorID         string `json:"error_id,omitempty"`
+	// Errors details the problem, e.g. the invalid fields of a request.
+	Errors interface{} `json:"errors,omitempty"`
 }
 
 func (e *HTTPError) Error() string {
@@ -104,6 +173,12 @@ func (e *HTTPError) WithInternalMessage(fmtString string, args ...interface{}) *
 	return e
 }
 
+// WithErrors adds details of the problem to the response
+func (e *HTTPError) WithErrors(errs interface{}) *HTTPError {
+	e.Errors = errs
+	return e
+}
+
 func httpError(code int, fmtString string, args ...interface{}) *HTTPError {
 	return &HTTPError{
 		Code:    code,
@@ -172,6 +247,7 @@ func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
 		w.WriteHeader(499)
 		return
 	}
+	observeUpstreamError(r.Context())
 	log := getLogEntry(r)
 	log.WithError(err).Warn("Failed proxying request")
 	w.WriteHeader(http.StatusBadGateway)
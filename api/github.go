@@ -1,7 +1,6 @@
 package api
 
 import (
-	"errors"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -15,6 +14,7 @@ type GitHubGateway struct {
 
 var pathRegexp = regexp.MustCompile("^/github/?")
 var allowedRegexp = regexp.MustCompile("^/github/((git|contents|pulls|branches|merges|statuses|compare|commits)/?|(issues/(\\d+)/labels))")
+var githubPullMergeRegexp = regexp.MustCompile("^/github/pulls/\\d+/merge/?$")
 
 func NewGitHubGateway() *GitHubGateway {
 	return &GitHubGateway{
@@ -45,6 +45,9 @@ func director(r *http.Request) {
 		// explicitly disable User-Agent so it's not set to default value
 		r.Header.Set("User-Agent", "")
 	}
+	if id := getRequestID(ctx); id != "" {
+		r.Header.Set(requestIDHeaderName, id)
+	}
 	if r.Method != http.MethodOptions {
 		r.Header.Set("Authorization", "Bearer "+accessToken)
 	}
@@ -62,7 +65,13 @@ func (gh *GitHubGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := gh.authenticate(w, r); err != nil {
-		handleError(unauthorizedError(err.Error()), w, r)
+		observeAuthFailure(accessDeniedReason(err))
+		handleError(accessDeniedHTTPError(err), w, r)
+		return
+	}
+
+	if err := rewriteCommitAuthor(r, githubCommitAuthor); err != nil {
+		handleError(badRequestError("Unable to set commit author: %v", err), w, r)
 		return
 	}
 
@@ -81,43 +90,49 @@ func (gh *GitHubGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (gh *GitHubGateway) authenticate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	claims := getClaims(ctx)
-	config := getConfig(ctx)
 
 	if claims == nil {
-		return errors.New("Access to endpoint not allowed: no claims found in Bearer token")
+		return accessDenied("no_claims", "Access to endpoint not allowed: no claims found in Bearer token")
 	}
 
 	if !allowedRegexp.MatchString(r.URL.Path) {
-		return errors.New("Access to endpoint not allowed: this part of GitHub's API has been restricted")
+		return accessDenied("endpoint", "Access to endpoint not allowed: this part of GitHub's API has been restricted")
 	}
 
-	if len(config.Roles) == 0 {
-		return nil
+	if err := authorizeRoles(r, githubEndpointGroup(r.URL.Path)); err != nil {
+		return err
 	}
 
-	roles, ok := claims.AppMetaData["roles"]
-	if ok {
-		roleStrings, _ := roles.([]interface{})
-		for _, data := range roleStrings {
-			role, _ := data.(string)
-			for _, adminRole := range config.Roles {
-				if role == adminRole {
-					return nil
-				}
-			}
-		}
+	if err := authorizePaths(r, githubWrittenPaths); err != nil {
+		return err
 	}
 
-	return errors.New("Access to endpoint not allowed: your role doesn't allow access")
+	return authorizeBranches(r, githubBranchUpdate)
+}
+
+// githubEndpointGroup maps an allowed GitHub path to its endpoint group.
+func githubEndpointGroup(path string) string {
+	if githubPullMergeRegexp.MatchString(path) {
+		return endpointMerges
+	}
+	matches := allowedRegexp.FindStringSubmatch(path)
+	switch {
+	case matches == nil:
+		return endpointOther
+	case matches[2] == "":
+		return endpointLabels
+	}
+	return matches[2]
 }
 
 type GitHubTransport struct{}
 
 func (t *GitHubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
-	resp, err := http.DefaultTransport.RoundTrip(r)
+	resp, err := tracedRoundTrip("github", r)
 	if err == nil {
 		// remove CORS headers from GitHub and use our own
 		resp.Header.Del("Access-Control-Allow-Origin")
+		observeRateLimit(r.Context(), resp.Header.Get("X-RateLimit-Remaining"))
 	}
 	return resp, err
 }
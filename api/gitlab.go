@@ -2,7 +2,6 @@ package api
 
 import (
 	"bytes"
-	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
@@ -10,6 +9,7 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/netlify/git-gateway/conf"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,10 +20,11 @@ type GitLabGateway struct {
 
 var gitlabPathRegexp = regexp.MustCompile("^/gitlab/?")
 var gitlabAllowedRegexp = regexp.MustCompile("^/gitlab/(merge_requests|(repository/(files|commits|tree|compare|branches)))/?")
+var gitlabMergeRequestMergeRegexp = regexp.MustCompile("^/gitlab/merge_requests/\\d+/merge/?$")
 
 const (
 	gitlabPATPrefix = "glpat-"
-	tokenTypePAT    = "personal_access"
+	tokenTypePAT    = conf.GitLabTokenTypePersonalAccess
 )
 
 func NewGitLabGateway() *GitLabGateway {
@@ -62,6 +63,9 @@ func gitlabDirector(r *http.Request) {
 
 	// remove header which causes false positives for blocking on Gitlab loadbalancers
 	r.Header.Del("Client-IP")
+	if id := getRequestID(ctx); id != "" {
+		r.Header.Set(requestIDHeaderName, id)
+	}
 
 	config := getConfig(ctx)
 	tokenType := config.GitLab.AccessTokenType
@@ -98,7 +102,13 @@ func (gl *GitLabGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := gl.authenticate(w, r); err != nil {
-		handleError(unauthorizedError(err.Error()), w, r)
+		observeAuthFailure(accessDeniedReason(err))
+		handleError(accessDeniedHTTPError(err), w, r)
+		return
+	}
+
+	if err := rewriteCommitAuthor(r, gitlabCommitAuthor); err != nil {
+		handleError(badRequestError("Unable to set commit author: %v", err), w, r)
 		return
 	}
 
@@ -120,34 +130,43 @@ func (gl *GitLabGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (gl *GitLabGateway) authenticate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	claims := getClaims(ctx)
-	config := getConfig(ctx)
 
 	if claims == nil {
-		return errors.New("Access to endpoint not allowed: no claims found in Bearer token")
+		return accessDenied("no_claims", "Access to endpoint not allowed: no claims found in Bearer token")
 	}
 
 	if !gitlabAllowedRegexp.MatchString(r.URL.Path) {
-		return errors.New("Access to endpoint not allowed: this part of GitLab's API has been restricted")
+		return accessDenied("endpoint", "Access to endpoint not allowed: this part of GitLab's API has been restricted")
 	}
 
-	if len(config.Roles) == 0 {
-		return nil
+	if err := authorizeRoles(r, gitlabEndpointGroup(r.URL.Path)); err != nil {
+		return err
 	}
 
-	roles, ok := claims.AppMetaData["roles"]
-	if ok {
-		roleStrings, _ := roles.([]interface{})
-		for _, data := range roleStrings {
-			role, _ := data.(string)
-			for _, adminRole := range config.Roles {
-				if role == adminRole {
-					return nil
-				}
-			}
-		}
+	if err := authorizePaths(r, gitlabWrittenPaths); err != nil {
+		return err
 	}
 
-	return errors.New("Access to endpoint not allowed: your role doesn't allow access")
+	return authorizeBranches(r, gitlabBranchUpdate)
+}
+
+// gitlabEndpointGroup maps an allowed GitLab path to its endpoint group.
+func gitlabEndpointGroup(path string) string {
+	if gitlabMergeRequestMergeRegexp.MatchString(path) {
+		return endpointMerges
+	}
+	matches := gitlabAllowedRegexp.FindStringSubmatch(path)
+	switch {
+	case matches == nil:
+		return endpointOther
+	case matches[1] == "merge_requests":
+		return endpointPulls
+	case matches[3] == "files":
+		return endpointContents
+	case matches[3] == "tree":
+		return endpointGit
+	}
+	return matches[3]
 }
 
 var gitlabLinkRegex = regexp.MustCompile("<(.*?)>")
@@ -189,7 +208,7 @@ type GitLabTransport struct{}
 func (t *GitLabTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	ctx := r.Context()
 	config := getConfig(ctx)
-	resp, err := http.DefaultTransport.RoundTrip(r)
+	resp, err := tracedRoundTrip("gitlab", r)
 	if err == nil {
 		// remove CORS headers from GitLab and use our own
 		resp.Header.Del("Access-Control-Allow-Origin")
@@ -202,9 +221,10 @@ func (t *GitLabTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 			resp.Header.Set("Link", newLinkHeader)
 		}
 
+		observeRateLimit(ctx, resp.Header.Get("ratelimit-remaining"))
 		logEntrySetFields(r, logrus.Fields{
-			"gitlab_ratelimit_remaining": r.Header.Get("ratelimit-remaining"),
-			"gitlab_request_id":          r.Header.Get("X-Request-Id"),
+			"gitlab_ratelimit_remaining": resp.Header.Get("ratelimit-remaining"),
+			"gitlab_request_id":          resp.Header.Get("X-Request-Id"),
 			"gitlab_lb":                  resp.Header.Get("gitlab-lb"),
 		})
 
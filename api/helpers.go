@@ -1,9 +1,12 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
@@ -13,34 +16,87 @@ import (
 	"github.com/pkg/errors"
 )
 
+// maxRequestIDLength bounds client supplied request IDs, which end up in logs
+// and upstream requests.
+const maxRequestIDLength = 128
+
+// maxRequestBody caps the bodies the gateways buffer to check or rewrite a
+// request before proxying it. Content API uploads are base64 encoded, so this
+// leaves room for files of about 24MB.
+const maxRequestBody = 32 << 20
+
+var errRequestBodyTooLarge = fmt.Errorf("request body is larger than %d bytes", maxRequestBody)
+
+// addRequestID honors a request ID sent by the client, or generates one, and
+// echoes it in the response.
 func addRequestID(w http.ResponseWriter, r *http.Request) (context.Context, error) {
-	id := uuid.NewRandom().String()
+	id := r.Header.Get(requestIDHeaderName)
+	if !validRequestID(id) {
+		id = uuid.NewRandom().String()
+	}
+	w.Header().Set(requestIDHeaderName, id)
 	ctx := r.Context()
 	ctx = withRequestID(ctx, id)
 	return ctx, nil
 }
 
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeOutput redacts the configuration secrets of instances before they
+// are sent. Instance responses also report which secrets are set.
 func sanitizeOutput(obj interface{}) interface{} {
 	switch v := obj.(type) {
 	case InstanceResponse:
-		v.Instance.BaseConfig.GitHub.AccessToken = ""
+		return *redactInstanceResponse(&v)
 	case *InstanceResponse:
-		v.Instance.BaseConfig.GitHub.AccessToken = ""
+		return redactInstanceResponse(v)
+	case []*InstanceResponse:
+		redacted := make([]*InstanceResponse, len(v))
+		for idx, resp := range v {
+			redacted[idx] = redactInstanceResponse(resp)
+		}
+		return redacted
+	case []*InstanceRevisionResponse:
+		redacted := make([]*InstanceRevisionResponse, len(v))
+		for idx, resp := range v {
+			r := *resp
+			r.Secrets = resp.BaseConfig.Secrets()
+			r.BaseConfig = resp.BaseConfig.Redacted()
+			redacted[idx] = &r
+		}
+		return redacted
 	case models.Instance:
-		v.BaseConfig.GitHub.AccessToken = ""
+		v.BaseConfig = v.BaseConfig.Redacted()
+		return v
 	case *models.Instance:
-		v.BaseConfig.GitHub.AccessToken = ""
-	case *conf.Configuration:
-		v.GitHub.AccessToken = ""
+		i := *v
+		i.BaseConfig = v.BaseConfig.Redacted()
+		return &i
 	case conf.Configuration:
-		v.GitHub.AccessToken = ""
-		// must return here because v != obj due to value copying
-		return v
-	default:
+		return *v.Redacted()
+	case *conf.Configuration:
+		return v.Redacted()
 	}
 	return obj
 }
 
+func redactInstanceResponse(resp *InstanceResponse) *InstanceResponse {
+	r := *resp
+	r.Secrets = resp.BaseConfig.Secrets()
+	r.BaseConfig = resp.BaseConfig.Redacted()
+	return &r
+}
+
 func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
 	obj = sanitizeOutput(obj)
 
@@ -54,6 +110,28 @@ func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
 	return err
 }
 
+// readRequestBody reads the body of r and replaces it with a copy, so the
+// request can still be proxied afterwards. Bodies larger than maxRequestBody
+// are refused with errRequestBodyTooLarge.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	if r.ContentLength > maxRequestBody {
+		return nil, errRequestBodyTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxRequestBody {
+		return nil, errRequestBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
 // From https://golang.org/src/net/http/httputil/reverseproxy.go?s=2298:2359#L72
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
@@ -66,3 +144,12 @@ func singleJoiningSlash(a, b string) string {
 	}
 	return a + b
 }
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -93,4 +93,21 @@ func TestSanitizeOutput(t *testing.T) {
 		require.IsType(t, v, ov)
 		assert.Equal(t, "", ov.(*conf.Configuration).GitHub.AccessToken)
 	})
+
+	t.Run("InstanceResponseSecrets", func(t *testing.T) {
+		config := &conf.Configuration{
+			GitLab:    conf.GitLabConfig{AccessToken: "gitlab-token"},
+			BitBucket: conf.BitBucketConfig{RefreshToken: "refresh-token", ClientSecret: "client-secret"},
+		}
+		v := &InstanceResponse{Instance: models.Instance{BaseConfig: config}}
+
+		ov := sanitizeOutput(v).(*InstanceResponse)
+		assert.Empty(t, ov.BaseConfig.GitLab.AccessToken)
+		assert.Empty(t, ov.BaseConfig.BitBucket.RefreshToken)
+		assert.Empty(t, ov.BaseConfig.BitBucket.ClientSecret)
+		assert.True(t, ov.Secrets["gitlab.access_token"])
+		assert.True(t, ov.Secrets["bitbucket.client_secret"])
+		assert.False(t, ov.Secrets["github.access_token"])
+		assert.Equal(t, "gitlab-token", config.GitLab.AccessToken)
+	})
 }
@@ -2,8 +2,8 @@ package api
 
 import (
 	"context"
-	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/netlify/git-gateway/conf"
@@ -15,7 +15,7 @@ func (a *API) loadInstance(w http.ResponseWriter, r *http.Request) (context.Cont
 	instanceID := chi.URLParam(r, "instance_id")
 	logEntrySetField(r, "instance_id", instanceID)
 
-	i, err := a.db.GetInstance(instanceID)
+	i, err := a.conn(r.Context()).GetInstance(instanceID)
 	if err != nil {
 		if models.IsNotFoundError(err) {
 			return nil, notFoundError("Instance not found")
@@ -43,16 +43,118 @@ type InstanceRequestParams struct {
 type InstanceResponse struct {
 	models.Instance
 	Endpoint string `json:"endpoint"`
-	State    string `json:"state"`
+	// Secrets reports which configuration secrets are set, their values
+	// are never returned.
+	Secrets map[string]bool `json:"secrets"`
+}
+
+// sendInstance responds with the instance and its ETag.
+func (a *API) sendInstance(w http.ResponseWriter, status int, i *models.Instance) error {
+	w.Header().Set("ETag", i.ETag())
+	return sendJSON(w, status, a.instanceResponse(i))
+}
+
+// checkIfMatch compares the If-Match header of the request with the ETag of
+// the instance.
+func checkIfMatch(r *http.Request, i *models.Instance) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == i.ETag() {
+			return nil
+		}
+	}
+	return preconditionFailedError("Instance has been modified, its current ETag is %s", i.ETag())
+}
+
+// checkNotDeleted refuses changes to a deleted instance, it has to be
+// restored first.
+func checkNotDeleted(i *models.Instance) error {
+	if i.State == models.InstanceStateDeleted {
+		return goneError("Instance has been deleted")
+	}
+	return nil
+}
+
+// updateInstance saves the instance, turning a concurrent modification into
+// a 412 response.
+func (a *API) updateInstance(ctx context.Context, i *models.Instance) error {
+	if err := a.conn(ctx).UpdateInstance(i); err != nil {
+		if models.IsVersionConflictError(err) {
+			return preconditionFailedError("Instance has been modified concurrently")
+		}
+		if models.IsDuplicateUUIDError(err) {
+			return conflictError("Another instance has taken the UUID %s", i.UUID)
+		}
+		return internalServerError("Database error updating instance").WithInternalError(err)
+	}
+	return nil
+}
+
+func (a *API) instanceResponse(i *models.Instance) *InstanceResponse {
+	return &InstanceResponse{
+		Instance: *i,
+		Endpoint: a.config.API.Endpoint,
+	}
+}
+
+// ListInstances returns the instances matching the uuid, provider and repo
+// query parameters, sorted by the sort parameter, e.g. "-updated_at".
+func (a *API) ListInstances(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	pagination, err := paginate(r)
+	if err != nil {
+		return err
+	}
+	sort, err := sortParams(r, "created_at", "updated_at")
+	if err != nil {
+		return err
+	}
+	if len(sort.Fields) == 0 {
+		sort.Fields = []models.SortField{{Name: "created_at", Dir: models.Descending}}
+	}
+
+	filter := &models.InstanceFilter{
+		UUID:     params.Get("uuid"),
+		Provider: params.Get("provider"),
+		Repo:     params.Get("repo"),
+		State:    params.Get("state"),
+	}
+	switch filter.Provider {
+	case "", models.ProviderGitHub, models.ProviderGitLab, models.ProviderBitBucket:
+	default:
+		return badRequestError("Invalid provider: %q", filter.Provider)
+	}
+	switch filter.State {
+	case "", models.InstanceStateActive, models.InstanceStateSuspended, models.InstanceStateDeleted:
+	default:
+		return badRequestError("Invalid state: %q", filter.State)
+	}
+
+	instances, err := a.conn(r.Context()).FindInstances(filter, sort, pagination)
+	if err != nil {
+		return internalServerError("Database error finding instances").WithInternalError(err)
+	}
+
+	resp := make([]*InstanceResponse, len(instances))
+	for idx, i := range instances {
+		resp[idx] = a.instanceResponse(i)
+	}
+	addPaginationHeaders(w, r, pagination)
+	return sendJSON(w, http.StatusOK, resp)
 }
 
 func (a *API) CreateInstance(w http.ResponseWriter, r *http.Request) error {
 	params := InstanceRequestParams{}
-	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+	if err := decodeStrict(r.Body, &params); err != nil {
 		return badRequestError("Error decoding params: %v", err)
 	}
 
-	_, err := a.db.GetInstanceByUUID(params.UUID)
+	_, err := a.conn(r.Context()).GetInstanceByUUID(params.UUID)
 	if err != nil {
 		if !models.IsNotFoundError(err) {
 			return internalServerError("Database error looking up instance").WithInternalError(err)
@@ -66,82 +168,167 @@ func (a *API) CreateInstance(w http.ResponseWriter, r *http.Request) error {
 		UUID:       params.UUID,
 		BaseConfig: params.BaseConfig,
 	}
-	if err = a.db.CreateInstance(&i); err != nil {
+	if err := a.validateInstance(r, &i); err != nil {
+		return err
+	}
+	if err = a.conn(r.Context()).CreateInstance(&i); err != nil {
+		if models.IsDuplicateUUIDError(err) {
+			return badRequestError("An instance with that UUID already exists")
+		}
 		return internalServerError("Database error creating instance").WithInternalError(err)
 	}
-
-	resp := InstanceResponse{
-		Instance: i,
-		Endpoint: a.config.API.Endpoint,
-		State:    "active",
+	if err := a.recordRevision(r.Context(), &i, 0); err != nil {
+		return err
 	}
-	return sendJSON(w, http.StatusCreated, resp)
+
+	return a.sendInstance(w, http.StatusCreated, &i)
 }
 
 func (a *API) GetInstance(w http.ResponseWriter, r *http.Request) error {
 	i := getInstance(r.Context())
-	return sendJSON(w, http.StatusOK, i)
+	return a.sendInstance(w, http.StatusOK, i)
 }
 
+// UpdateInstance replaces the configuration of an instance. Secrets left
+// empty keep their stored values, so a redacted configuration read with GET
+// can be sent back as it is. Secrets are cleared with PatchInstance.
 func (a *API) UpdateInstance(w http.ResponseWriter, r *http.Request) error {
 	i := getInstance(r.Context())
+	if err := checkIfMatch(r, i); err != nil {
+		return err
+	}
+	if err := checkNotDeleted(i); err != nil {
+		return err
+	}
 
 	params := InstanceRequestParams{}
-	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+	if err := decodeStrict(r.Body, &params); err != nil {
 		return badRequestError("Error decoding params: %v", err)
 	}
+	if params.BaseConfig == nil {
+		return badRequestError("Instance config is required")
+	}
+	config, err := params.BaseConfig.KeepSecrets(i.BaseConfig)
+	if err != nil {
+		return internalServerError("Error reading instance secrets").WithInternalError(err)
+	}
+	i.BaseConfig = config
+	if err := a.validateInstance(r, i); err != nil {
+		return err
+	}
 
-	if params.BaseConfig != nil {
-		i.BaseConfig = mergeConfig(i.BaseConfig, params.BaseConfig)
+	if err := a.updateInstance(r.Context(), i); err != nil {
+		return err
 	}
+	if err := a.recordRevision(r.Context(), i, 0); err != nil {
+		return err
+	}
+	return a.sendInstance(w, http.StatusOK, i)
+}
 
-	if err := a.db.UpdateInstance(i); err != nil {
-		return internalServerError("Database error updating instance").WithInternalError(err)
+// PatchInstance applies a JSON merge patch (RFC 7396) to the configuration
+// of an instance, e.g. {"config": {"github": {"repo": "owner/repo"}}}. Null
+// values clear fields.
+func (a *API) PatchInstance(w http.ResponseWriter, r *http.Request) error {
+	i := getInstance(r.Context())
+	if err := checkIfMatch(r, i); err != nil {
+		return err
+	}
+	if err := checkNotDeleted(i); err != nil {
+		return err
+	}
+
+	patch := map[string]interface{}{}
+	if err := decodeJSON(r.Body, &patch); err != nil {
+		return badRequestError("Error decoding patch: %v", err)
+	}
+	configPatch, ok := patch["config"]
+	for field := range patch {
+		if field != "config" {
+			return badRequestError("Error decoding patch: unknown field %q", field)
+		}
+	}
+	if ok {
+		if configPatch == nil {
+			return badRequestError("Instance config can't be removed")
+		}
+		config, err := patchConfig(i.BaseConfig, configPatch)
+		if err != nil {
+			return badRequestError("Error applying patch: %v", err)
+		}
+		i.BaseConfig = config
 	}
-	return sendJSON(w, http.StatusOK, i)
+	if err := a.validateInstance(r, i); err != nil {
+		return err
+	}
+
+	if err := a.updateInstance(r.Context(), i); err != nil {
+		return err
+	}
+	if err := a.recordRevision(r.Context(), i, 0); err != nil {
+		return err
+	}
+	return a.sendInstance(w, http.StatusOK, i)
 }
 
+// DeleteInstance marks an instance deleted. It stops serving requests and
+// can be restored until it's purged.
 func (a *API) DeleteInstance(w http.ResponseWriter, r *http.Request) error {
 	i := getInstance(r.Context())
-	if err := a.db.DeleteInstance(i); err != nil {
+	if err := checkIfMatch(r, i); err != nil {
+		return err
+	}
+	if err := checkNotDeleted(i); err != nil {
+		return err
+	}
+	if err := a.conn(r.Context()).DeleteInstance(i); err != nil {
 		return internalServerError("Database error deleting instance").WithInternalError(err)
 	}
 
-	// TODO do we delete everything associated with an instance too?
-
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
-func mergeConfig(baseConfig *conf.Configuration, newConfig *conf.Configuration) *conf.Configuration {
-	if newConfig.GitHub.AccessToken != "" {
-		baseConfig.GitHub.AccessToken = newConfig.GitHub.AccessToken
-	}
+// SuspendInstance stops an instance from serving requests, keeping its
+// configuration.
+func (a *API) SuspendInstance(w http.ResponseWriter, r *http.Request) error {
+	return a.setInstanceState(w, r, models.InstanceStateSuspended)
+}
 
-	if newConfig.GitHub.Endpoint != "" {
-		baseConfig.GitHub.Endpoint = newConfig.GitHub.Endpoint
-	}
+// ResumeInstance lets a suspended instance serve requests again.
+func (a *API) ResumeInstance(w http.ResponseWriter, r *http.Request) error {
+	return a.setInstanceState(w, r, models.InstanceStateActive)
+}
 
-	if newConfig.GitHub.Repo != "" {
-		baseConfig.GitHub.Repo = newConfig.GitHub.Repo
+func (a *API) setInstanceState(w http.ResponseWriter, r *http.Request, state string) error {
+	i := getInstance(r.Context())
+	if err := checkIfMatch(r, i); err != nil {
+		return err
 	}
-
-	if newConfig.GitLab.AccessToken != "" {
-		baseConfig.GitLab.AccessToken = newConfig.GitLab.AccessToken
+	if err := checkNotDeleted(i); err != nil {
+		return err
 	}
-
-	if newConfig.GitLab.AccessTokenType != "" {
-		baseConfig.GitLab.AccessTokenType = newConfig.GitLab.AccessTokenType
+	if i.State != state {
+		i.State = state
+		if err := a.updateInstance(r.Context(), i); err != nil {
+			return err
+		}
 	}
+	return a.sendInstance(w, http.StatusOK, i)
+}
 
-	if newConfig.GitLab.Endpoint != "" {
-		baseConfig.GitLab.Endpoint = newConfig.GitLab.Endpoint
+// RestoreInstance brings a deleted instance back as active.
+func (a *API) RestoreInstance(w http.ResponseWriter, r *http.Request) error {
+	i := getInstance(r.Context())
+	if err := checkIfMatch(r, i); err != nil {
+		return err
 	}
-
-	if newConfig.GitLab.Repo != "" {
-		baseConfig.GitLab.Repo = newConfig.GitLab.Repo
+	if i.State == models.InstanceStateDeleted {
+		i.State = models.InstanceStateActive
+		i.DeletedAt = nil
+		if err := a.updateInstance(r.Context(), i); err != nil {
+			return err
+		}
 	}
-
-	baseConfig.Roles = newConfig.Roles
-	return baseConfig
+	return a.sendInstance(w, http.StatusOK, i)
 }
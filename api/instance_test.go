@@ -0,0 +1,291 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/netlify/git-gateway/storage/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOperatorToken = "operator-token"
+
+func newOperatorAPI(t *testing.T) *API {
+	f, err := ioutil.TempFile("", "git-gateway-test-")
+	require.NoError(t, err)
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	globalConfig := &conf.GlobalConfiguration{
+		DB:                conf.DBConfiguration{Driver: "sqlite3", URL: f.Name()},
+		OperatorToken:     testOperatorToken,
+		MultiInstanceMode: true,
+	}
+	conn, err := sql.Dial(globalConfig)
+	require.NoError(t, err)
+	require.NoError(t, conn.Automigrate())
+	t.Cleanup(func() { conn.Close() })
+
+	return NewAPIWithVersion(context.Background(), globalConfig, storage.WithMetrics(conn), "test")
+}
+
+func operatorRequest(t *testing.T, api *API, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	return w
+}
+
+func createTestInstance(t *testing.T, api *API, uuid string, config *conf.Configuration) *InstanceResponse {
+	w := operatorRequest(t, api, http.MethodPost, "/instances", InstanceRequestParams{UUID: uuid, BaseConfig: config})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	resp := &InstanceResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+	return resp
+}
+
+var testJWT = conf.JWTConfiguration{Secret: "secret"}
+
+func TestListInstances(t *testing.T) {
+	api := newOperatorAPI(t)
+	createTestInstance(t, api, "uuid-1", &conf.Configuration{JWT: testJWT, GitHub: conf.GitHubConfig{AccessToken: "github-token", Repo: "owner/site"}})
+	createTestInstance(t, api, "uuid-2", &conf.Configuration{JWT: testJWT, GitLab: conf.GitLabConfig{AccessToken: "gitlab-token", Repo: "owner/site"}})
+	createTestInstance(t, api, "uuid-3", &conf.Configuration{JWT: testJWT, GitHub: conf.GitHubConfig{Repo: "owner/other"}})
+
+	list := func(query string) ([]*InstanceResponse, *httptest.ResponseRecorder) {
+		w := operatorRequest(t, api, http.MethodGet, "/instances"+query, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		resp := []*InstanceResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp, w
+	}
+	uuids := func(instances []*InstanceResponse) []string {
+		ids := []string{}
+		for _, i := range instances {
+			ids = append(ids, i.UUID)
+		}
+		return ids
+	}
+
+	instances, w := list("")
+	assert.Len(t, instances, 3)
+	assert.Equal(t, "3", w.Header().Get("X-Total-Count"))
+	assert.NotContains(t, w.Body.String(), "github-token")
+	assert.NotContains(t, w.Body.String(), "gitlab-token")
+
+	instances, _ = list("?provider=github&sort=created_at")
+	assert.Equal(t, []string{"uuid-1", "uuid-3"}, uuids(instances))
+
+	instances, _ = list("?repo=owner/site")
+	assert.ElementsMatch(t, []string{"uuid-1", "uuid-2"}, uuids(instances))
+
+	instances, _ = list("?uuid=uuid-2")
+	assert.Equal(t, []string{"uuid-2"}, uuids(instances))
+	assert.True(t, instances[0].Secrets["gitlab.access_token"])
+
+	instances, w = list("?per_page=2&page=2")
+	assert.Len(t, instances, 1)
+	assert.Contains(t, w.Header().Get("Link"), `rel="prev"`)
+
+	w = operatorRequest(t, api, http.MethodGet, "/instances?sort=uuid", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = operatorRequest(t, api, http.MethodGet, "/instances?provider=svn", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUpdateInstanceIfMatch(t *testing.T) {
+	api := newOperatorAPI(t)
+	instance := createTestInstance(t, api, "uuid-1", &conf.Configuration{JWT: testJWT, GitHub: conf.GitHubConfig{Repo: "owner/site"}})
+	path := "/instances/" + instance.ID
+
+	w := operatorRequest(t, api, http.MethodGet, path, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	update := InstanceRequestParams{BaseConfig: &conf.Configuration{JWT: testJWT, GitHub: conf.GitHubConfig{Repo: "owner/other"}}}
+	ifMatch := func(etag string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(update)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPut, path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+		req.Header.Set("If-Match", etag)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w = ifMatch(etag)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	w = ifMatch(etag)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	// the storage rejects updates of stale copies
+	first, err := api.db.GetInstance(instance.ID)
+	require.NoError(t, err)
+	second, err := api.db.GetInstance(instance.ID)
+	require.NoError(t, err)
+	require.NoError(t, api.db.UpdateInstance(first))
+	err = api.db.UpdateInstance(second)
+	assert.True(t, models.IsVersionConflictError(err), "expected a version conflict, got %v", err)
+}
+
+func TestPatchAndReplaceInstance(t *testing.T) {
+	api := newOperatorAPI(t)
+	instance := createTestInstance(t, api, "uuid-1", &conf.Configuration{
+		JWT:    testJWT,
+		GitHub: conf.GitHubConfig{AccessToken: "github-token", Repo: "owner/site"},
+		Roles:  []string{"admin"},
+	})
+	path := "/instances/" + instance.ID
+
+	w := operatorRequest(t, api, http.MethodPatch, path, map[string]interface{}{
+		"config": map[string]interface{}{
+			"bitbucket": map[string]interface{}{"repo": "owner/bb"},
+			"roles":     nil,
+		},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	i, err := api.db.GetInstance(instance.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "github-token", i.BaseConfig.GitHub.AccessToken)
+	assert.Equal(t, "owner/bb", i.BaseConfig.BitBucket.Repo)
+	assert.Empty(t, i.BaseConfig.Roles)
+
+	w = operatorRequest(t, api, http.MethodPatch, path, map[string]interface{}{"config": map[string]interface{}{"gitub": map[string]interface{}{}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = operatorRequest(t, api, http.MethodPatch, path, map[string]interface{}{"uuid": "other"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = operatorRequest(t, api, http.MethodPut, path, map[string]interface{}{"config": map[string]interface{}{
+		"jwt":    map[string]interface{}{"secret": "secret"},
+		"github": map[string]interface{}{"repo": "owner/new"},
+	}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	i, err = api.db.GetInstance(instance.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "owner/new", i.BaseConfig.GitHub.Repo)
+	assert.Equal(t, "github-token", i.BaseConfig.GitHub.AccessToken, "PUT keeps secrets left empty")
+	assert.Equal(t, "secret", i.BaseConfig.JWT.Secret)
+	assert.Empty(t, i.BaseConfig.BitBucket.Repo, "PUT replaces the rest of the config")
+
+	// a redacted config read with GET can be sent back as it is
+	w = operatorRequest(t, api, http.MethodGet, path, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	read := InstanceResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &read))
+	require.Empty(t, read.BaseConfig.GitHub.AccessToken)
+	read.BaseConfig.GitHub.Repo = "owner/renamed"
+	w = operatorRequest(t, api, http.MethodPut, path, InstanceRequestParams{BaseConfig: read.BaseConfig})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	i, err = api.db.GetInstance(instance.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "owner/renamed", i.BaseConfig.GitHub.Repo)
+	assert.Equal(t, "github-token", i.BaseConfig.GitHub.AccessToken)
+	assert.Equal(t, "secret", i.BaseConfig.JWT.Secret)
+
+	// secrets are cleared with a patch
+	w = operatorRequest(t, api, http.MethodPatch, path, map[string]interface{}{
+		"config": map[string]interface{}{"github": map[string]interface{}{"access_token": nil}},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	i, err = api.db.GetInstance(instance.ID)
+	require.NoError(t, err)
+	assert.Empty(t, i.BaseConfig.GitHub.AccessToken)
+
+	w = operatorRequest(t, api, http.MethodPut, path, map[string]interface{}{"config": map[string]interface{}{"github": map[string]interface{}{"token": "x"}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestInstanceStates(t *testing.T) {
+	api := newOperatorAPI(t)
+	instance := createTestInstance(t, api, "uuid-1", &conf.Configuration{JWT: testJWT})
+	assert.Equal(t, models.InstanceStateActive, instance.State)
+	path := "/instances/" + instance.ID
+
+	signature, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testSignatureClaims(instance.ID)).
+		SignedString([]byte(testOperatorToken))
+	require.NoError(t, err)
+	gatewayStatus := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/settings", nil)
+		req.Header.Set(jwsSignatureHeaderName, signature)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	state := func(w *httptest.ResponseRecorder) string {
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		resp := &InstanceResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+		return resp.State
+	}
+
+	// active instances get as far as authenticating the user
+	assert.Equal(t, http.StatusUnauthorized, gatewayStatus())
+
+	assert.Equal(t, models.InstanceStateSuspended, state(operatorRequest(t, api, http.MethodPost, path+"/suspend", nil)))
+	assert.Equal(t, http.StatusForbidden, gatewayStatus())
+	assert.Equal(t, models.InstanceStateActive, state(operatorRequest(t, api, http.MethodPost, path+"/resume", nil)))
+	assert.Equal(t, http.StatusUnauthorized, gatewayStatus())
+
+	w := operatorRequest(t, api, http.MethodDelete, path, nil)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusGone, gatewayStatus())
+	assert.Equal(t, models.InstanceStateDeleted, state(operatorRequest(t, api, http.MethodGet, path, nil)))
+	w = operatorRequest(t, api, http.MethodPost, path+"/suspend", nil)
+	assert.Equal(t, http.StatusGone, w.Code)
+	w = operatorRequest(t, api, http.MethodPatch, path, map[string]interface{}{})
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	w = operatorRequest(t, api, http.MethodGet, "/instances", nil)
+	assert.NotContains(t, w.Body.String(), instance.ID)
+	w = operatorRequest(t, api, http.MethodGet, "/instances?state=deleted", nil)
+	assert.Contains(t, w.Body.String(), instance.ID)
+
+	// the UUID may have been taken by another instance in the meantime
+	other := createTestInstance(t, api, "uuid-1", &conf.Configuration{JWT: testJWT})
+	w = operatorRequest(t, api, http.MethodPost, path+"/restore", nil)
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	assert.Equal(t, models.InstanceStateDeleted, state(operatorRequest(t, api, http.MethodGet, path, nil)))
+	w = operatorRequest(t, api, http.MethodDelete, "/instances/"+other.ID, nil)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	assert.Equal(t, models.InstanceStateActive, state(operatorRequest(t, api, http.MethodPost, path+"/restore", nil)))
+	assert.Equal(t, http.StatusUnauthorized, gatewayStatus())
+
+	// purging only removes instances deleted before the cutoff
+	require.NoError(t, api.db.DeleteInstance(&instance.Instance))
+	n, err := api.db.PurgeInstances(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, n)
+	n, err = api.db.PurgeInstances(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, n, "both instances with the UUID are deleted")
+	_, err = api.db.GetInstance(instance.ID)
+	assert.True(t, models.IsNotFoundError(err))
+	revisions, err := api.db.FindInstanceRevisions(instance.ID, nil)
+	require.NoError(t, err)
+	assert.Empty(t, revisions)
+}
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/pkg/errors"
+)
+
+// jwksMinRefetchInterval rate limits refetching a key set when a token
+// references a key ID that isn't known yet.
+const jwksMinRefetchInterval = time.Minute
+
+// jwksRetryInterval is how long a failed fetch is remembered before the key
+// set is fetched again, so an unreachable provider isn't hit on every request.
+const jwksRetryInterval = 30 * time.Second
+
+var jwksHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if req.URL.Scheme != "https" && via[0].URL.Scheme == "https" {
+			return errors.New("refusing to follow a redirect from https to http")
+		}
+		return nil
+	},
+}
+
+// jwksURLCheck refuses key set URLs an instance isn't allowed to fetch. It
+// is applied to the configured URL and every redirect.
+type jwksURLCheck func(u *url.URL) error
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// keySet is a cached JSON Web Key Set loaded from a URL or a local file.
+type keySet struct {
+	source string
+
+	fetchMu sync.Mutex // serializes fetches, held during the network call
+
+	mu        sync.Mutex // guards the fields below
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	failedAt  time.Time
+	err       error
+}
+
+// jwksCache holds one key set per source, so instances sharing an identity
+// provider share the cached keys.
+type jwksCache struct {
+	mu   sync.Mutex
+	sets map[string]*keySet
+}
+
+func newJWKSCache() *jwksCache {
+	return &jwksCache{sets: make(map[string]*keySet)}
+}
+
+func (c *jwksCache) get(source string) *keySet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ks, ok := c.sets[source]
+	if !ok {
+		ks = &keySet{source: source}
+		c.sets[source] = ks
+	}
+	return ks
+}
+
+// lookupKey returns the public key for kid from the key set configured in
+// config, fetching or refreshing the set when needed. check, when set, is
+// applied to the key set URL and its redirects.
+func (c *jwksCache) lookupKey(config *conf.JWTConfiguration, kid string, check jwksURLCheck) (interface{}, error) {
+	source := config.JWKSSource()
+	if source == "" {
+		return nil, errors.New("no JWKS configured")
+	}
+	refresh := time.Duration(config.JWKSRefreshInterval) * time.Second
+	if refresh <= 0 {
+		refresh = conf.DefaultJWKSRefreshInterval * time.Second
+	}
+	return c.get(source).key(config, kid, refresh, check)
+}
+
+func (ks *keySet) key(config *conf.JWTConfiguration, kid string, refresh time.Duration, check jwksURLCheck) (interface{}, error) {
+	keys, fetchedAt := ks.snapshot()
+	if keys == nil || time.Since(fetchedAt) > refresh {
+		// keep serving the stale keys rather than failing every request
+		if err := ks.refresh(config, fetchedAt, check); err != nil && keys == nil {
+			return nil, err
+		}
+		keys, fetchedAt = ks.snapshot()
+	}
+
+	if key, ok := findKey(keys, kid); ok {
+		return key, nil
+	}
+
+	// the provider may have rotated keys since the last fetch
+	if time.Since(fetchedAt) > jwksMinRefetchInterval {
+		if err := ks.refresh(config, fetchedAt, check); err != nil {
+			return nil, err
+		}
+		keys, _ = ks.snapshot()
+		if key, ok := findKey(keys, kid); ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no key found for kid %q", kid)
+}
+
+func (ks *keySet) snapshot() (map[string]interface{}, time.Time) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.keys, ks.fetchedAt
+}
+
+// refresh fetches the key set, unless another request fetched it since
+// fetchedAt or the last fetch failed less than jwksRetryInterval ago, in
+// which case that error is returned again.
+func (ks *keySet) refresh(config *conf.JWTConfiguration, fetchedAt time.Time, check jwksURLCheck) error {
+	ks.fetchMu.Lock()
+	defer ks.fetchMu.Unlock()
+
+	ks.mu.Lock()
+	current, failedAt, lastErr := ks.fetchedAt, ks.failedAt, ks.err
+	ks.mu.Unlock()
+	if current.After(fetchedAt) {
+		return nil
+	}
+	if lastErr != nil && time.Since(failedAt) < jwksRetryInterval {
+		return lastErr
+	}
+
+	keys, err := loadJWKS(config, check)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if err != nil {
+		ks.failedAt = time.Now()
+		ks.err = err
+		return err
+	}
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+	ks.err = nil
+	return nil
+}
+
+func findKey(keys map[string]interface{}, kid string) (interface{}, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+func loadJWKS(config *conf.JWTConfiguration, check jwksURLCheck) (map[string]interface{}, error) {
+	var data []byte
+	var err error
+	if config.JWKSURL != "" {
+		data, err = fetchJWKSURL(config.JWKSURL, check)
+	} else {
+		data, err = ioutil.ReadFile(config.JWKSFile)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading JWKS")
+	}
+	return parseJWKS(data)
+}
+
+func fetchJWKSURL(rawURL string, check jwksURLCheck) ([]byte, error) {
+	client := jwksHTTPClient
+	if check != nil {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := check(u); err != nil {
+			return nil, err
+		}
+		checked := *jwksHTTPClient
+		checked.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if err := jwksHTTPClient.CheckRedirect(req, via); err != nil {
+				return err
+			}
+			if err := check(req.URL); err != nil {
+				return errors.Wrap(err, "refusing to follow a redirect")
+			}
+			return nil
+		}
+		client = &checked
+	}
+
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, rawURL)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	set := jsonWebKeySet{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrap(err, "error decoding JWKS")
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding key %q", k.Kid)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes RSA and EC keys, other key types are skipped.
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func testClaims() *GatewayClaims {
+	return &GatewayClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "user",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Email: "user@example.com",
+	}
+}
+
+func signedRequest(t *testing.T, config *conf.Configuration, method jwt.SigningMethod, kid string, key interface{}) *http.Request {
+	return signedRequestWithClaims(t, config, method, kid, key, testClaims())
+}
+
+func signedRequestWithClaims(t *testing.T, config *conf.Configuration, method jwt.SigningMethod, kid string, key interface{}, claims *GatewayClaims) *http.Request {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/settings", nil)
+	ctx, err := WithInstanceConfig(context.Background(), config, "")
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	return req
+}
+
+func TestParseJWTClaimsJWKSURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	set := jsonWebKeySet{Keys: []jsonWebKey{{
+		Kty: "RSA",
+		Kid: "rsa-1",
+		Use: "sig",
+		N:   encodeBigInt(key.N),
+		E:   encodeBigInt(big.NewInt(int64(key.E))),
+	}}}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	a := &API{jwks: newJWKSCache()}
+	config := &conf.Configuration{JWT: conf.JWTConfiguration{JWKSURL: srv.URL}}
+	config.ApplyDefaults()
+
+	req := signedRequest(t, config, jwt.SigningMethodRS256, "rsa-1", key)
+	ctx, err := a.requireAuthentication(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", getClaims(ctx).Email)
+
+	// keys are cached between requests
+	req = signedRequest(t, config, jwt.SigningMethodRS256, "rsa-1", key)
+	_, err = a.requireAuthentication(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	t.Run("UnknownKid", func(t *testing.T) {
+		req := signedRequest(t, config, jwt.SigningMethodRS256, "other", key)
+		_, err := a.requireAuthentication(httptest.NewRecorder(), req)
+		require.Error(t, err)
+	})
+
+	t.Run("HS256WithoutSecret", func(t *testing.T) {
+		req := signedRequest(t, config, jwt.SigningMethodHS256, "", []byte(""))
+		_, err := a.requireAuthentication(httptest.NewRecorder(), req)
+		require.Error(t, err)
+	})
+}
+
+func TestParseJWTClaimsJWKSFile(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	set := jsonWebKeySet{Keys: []jsonWebKey{{
+		Kty: "EC",
+		Kid: "ec-1",
+		Crv: "P-256",
+		X:   encodeBigInt(key.X),
+		Y:   encodeBigInt(key.Y),
+	}}}
+	data, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "git-gateway-jwks-")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a := &API{jwks: newJWKSCache()}
+	config := &conf.Configuration{JWT: conf.JWTConfiguration{Secret: "secret", JWKSFile: f.Name()}}
+	config.ApplyDefaults()
+
+	req := signedRequest(t, config, jwt.SigningMethodES256, "ec-1", key)
+	_, err = a.requireAuthentication(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+
+	// the shared secret keeps working alongside the key set
+	req = signedRequest(t, config, jwt.SigningMethodHS256, "", []byte("secret"))
+	_, err = a.requireAuthentication(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+}
+
+func TestInstanceJWKSRestrictions(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+	}))
+	defer srv.Close()
+
+	a := &API{config: &conf.GlobalConfiguration{MultiInstanceMode: true}, jwks: newJWKSCache()}
+	for _, jwtConfig := range []conf.JWTConfiguration{{JWKSURL: srv.URL}, {JWKSFile: "/etc/passwd"}} {
+		config := &conf.Configuration{JWT: jwtConfig}
+		config.ApplyDefaults()
+		req := signedRequest(t, config, jwt.SigningMethodRS256, "rsa-1", key)
+		_, err = a.requireAuthentication(httptest.NewRecorder(), req)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 0, fetches)
+
+	api := newOperatorAPI(t)
+	w := operatorRequest(t, api, http.MethodPost, "/instances", map[string]interface{}{
+		"uuid":   "uuid-1",
+		"config": map[string]interface{}{"jwt": map[string]interface{}{"jwks_file": "/etc/passwd"}},
+	})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+}
+
+func TestInstanceJWKSRedirects(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	set := jsonWebKeySet{Keys: []jsonWebKey{{
+		Kty: "RSA",
+		Kid: "rsa-1",
+		N:   encodeBigInt(key.N),
+		E:   encodeBigInt(big.NewInt(int64(key.E))),
+	}}}
+
+	fetches := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/jwks":
+			fetches++
+			json.NewEncoder(w).Encode(set)
+		case "/allowed":
+			http.Redirect(w, r, "/jwks", http.StatusFound)
+		case "/elsewhere":
+			u, _ := url.Parse("https://" + r.Host + "/jwks")
+			u.Host = "localhost:" + u.Port()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	defer func(transport http.RoundTripper) { jwksHTTPClient.Transport = transport }(jwksHTTPClient.Transport)
+	jwksHTTPClient.Transport = srv.Client().Transport
+
+	a := &API{
+		config: &conf.GlobalConfiguration{MultiInstanceMode: true, JWKSAllowedHosts: []string{"127.0.0.1"}},
+		jwks:   newJWKSCache(),
+	}
+	authenticate := func(path string) error {
+		config := &conf.Configuration{JWT: conf.JWTConfiguration{JWKSURL: srv.URL + path}}
+		config.ApplyDefaults()
+		_, err := a.requireAuthentication(httptest.NewRecorder(), signedRequest(t, config, jwt.SigningMethodRS256, "rsa-1", key))
+		return err
+	}
+
+	require.NoError(t, authenticate("/jwks"))
+	require.NoError(t, authenticate("/allowed"))
+	assert.Equal(t, 2, fetches)
+
+	// redirects are checked against the allowed hosts too
+	err = authenticate("/elsewhere")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `host "localhost" isn't allowed`)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestJWKSFetchFailureBackoff(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	a := &API{jwks: newJWKSCache()}
+	config := &conf.Configuration{JWT: conf.JWTConfiguration{JWKSURL: srv.URL}}
+	config.ApplyDefaults()
+	for i := 0; i < 3; i++ {
+		req := signedRequest(t, config, jwt.SigningMethodRS256, "rsa-1", key)
+		_, err = a.requireAuthentication(httptest.NewRecorder(), req)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, fetches, "failed fetches aren't retried right away")
+
+	// once the retry interval passed the key set is fetched again
+	ks := a.jwks.get(srv.URL)
+	ks.failedAt = ks.failedAt.Add(-jwksRetryInterval)
+	_, err = a.requireAuthentication(httptest.NewRecorder(), signedRequest(t, config, jwt.SigningMethodRS256, "rsa-1", key))
+	assert.Error(t, err)
+	assert.Equal(t, 2, fetches)
+}
@@ -7,6 +7,7 @@ import (
 
 	chimiddleware "github.com/go-chi/chi/middleware"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func newStructuredLogger(logger *logrus.Logger) func(next http.Handler) http.Handler {
@@ -30,6 +31,9 @@ func (l *structuredLogger) NewLogEntry(r *http.Request) chimiddleware.LogEntry {
 	if reqID := getRequestID(r.Context()); reqID != "" {
 		logFields["request_id"] = reqID
 	}
+	if span := trace.SpanContextFromContext(r.Context()); span.HasTraceID() {
+		logFields["trace_id"] = span.TraceID().String()
+	}
 
 	entry.Logger = entry.Logger.WithFields(logFields)
 	entry.Logger.Infoln("request started")
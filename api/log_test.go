@@ -0,0 +1,75 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestGatewayLogsNoCredentials(t *testing.T) {
+	_, err := conf.ConfigureLogging(&conf.LoggingConfig{Format: "json", Level: "debug"})
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	logger := logrus.StandardLogger()
+	stderr := logger.Out
+	logger.Out = out
+	defer func() {
+		logger.Out = stderr
+		conf.ConfigureLogging(&conf.LoggingConfig{Level: "info"})
+	}()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	accessToken := "upstream-access-token-0123456789"
+	bitbucketAccessToken := "bitbucket-access-token-0123456789"
+	config := &conf.Configuration{
+		JWT:    conf.JWTConfiguration{Secret: "secret"},
+		GitHub: conf.GitHubConfig{AccessToken: accessToken, Endpoint: upstream.URL, Repo: "owner/repo"},
+		BitBucket: conf.BitBucketConfig{
+			RefreshToken: "bitbucket-refresh-token",
+			ClientSecret: "bitbucket-client-secret",
+			Endpoint:     upstream.URL,
+			Repo:         "owner/repo",
+		},
+	}
+	// a valid token keeps the gateway from refreshing it with Bitbucket
+	currentTokenSource = &notifyRefreshTokenSource{t: &oauth2.Token{
+		AccessToken:  bitbucketAccessToken,
+		RefreshToken: "bitbucket-refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	}}
+	defer func() { currentTokenSource = nil }()
+	ctx, err := WithInstanceConfig(context.Background(), config, "")
+	require.NoError(t, err)
+	api := NewAPIWithVersion(ctx, &conf.GlobalConfiguration{}, nil, "test")
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	for _, path := range []string{"/github/contents/README.md", "/gitlab/repository/files/README.md", "/bitbucket/src/master/README.md"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Private-Token", "client-private-token-0123456789")
+		api.handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	logs := out.String()
+	require.NotEmpty(t, logs)
+	assert.Contains(t, logs, "Proxying to BitBucket")
+	for _, secret := range []string{token, accessToken, bitbucketAccessToken, "client-private-token-0123456789", "bitbucket-refresh-token", "bitbucket-client-secret"} {
+		assert.NotContains(t, logs, secret)
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/netlify/git-gateway/conf"
+)
+
+// decodeJSON decodes a single JSON value, keeping numbers as json.Number so
+// they survive a round trip unchanged.
+func decodeJSON(r io.Reader, v interface{}) error {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// decodeStrict decodes a single JSON value, rejecting fields v doesn't have.
+func decodeStrict(r io.Reader, v interface{}) error {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch to target: objects are
+// merged recursively, null removes a member and any other value replaces
+// the target.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// patchConfig returns a copy of config with the merge patch applied. The
+// result must still be a valid configuration without unknown fields.
+func patchConfig(config *conf.Configuration, patch interface{}) (*conf.Configuration, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var target interface{}
+	if err := decodeJSON(bytes.NewReader(data), &target); err != nil {
+		return nil, err
+	}
+
+	data, err = json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return nil, err
+	}
+	patched := &conf.Configuration{}
+	if err := decodeStrict(bytes.NewReader(data), patched); err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396, appendix A
+	cases := []struct{ target, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		var target, patch interface{}
+		require.NoError(t, decodeJSON(strings.NewReader(c.target), &target))
+		require.NoError(t, decodeJSON(strings.NewReader(c.patch), &patch))
+		result, err := json.Marshal(mergePatch(target, patch))
+		require.NoError(t, err)
+		assert.JSONEq(t, c.result, string(result), "%s patched with %s", c.target, c.patch)
+	}
+}
+
+func TestPatchConfig(t *testing.T) {
+	config := &conf.Configuration{
+		GitHub:    conf.GitHubConfig{AccessToken: "token", Repo: "owner/site"},
+		BitBucket: conf.BitBucketConfig{ClientID: "client", Repo: "owner/site"},
+		Roles:     []string{"admin"},
+		JWT:       conf.JWTConfiguration{JWKSRefreshInterval: 3600},
+	}
+
+	var patch interface{}
+	require.NoError(t, decodeJSON(strings.NewReader(`{"github":{"repo":"owner/other"},"bitbucket":{"client_id":null}}`), &patch))
+	patched, err := patchConfig(config, patch)
+	require.NoError(t, err)
+	assert.Equal(t, "owner/other", patched.GitHub.Repo)
+	assert.Equal(t, "token", patched.GitHub.AccessToken)
+	assert.Empty(t, patched.BitBucket.ClientID)
+	assert.Equal(t, "owner/site", patched.BitBucket.Repo)
+	assert.Equal(t, []string{"admin"}, patched.Roles)
+	assert.Equal(t, 3600, patched.JWT.JWKSRefreshInterval)
+	assert.Equal(t, "owner/site", config.GitHub.Repo, "the original is left untouched")
+
+	require.NoError(t, decodeJSON(strings.NewReader(`{"github":{"rpo":"typo"}}`), &patch))
+	_, err = patchConfig(config, patch)
+	assert.Error(t, err)
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "git_gateway"
+
+var (
+	gatewayRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Number of requests handled by the git provider gateways.",
+	}, []string{"provider", "endpoint", "method", "status", "instance"})
+
+	gatewayRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of requests handled by the git provider gateways.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"provider", "endpoint", "method", "status", "instance"})
+
+	upstreamErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Number of requests that failed to reach the git provider.",
+	}, []string{"provider", "instance"})
+
+	upstreamRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_ratelimit_remaining",
+		Help:      "Remaining requests in the git provider rate limit window, as last reported by the provider.",
+	}, []string{"provider", "instance"})
+
+	authFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of requests rejected by authentication or authorization.",
+	}, []string{"reason"})
+)
+
+// newMetricsHandler serves /metrics on the separate metrics listener.
+func newMetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// instrumentGateway records request counts and latencies for a gateway. It
+// also stores the provider in the context for the proxy error handler.
+func instrumentGateway(provider string, endpointGroup endpointGroupFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			endpoint := endpointGroup(r.URL.Path)
+			ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			ctx := withProvider(r.Context(), provider)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			labels := prometheus.Labels{
+				"provider": provider,
+				"endpoint": endpoint,
+				"method":   r.Method,
+				"status":   strconv.Itoa(status),
+				"instance": getInstanceID(ctx),
+			}
+			gatewayRequestsTotal.With(labels).Inc()
+			gatewayRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+func observeAuthFailure(reason string) {
+	authFailuresTotal.WithLabelValues(reason).Inc()
+}
+
+func observeUpstreamError(ctx context.Context) {
+	upstreamErrorsTotal.WithLabelValues(getProvider(ctx), getInstanceID(ctx)).Inc()
+}
+
+// observeRateLimit records the remaining rate limit reported in header.
+func observeRateLimit(ctx context.Context, header string) {
+	if header == "" {
+		return
+	}
+	remaining, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return
+	}
+	upstreamRateLimitRemaining.WithLabelValues(getProvider(ctx), getInstanceID(ctx)).Set(remaining)
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	config := &conf.Configuration{JWT: conf.JWTConfiguration{Secret: "secret"}}
+	ctx, err := WithInstanceConfig(context.Background(), config, "")
+	require.NoError(t, err)
+	api := NewAPIWithVersion(ctx, &conf.GlobalConfiguration{OperatorToken: testOperatorToken}, nil, "test")
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/github/contents/README.md", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "metrics require an operator credential")
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Contains(t, string(body), `git_gateway_auth_failures_total{reason="missing_token"}`)
+	assert.Contains(t, string(body), `git_gateway_requests_total{endpoint="contents",instance="",method="GET",provider="github",status="401"}`)
+}
+
+func TestMetricsListener(t *testing.T) {
+	config := &conf.Configuration{JWT: conf.JWTConfiguration{Secret: "secret"}}
+	ctx, err := WithInstanceConfig(context.Background(), config, "")
+	require.NoError(t, err)
+	globalConfig := &conf.GlobalConfiguration{OperatorToken: testOperatorToken}
+	globalConfig.Metrics.Address = "localhost:9100"
+	api := NewAPIWithVersion(ctx, globalConfig, nil, "test")
+
+	// the API listener doesn't serve metrics at all
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	api.handler.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	newMetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "git_gateway_")
+}
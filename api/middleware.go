@@ -2,20 +2,29 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
 	"github.com/netlify/git-gateway/models"
 )
 
 const (
 	jwsSignatureHeaderName = "x-nf-sign"
+	// defaultOperatorName identifies requests made with the operator token
+	defaultOperatorName = conf.LegacyOperatorName
 )
 
 type NetlifyMicroserviceClaims struct {
 	SiteURL    string `json:"site_url"`
 	InstanceID string `json:"id"`
 	NetlifyID  string `json:"netlify_id"`
+	// Host and Path bind the signature to a request
+	Host string `json:"host,omitempty"`
+	Path string `json:"path,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -37,13 +46,15 @@ func (a *API) loadInstanceConfig(w http.ResponseWriter, r *http.Request) (contex
 	}
 
 	claims := NetlifyMicroserviceClaims{}
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-	_, err := p.ParseWithClaims(signature, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(a.config.OperatorToken), nil
-	})
+	operator, err := a.verifySignature(signature, &claims)
 	if err != nil {
 		return nil, badRequestError("Operator microservice signature is invalid: %v", err)
 	}
+	logEntrySetField(r, "operator", operator)
+	ctx = withOperator(ctx, operator)
+	if err := a.checkSignatureClaims(r, &claims); err != nil {
+		return nil, err
+	}
 
 	instanceID := claims.InstanceID
 	if instanceID == "" {
@@ -52,13 +63,19 @@ func (a *API) loadInstanceConfig(w http.ResponseWriter, r *http.Request) (contex
 
 	logEntrySetField(r, "instance_id", instanceID)
 	logEntrySetField(r, "netlify_id", claims.NetlifyID)
-	instance, err := a.db.GetInstance(instanceID)
+	instance, err := a.conn(ctx).GetInstance(instanceID)
 	if err != nil {
 		if models.IsNotFoundError(err) {
 			return nil, notFoundError("Unable to locate site configuration")
 		}
 		return nil, internalServerError("Database error loading instance").WithInternalError(err)
 	}
+	switch instance.State {
+	case models.InstanceStateSuspended:
+		return nil, forbiddenError("Site configuration is suspended")
+	case models.InstanceStateDeleted:
+		return nil, goneError("Site configuration has been deleted")
+	}
 
 	config, err := instance.Config()
 	if err != nil {
@@ -74,18 +91,109 @@ func (a *API) loadInstanceConfig(w http.ResponseWriter, r *http.Request) (contex
 	return ctx, nil
 }
 
+// verifySignature checks the signature against the active signing
+// credentials and returns the name of the one it was signed with. A "kid"
+// header names the credential, otherwise each is tried.
+func (a *API) verifySignature(signature string, claims *NetlifyMicroserviceClaims) (string, error) {
+	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
+	err := errors.New("no signing credential is configured")
+	now := time.Now()
+	for _, c := range a.config.OperatorCredentials() {
+		if !c.HasScope(conf.OperatorScopeSigning) || !c.Active(now) {
+			continue
+		}
+		_, err = p.ParseWithClaims(signature, claims, func(token *jwt.Token) (interface{}, error) {
+			if kid, ok := token.Header["kid"]; ok && kid != c.Name {
+				return nil, errors.New("signed by another credential")
+			}
+			return []byte(c.Token), nil
+		})
+		if err == nil {
+			return c.Name, nil
+		}
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0 {
+			continue
+		}
+		// the signature matched, the claims are invalid
+		return "", err
+	}
+	return "", err
+}
+
+// checkSignatureClaims limits the age of a signature and, when configured,
+// its use to a single request.
+func (a *API) checkSignatureClaims(r *http.Request, claims *NetlifyMicroserviceClaims) error {
+	config := a.config.Signature
+	maxAge := config.MaxAge
+	if maxAge <= 0 {
+		maxAge = conf.DefaultSignatureMaxAge
+	}
+
+	if claims.ExpiresAt == 0 || claims.IssuedAt == 0 {
+		return badRequestError("Operator microservice signature requires exp and iat claims")
+	}
+	issuedAt, expiresAt := time.Unix(claims.IssuedAt, 0), time.Unix(claims.ExpiresAt, 0)
+	now := time.Now()
+	if now.Sub(issuedAt) > maxAge || expiresAt.Sub(issuedAt) > maxAge {
+		return badRequestError("Operator microservice signature exceeds the maximum age of %v", maxAge)
+	}
+
+	if config.BindRequest && (claims.Host != r.Host || claims.Path != r.URL.Path) {
+		return badRequestError("Operator microservice signature was made for another request")
+	}
+
+	if config.ReplayProtection {
+		if claims.Id == "" {
+			return badRequestError("Operator microservice signature requires a jti claim")
+		}
+		if !a.replay.add(claims.Id, expiresAt, now) {
+			return badRequestError("Operator microservice signature has already been used")
+		}
+	}
+	return nil
+}
+
 func (a *API) verifyOperatorRequest(w http.ResponseWriter, req *http.Request) (context.Context, error) {
 	c, _, err := a.extractOperatorRequest(w, req)
 	return c, err
 }
 
+// extractOperatorRequest authenticates the operator credential of the
+// request. Reading takes the read-only scope, changes the instance-admin
+// scope.
 func (a *API) extractOperatorRequest(w http.ResponseWriter, req *http.Request) (context.Context, string, error) {
 	token, err := a.extractBearerToken(w, req)
 	if err != nil {
 		return nil, token, err
 	}
-	if token == "" || token != a.config.OperatorToken {
+	c := a.operatorCredential(token)
+	if c == nil {
 		return nil, token, unauthorizedError("Request does not include an Operator token")
 	}
-	return req.Context(), token, nil
+	logEntrySetField(req, "operator", c.Name)
+
+	scope := conf.OperatorScopeInstanceAdmin
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		scope = conf.OperatorScopeReadOnly
+	}
+	if !c.HasScope(scope) {
+		return nil, token, forbiddenError("Operator credential %q lacks the %s scope", c.Name, scope)
+	}
+	return withOperator(req.Context(), c.Name), token, nil
+}
+
+// operatorCredential finds the active credential with the token. Every
+// credential is compared in constant time, so the comparison doesn't leak
+// how much of a token matched.
+func (a *API) operatorCredential(token string) *conf.OperatorCredential {
+	var found *conf.OperatorCredential
+	now := time.Now()
+	creds := a.config.OperatorCredentials()
+	for idx := range creds {
+		match := subtle.ConstantTimeCompare([]byte(token), []byte(creds[idx].Token)) == 1
+		if match && found == nil && creds[idx].Active(now) {
+			found = &creds[idx]
+		}
+	}
+	return found
 }
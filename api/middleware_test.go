@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSignatureClaims(instanceID string) NetlifyMicroserviceClaims {
+	now := time.Now()
+	return NetlifyMicroserviceClaims{
+		InstanceID: instanceID,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(time.Minute).Unix(),
+		},
+	}
+}
+
+func TestSignatureClaims(t *testing.T) {
+	api := newOperatorAPI(t)
+	instance := createTestInstance(t, api, "uuid-1", &conf.Configuration{JWT: testJWT})
+
+	request := func(claims NetlifyMicroserviceClaims, path string) *httptest.ResponseRecorder {
+		signature, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testOperatorToken))
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "http://gateway.example.com"+path, nil)
+		req.Header.Set(jwsSignatureHeaderName, signature)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		return w
+	}
+	// requests with an accepted signature fail the user authentication
+	accepted := func(t *testing.T, w *httptest.ResponseRecorder) {
+		assert.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+	rejected := func(t *testing.T, w *httptest.ResponseRecorder, msg string) {
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), msg)
+	}
+
+	t.Run("Lifetime", func(t *testing.T) {
+		accepted(t, request(testSignatureClaims(instance.ID), "/settings"))
+
+		claims := testSignatureClaims(instance.ID)
+		claims.ExpiresAt = 0
+		rejected(t, request(claims, "/settings"), "requires exp and iat")
+
+		claims = testSignatureClaims(instance.ID)
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		rejected(t, request(claims, "/settings"), "maximum age")
+
+		claims = testSignatureClaims(instance.ID)
+		claims.IssuedAt = time.Now().Add(-10 * time.Minute).Unix()
+		rejected(t, request(claims, "/settings"), "maximum age")
+
+		claims = testSignatureClaims(instance.ID)
+		claims.ExpiresAt = time.Now().Add(-time.Second).Unix()
+		rejected(t, request(claims, "/settings"), "expired")
+	})
+
+	t.Run("ReplayProtection", func(t *testing.T) {
+		api.config.Signature.ReplayProtection = true
+		defer func() { api.config.Signature.ReplayProtection = false }()
+
+		rejected(t, request(testSignatureClaims(instance.ID), "/settings"), "requires a jti")
+
+		claims := testSignatureClaims(instance.ID)
+		claims.Id = "nonce-1"
+		accepted(t, request(claims, "/settings"))
+		rejected(t, request(claims, "/settings"), "already been used")
+	})
+
+	t.Run("BindRequest", func(t *testing.T) {
+		api.config.Signature.BindRequest = true
+		defer func() { api.config.Signature.BindRequest = false }()
+
+		claims := testSignatureClaims(instance.ID)
+		claims.Host = "gateway.example.com"
+		claims.Path = "/settings"
+		accepted(t, request(claims, "/settings"))
+		rejected(t, request(claims, "/github/contents/README.md"), "another request")
+		claims.Host = "other.example.com"
+		rejected(t, request(claims, "/settings"), "another request")
+	})
+}
+
+func TestReplayCache(t *testing.T) {
+	c := newReplayCache()
+	now := time.Now()
+	assert.True(t, c.add("a", now.Add(time.Minute), now))
+	assert.False(t, c.add("a", now.Add(time.Minute), now))
+	assert.True(t, c.add("b", now.Add(time.Minute), now))
+
+	// expired entries are forgotten
+	later := now.Add(2 * time.Minute)
+	assert.True(t, c.add("a", later.Add(time.Minute), later))
+	assert.Len(t, c.seen, 1)
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperatorCredentialScopes(t *testing.T) {
+	api := newOperatorAPI(t)
+	api.config.Operators = conf.OperatorCredentials{
+		{Name: "reader", Token: "reader-token", Scopes: []string{conf.OperatorScopeReadOnly}},
+		{Name: "old-admin", Token: "old-admin-token", Scopes: []string{conf.OperatorScopeInstanceAdmin}, ExpiresAt: time.Now().Add(-time.Minute)},
+		{Name: "admin", Token: "admin-token", Scopes: []string{conf.OperatorScopeInstanceAdmin}},
+	}
+	request := func(method, token string) int {
+		req := httptest.NewRequest(method, "/instances", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "reader-token"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "reader-token"))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "admin-token"))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "old-admin-token"), "expired credentials are rejected")
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "admin-token-"))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, testOperatorToken))
+}
+
+func TestOperatorSigningCredentials(t *testing.T) {
+	api := newOperatorAPI(t)
+	instance := createTestInstance(t, api, "uuid-1", &conf.Configuration{JWT: testJWT})
+	api.config.OperatorToken = ""
+	api.config.Operators = conf.OperatorCredentials{
+		{Name: "reader", Token: "reader-token", Scopes: []string{conf.OperatorScopeReadOnly}},
+		{Name: "signer-2023", Token: "old-signing-key", Scopes: []string{conf.OperatorScopeSigning}},
+		{Name: "signer-2024", Token: "new-signing-key", Scopes: []string{conf.OperatorScopeSigning}},
+	}
+	status := func(key string, header map[string]interface{}) int {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, testSignatureClaims(instance.ID))
+		for k, v := range header {
+			token.Header[k] = v
+		}
+		signature, err := token.SignedString([]byte(key))
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/settings", nil)
+		req.Header.Set(jwsSignatureHeaderName, signature)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// both signing credentials are accepted during a rotation, passing on to
+	// the user authentication
+	assert.Equal(t, http.StatusUnauthorized, status("old-signing-key", nil))
+	assert.Equal(t, http.StatusUnauthorized, status("new-signing-key", nil))
+	assert.Equal(t, http.StatusUnauthorized, status("new-signing-key", map[string]interface{}{"kid": "signer-2024"}))
+	assert.Equal(t, http.StatusBadRequest, status("new-signing-key", map[string]interface{}{"kid": "signer-2023"}))
+	assert.Equal(t, http.StatusBadRequest, status("reader-token", nil), "credentials without the signing scope can't sign")
+}
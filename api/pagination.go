@@ -0,0 +1,94 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/netlify/git-gateway/models"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 100
+)
+
+// paginate reads the page and per_page query parameters.
+func paginate(r *http.Request) (*models.Pagination, error) {
+	params := r.URL.Query()
+	p := &models.Pagination{Page: 1, PerPage: defaultPerPage}
+
+	if v := params.Get("page"); v != "" {
+		page, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || page == 0 {
+			return nil, badRequestError("Invalid page: %q", v)
+		}
+		p.Page = page
+	}
+	if v := params.Get("per_page"); v != "" {
+		perPage, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || perPage == 0 {
+			return nil, badRequestError("Invalid per_page: %q", v)
+		}
+		if perPage > maxPerPage {
+			perPage = maxPerPage
+		}
+		p.PerPage = perPage
+	}
+	return p, nil
+}
+
+// addPaginationHeaders sets the X-Total-Count and Link headers for a page of
+// results.
+func addPaginationHeaders(w http.ResponseWriter, r *http.Request, p *models.Pagination) {
+	w.Header().Set("X-Total-Count", strconv.FormatUint(p.Count, 10))
+
+	lastPage := (p.Count + p.PerPage - 1) / p.PerPage
+	if lastPage == 0 {
+		lastPage = 1
+	}
+
+	links := []string{}
+	if p.Page < lastPage {
+		links = append(links, pageLink(r, p, p.Page+1, "next"))
+	}
+	if p.Page > 1 {
+		links = append(links, pageLink(r, p, p.Page-1, "prev"))
+	}
+	links = append(links, pageLink(r, p, 1, "first"), pageLink(r, p, lastPage, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+func pageLink(r *http.Request, p *models.Pagination, page uint64, rel string) string {
+	u := url.URL{Path: r.URL.Path}
+	q := r.URL.Query()
+	q.Set("page", strconv.FormatUint(page, 10))
+	q.Set("per_page", strconv.FormatUint(p.PerPage, 10))
+	u.RawQuery = q.Encode()
+	return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+}
+
+// sortParams reads the comma separated sort query parameter. Fields are
+// sorted ascending unless prefixed with "-", only the allowed fields may be
+// used.
+func sortParams(r *http.Request, allowed ...string) (*models.SortParams, error) {
+	sort := &models.SortParams{}
+	v := r.URL.Query().Get("sort")
+	if v == "" {
+		return sort, nil
+	}
+	for _, name := range strings.Split(v, ",") {
+		field := models.SortField{Name: strings.TrimSpace(name), Dir: models.Ascending}
+		if strings.HasPrefix(field.Name, "-") {
+			field.Name = strings.TrimPrefix(field.Name, "-")
+			field.Dir = models.Descending
+		}
+		if !containsString(allowed, field.Name) {
+			return nil, badRequestError("Invalid sort field: %q", field.Name)
+		}
+		sort.Fields = append(sort.Fields, field)
+	}
+	return sort, nil
+}
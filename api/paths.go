@@ -0,0 +1,212 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const maxFormMemory = 32 << 20
+
+// writtenPath is a repository path modified by a request. Tree is set when
+// the whole directory at Path is replaced.
+type writtenPath struct {
+	Path string
+	Tree bool
+}
+
+type writtenPathsFunc func(r *http.Request) ([]writtenPath, error)
+
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// authorizePaths checks every path written by the request against the
+// configured path rules.
+func authorizePaths(r *http.Request, extract writtenPathsFunc) error {
+	ctx := r.Context()
+	config := getConfig(ctx)
+	if len(config.PathRules) == 0 || !isWriteMethod(r.Method) {
+		return nil
+	}
+
+	paths, err := extract(r)
+	if err != nil {
+		return unreadableRequest(err)
+	}
+
+	roles := userRoles(getClaims(ctx))
+	for _, p := range paths {
+		if p.Tree {
+			if !config.PathRules.AllowsTreeWrite(roles, p.Path) {
+				return accessDenied("path", "Access to path not allowed: your role can't replace the directory %q", p.Path)
+			}
+		} else if !config.PathRules.AllowsWrite(roles, p.Path) {
+			return accessDenied("path", "Access to path not allowed: your role can't write to %q", p.Path)
+		}
+	}
+	return nil
+}
+
+type githubTreeParams struct {
+	BaseTree string `json:"base_tree"`
+	Tree     []struct {
+		Path string `json:"path"`
+		Mode string `json:"mode"`
+		Type string `json:"type"`
+	} `json:"tree"`
+}
+
+// githubWrittenPaths extracts the paths written through the contents API and
+// the entries of trees created through the git data API. A tree created
+// without a base tree drops every file it doesn't list, so it replaces the
+// whole repository.
+func githubWrittenPaths(r *http.Request) ([]writtenPath, error) {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/github/contents"):
+		return []writtenPath{{Path: strings.TrimPrefix(strings.TrimPrefix(path, "/github/contents"), "/")}}, nil
+	case strings.TrimSuffix(path, "/") == "/github/git/trees" && r.Method == http.MethodPost:
+		body, err := readRequestBody(r)
+		if err != nil {
+			return nil, err
+		}
+		params := githubTreeParams{}
+		if err := json.Unmarshal(body, &params); err != nil {
+			return nil, err
+		}
+		paths := []writtenPath{}
+		if params.BaseTree == "" {
+			paths = append(paths, writtenPath{Path: "", Tree: true})
+		}
+		for _, entry := range params.Tree {
+			paths = append(paths, writtenPath{
+				Path: entry.Path,
+				Tree: entry.Type == "tree" || entry.Mode == "040000",
+			})
+		}
+		return paths, nil
+	}
+	return nil, nil
+}
+
+type gitlabCommitParams struct {
+	Actions []struct {
+		Action       string `json:"action"`
+		FilePath     string `json:"file_path"`
+		PreviousPath string `json:"previous_path"`
+	} `json:"actions"`
+}
+
+// gitlabWrittenPaths extracts the paths written through the files API and
+// the actions of commits created through the commits API. Cherry picks and
+// reverts don't list the files they change, so they count as replacing the
+// whole repository.
+func gitlabWrittenPaths(r *http.Request) ([]writtenPath, error) {
+	path := r.URL.Path
+	switch {
+	case gitlabCommitActionRegexp.MatchString(strings.TrimSuffix(path, "/")) && r.Method == http.MethodPost:
+		return []writtenPath{{Path: "", Tree: true}}, nil
+	case strings.HasPrefix(path, "/gitlab/repository/files"):
+		return []writtenPath{{Path: strings.TrimPrefix(strings.TrimPrefix(path, "/gitlab/repository/files"), "/")}}, nil
+	case strings.TrimSuffix(path, "/") == "/gitlab/repository/commits" && r.Method == http.MethodPost:
+		body, err := readRequestBody(r)
+		if err != nil {
+			return nil, err
+		}
+		params := gitlabCommitParams{}
+		if err := json.Unmarshal(body, &params); err != nil {
+			return nil, err
+		}
+		paths := []writtenPath{}
+		for _, action := range params.Actions {
+			paths = append(paths, writtenPath{Path: action.FilePath})
+			if action.PreviousPath != "" {
+				paths = append(paths, writtenPath{Path: action.PreviousPath})
+			}
+		}
+		return paths, nil
+	}
+	return nil, nil
+}
+
+// bitbucketReservedFields are the src form fields that don't name a file.
+var bitbucketReservedFields = map[string]bool{
+	"message": true,
+	"author":  true,
+	"parents": true,
+	"branch":  true,
+	"files":   true,
+}
+
+// bitbucketWrittenPaths extracts the file paths posted to the src endpoint,
+// where every non reserved form field names a file and "files" lists the
+// files to delete.
+func bitbucketWrittenPaths(r *http.Request) ([]writtenPath, error) {
+	form, err := parseFormCopy(r)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []writtenPath{}
+	for name, values := range form {
+		if name == "files" {
+			for _, v := range values {
+				paths = append(paths, writtenPath{Path: v})
+			}
+			continue
+		}
+		if !bitbucketReservedFields[name] {
+			paths = append(paths, writtenPath{Path: name})
+		}
+	}
+	return paths, nil
+}
+
+// parseFormCopy parses the url encoded or multipart form in the body of r
+// without consuming it. Uploaded files are reported by field name only.
+func parseFormCopy(r *http.Request) (map[string][]string, error) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	clone := &http.Request{
+		Method: r.Method,
+		Header: r.Header,
+		URL:    r.URL,
+		Body:   ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	form := map[string][]string{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := clone.ParseMultipartForm(maxFormMemory); err != nil {
+			return nil, err
+		}
+		defer clone.MultipartForm.RemoveAll()
+		for name, values := range clone.MultipartForm.Value {
+			form[name] = values
+		}
+		for name := range clone.MultipartForm.File {
+			if _, ok := form[name]; !ok {
+				form[name] = nil
+			}
+		}
+		return form, nil
+	}
+
+	if err := clone.ParseForm(); err != nil {
+		return nil, err
+	}
+	for name, values := range clone.PostForm {
+		form[name] = values
+	}
+	return form, nil
+}
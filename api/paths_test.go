@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pathRulesRequest(method, path, contentType string, body []byte, role string) *http.Request {
+	config := &conf.Configuration{
+		PathRules: conf.PathRules{
+			{Pattern: "data/settings/**", Roles: []string{"admin"}},
+			{Pattern: "content/blog/**", Roles: []string{"blogger", "admin"}},
+			{Pattern: "**", Roles: []string{"admin"}},
+		},
+	}
+	claims := testClaims()
+	claims.AppMetaData = map[string]interface{}{"roles": []interface{}{role}}
+	ctx := withConfig(context.Background(), config)
+	ctx = withToken(ctx, &jwt.Token{Claims: claims})
+
+	r := httptest.NewRequest(method, path, bytes.NewReader(body)).WithContext(ctx)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	return r
+}
+
+func TestPathRules(t *testing.T) {
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		role    string
+		allowed bool
+	}{
+		{"ReadAnywhere", http.MethodGet, "/github/contents/data/settings/site.yml", "", "blogger", true},
+		{"ContentsInScope", http.MethodPut, "/github/contents/content/blog/post.md", "", "blogger", true},
+		{"ContentsOutOfScope", http.MethodPut, "/github/contents/data/settings/site.yml", "", "blogger", false},
+		{"ContentsUnmatched", http.MethodDelete, "/github/contents/README.md", "", "blogger", false},
+		{"ContentsEscapingScope", http.MethodPut, "/github/contents/content/blog/../../data/settings/site.yml", "", "blogger", false},
+		{"TreeBlobEscapingScope", http.MethodPost, "/github/git/trees", `{"tree":[{"path":"content/blog/../../.github/workflows/x.yml","type":"blob"}]}`, "blogger", false},
+		{"TreeAbsoluteBlob", http.MethodPost, "/github/git/trees", `{"tree":[{"path":"/content/blog/a.md","type":"blob"}]}`, "blogger", false},
+		{"AdminAnywhere", http.MethodPut, "/github/contents/data/settings/site.yml", "", "admin", true},
+		{"TreeBlobs", http.MethodPost, "/github/git/trees", `{"base_tree":"abc","tree":[{"path":"content/blog/a.md","type":"blob"}]}`, "blogger", true},
+		{"TreeBlobOutOfScope", http.MethodPost, "/github/git/trees", `{"tree":[{"path":"content/blog/a.md","type":"blob"},{"path":"data/settings/site.yml","type":"blob"}]}`, "blogger", false},
+		{"TreeSubtree", http.MethodPost, "/github/git/trees", `{"base_tree":"abc","tree":[{"path":"content/blog","mode":"040000","type":"tree","sha":"def"}]}`, "blogger", true},
+		{"TreeParentSubtree", http.MethodPost, "/github/git/trees", `{"tree":[{"path":"content","mode":"040000","type":"tree","sha":"def"}]}`, "blogger", false},
+		{"TreeWithoutBase", http.MethodPost, "/github/git/trees", `{"tree":[{"path":"content/blog/a.md","type":"blob"}]}`, "blogger", false},
+		{"AdminTreeWithoutBase", http.MethodPost, "/github/git/trees", `{"tree":[{"path":"content/blog/a.md","type":"blob"}]}`, "admin", true},
+		{"GitLabFile", http.MethodPost, "/gitlab/repository/files/content%2Fblog%2Fpost.md", "", "blogger", true},
+		{"GitLabFileOutOfScope", http.MethodPut, "/gitlab/repository/files/data%2Fsettings%2Fsite.yml", "", "blogger", false},
+		{"GitLabCommitMove", http.MethodPost, "/gitlab/repository/commits", `{"actions":[{"action":"move","file_path":"content/blog/b.md","previous_path":"data/settings/site.yml"}]}`, "blogger", false},
+		{"GitLabCherryPick", http.MethodPost, "/gitlab/repository/commits/abc123/cherry_pick", `{"branch":"main"}`, "blogger", false},
+		{"GitLabRevert", http.MethodPost, "/gitlab/repository/commits/abc123/revert", `{"branch":"main"}`, "blogger", false},
+		{"AdminGitLabRevert", http.MethodPost, "/gitlab/repository/commits/abc123/revert", `{"branch":"main"}`, "admin", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := pathRulesRequest(c.method, c.path, "application/json", []byte(c.body), c.role)
+			extract := githubWrittenPaths
+			if strings.HasPrefix(c.path, "/gitlab") {
+				extract = gitlabWrittenPaths
+			}
+			err := authorizePaths(r, extract)
+			assert.Equal(t, c.allowed, err == nil, "unexpected result: %v", err)
+		})
+	}
+}
+
+func TestPathRulesBitBucketForm(t *testing.T) {
+	build := func(fields map[string]string) ([]byte, string) {
+		body := &bytes.Buffer{}
+		w := multipart.NewWriter(body)
+		for k, v := range fields {
+			require.NoError(t, w.WriteField(k, v))
+		}
+		require.NoError(t, w.Close())
+		return body.Bytes(), w.FormDataContentType()
+	}
+
+	body, contentType := build(map[string]string{"message": "update", "branch": "master", "content/blog/post.md": "hello"})
+	r := pathRulesRequest(http.MethodPost, "/bitbucket/src", contentType, body, "blogger")
+	require.NoError(t, authorizePaths(r, bitbucketWrittenPaths))
+
+	// the body is still available to be proxied
+	proxied := new(bytes.Buffer)
+	proxied.ReadFrom(r.Body)
+	assert.Equal(t, body, proxied.Bytes())
+
+	body, contentType = build(map[string]string{"message": "delete", "files": "data/settings/site.yml"})
+	r = pathRulesRequest(http.MethodPost, "/bitbucket/src", contentType, body, "blogger")
+	require.Error(t, authorizePaths(r, bitbucketWrittenPaths))
+}
@@ -0,0 +1,63 @@
+package api
+
+import "net/http"
+
+// Endpoint groups are shared by all gateways, so a single permission matrix
+// applies regardless of the git provider.
+const (
+	endpointContents = "contents"
+	endpointGit      = "git"
+	endpointCommits  = "commits"
+	endpointPulls    = "pulls"
+	endpointMerges   = "merges"
+	endpointBranches = "branches"
+	endpointStatuses = "statuses"
+	endpointCompare  = "compare"
+	endpointLabels   = "labels"
+	// endpointOther groups the paths a gateway doesn't allow.
+	endpointOther = "other"
+)
+
+type endpointGroupFunc func(path string) string
+
+// userRoles returns the roles stored in the app_metadata of the claims.
+func userRoles(claims *GatewayClaims) []string {
+	roles := []string{}
+	data, _ := claims.AppMetaData["roles"].([]interface{})
+	for _, r := range data {
+		if role, ok := r.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// authorizeRoles checks the roles of the caller against the configured
+// roles and, when present, the permission matrix for the endpoint group.
+func authorizeRoles(r *http.Request, endpoint string) error {
+	ctx := r.Context()
+	claims := getClaims(ctx)
+	config := getConfig(ctx)
+
+	roles := userRoles(claims)
+	if len(config.Roles) > 0 && !hasAnyRole(roles, config.Roles) {
+		return accessDenied("role", "Access to endpoint not allowed: your role doesn't allow access")
+	}
+
+	if len(config.Permissions) == 0 {
+		return nil
+	}
+	if !config.Permissions.Allows(roles, r.Method, endpoint) {
+		return accessDenied("permission", "Access to endpoint not allowed: your role doesn't allow %s requests to %s", r.Method, endpoint)
+	}
+	return nil
+}
+
+func hasAnyRole(roles []string, allowed []string) bool {
+	for _, role := range roles {
+		if containsString(allowed, role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointGroups(t *testing.T) {
+	assert.Equal(t, endpointContents, githubEndpointGroup("/github/contents/README.md"))
+	assert.Equal(t, endpointGit, githubEndpointGroup("/github/git/refs/heads/master"))
+	assert.Equal(t, endpointPulls, githubEndpointGroup("/github/pulls/12"))
+	assert.Equal(t, endpointMerges, githubEndpointGroup("/github/pulls/12/merge"))
+	assert.Equal(t, endpointMerges, githubEndpointGroup("/github/merges"))
+	assert.Equal(t, endpointLabels, githubEndpointGroup("/github/issues/12/labels"))
+
+	assert.Equal(t, endpointContents, gitlabEndpointGroup("/gitlab/repository/files/README.md"))
+	assert.Equal(t, endpointGit, gitlabEndpointGroup("/gitlab/repository/tree"))
+	assert.Equal(t, endpointCommits, gitlabEndpointGroup("/gitlab/repository/commits"))
+	assert.Equal(t, endpointPulls, gitlabEndpointGroup("/gitlab/merge_requests/3"))
+	assert.Equal(t, endpointMerges, gitlabEndpointGroup("/gitlab/merge_requests/3/merge"))
+
+	assert.Equal(t, endpointContents, bitbucketEndpointGroup("/bitbucket/src/main/README.md"))
+	assert.Equal(t, endpointOther, bitbucketEndpointGroup("/bitbucket/pullrequests/3/merge"))
+}
+
+func TestPermissionMatrix(t *testing.T) {
+	config := &conf.Configuration{
+		Roles: []string{"viewer", "editor", "publisher"},
+		Permissions: conf.PermissionMatrix{
+			"viewer": {{Methods: []string{"GET"}, Endpoints: []string{"contents", "git"}}},
+			"editor": {
+				{Methods: []string{"GET"}, Endpoints: []string{"*"}},
+				{Methods: []string{"POST"}, Endpoints: []string{"pulls"}},
+			},
+			"publisher": {{Methods: []string{"*"}, Endpoints: []string{"*"}}},
+		},
+	}
+
+	cases := []struct {
+		role    string
+		method  string
+		path    string
+		allowed bool
+	}{
+		{"viewer", http.MethodGet, "/github/contents/README.md", true},
+		{"viewer", http.MethodHead, "/gitlab/repository/tree", true},
+		{"viewer", http.MethodPut, "/github/contents/README.md", false},
+		{"viewer", http.MethodGet, "/github/pulls", false},
+		{"editor", http.MethodPost, "/github/pulls", true},
+		{"editor", http.MethodPut, "/github/pulls/1/merge", false},
+		{"editor", http.MethodPut, "/gitlab/merge_requests/1/merge", false},
+		{"publisher", http.MethodPut, "/github/pulls/1/merge", true},
+		{"viewer", http.MethodGet, "/bitbucket/src/main/README.md", true},
+		{"publisher", http.MethodPost, "/bitbucket/pullrequests/1/merge", false},
+		{"publisher", http.MethodDelete, "/bitbucket/refs/branches/main", false},
+		{"other", http.MethodGet, "/github/contents/README.md", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.role+" "+c.method+" "+c.path, func(t *testing.T) {
+			claims := testClaims()
+			claims.AppMetaData = map[string]interface{}{"roles": []interface{}{c.role}}
+			ctx := withConfig(context.Background(), config)
+			ctx = withToken(ctx, &jwt.Token{Claims: claims})
+			r := httptest.NewRequest(c.method, c.path, nil).WithContext(ctx)
+
+			var err error
+			switch {
+			case pathRegexp.MatchString(c.path):
+				err = NewGitHubGateway().authenticate(httptest.NewRecorder(), r)
+			case bitbucketPathRegexp.MatchString(c.path):
+				err = NewBitBucketGateway().authenticate(httptest.NewRecorder(), r)
+			default:
+				err = NewGitLabGateway().authenticate(httptest.NewRecorder(), r)
+			}
+			assert.Equal(t, c.allowed, err == nil, "unexpected result: %v", err)
+		})
+	}
+}
+
+func TestGatewayDenialStatus(t *testing.T) {
+	config := &conf.Configuration{
+		JWT:       conf.JWTConfiguration{Secret: "secret"},
+		GitHub:    conf.GitHubConfig{AccessToken: "github-token", Repo: "owner/repo"},
+		Roles:     []string{"viewer", "editor"},
+		PathRules: conf.PathRules{{Pattern: "**", Roles: []string{"editor"}}},
+	}
+	config.ApplyDefaults()
+	ctx, err := WithInstanceConfig(context.Background(), config, "")
+	require.NoError(t, err)
+	api := NewAPIWithVersion(ctx, &conf.GlobalConfiguration{}, memory.New(), "test")
+
+	status := func(role, method, path, body, token string) int {
+		if token == "" {
+			claims := testClaims()
+			claims.AppMetaData = map[string]interface{}{"roles": []interface{}{role}}
+			token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+			require.NoError(t, err)
+		}
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, status("editor", http.MethodGet, "/github/contents/README.md", "", "invalid"))
+	assert.Equal(t, http.StatusForbidden, status("guest", http.MethodGet, "/github/contents/README.md", "", ""))
+	assert.Equal(t, http.StatusForbidden, status("editor", http.MethodGet, "/github/user", "", ""))
+	assert.Equal(t, http.StatusForbidden, status("viewer", http.MethodPut, "/github/contents/README.md", "{}", ""))
+	assert.Equal(t, http.StatusBadRequest, status("editor", http.MethodPost, "/github/git/trees", "{", ""))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status("editor", http.MethodPost, "/github/git/trees", strings.Repeat(" ", maxRequestBody+1), ""))
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// replayCache remembers the jti of used signatures until they expire, so
+// each signature is accepted only once.
+type replayCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time)}
+}
+
+// add records jti until expiresAt. It returns false if jti is already
+// recorded.
+func (c *replayCache) add(jti string, expiresAt time.Time, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.pruned) > time.Minute {
+		for id, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, id)
+			}
+		}
+		c.pruned = now
+	}
+
+	if exp, ok := c.seen[jti]; ok && !now.After(exp) {
+		return false
+	}
+	c.seen[jti] = expiresAt
+	return true
+}
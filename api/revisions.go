@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/netlify/git-gateway/models"
+	"github.com/pborman/uuid"
+)
+
+type InstanceRevisionResponse struct {
+	models.InstanceRevision
+	// Secrets reports which configuration secrets are set, their values
+	// are never returned.
+	Secrets map[string]bool `json:"secrets"`
+}
+
+// recordRevision stores the current configuration of the instance as a new
+// revision, attributed to the operator making the request.
+func (a *API) recordRevision(ctx context.Context, i *models.Instance, restoredFrom int) error {
+	revision := &models.InstanceRevision{
+		ID:           uuid.NewRandom().String(),
+		InstanceID:   i.ID,
+		BaseConfig:   i.BaseConfig,
+		ChangedBy:    getOperator(ctx),
+		RestoredFrom: restoredFrom,
+	}
+	if err := a.conn(ctx).CreateInstanceRevision(revision); err != nil {
+		return internalServerError("Database error recording instance revision").WithInternalError(err)
+	}
+	return nil
+}
+
+// ListInstanceRevisions returns the configuration revisions of an instance,
+// newest first.
+func (a *API) ListInstanceRevisions(w http.ResponseWriter, r *http.Request) error {
+	i := getInstance(r.Context())
+
+	pagination, err := paginate(r)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := a.conn(r.Context()).FindInstanceRevisions(i.ID, pagination)
+	if err != nil {
+		return internalServerError("Database error finding instance revisions").WithInternalError(err)
+	}
+
+	resp := make([]*InstanceRevisionResponse, len(revisions))
+	for idx, revision := range revisions {
+		resp[idx] = &InstanceRevisionResponse{InstanceRevision: *revision}
+	}
+	addPaginationHeaders(w, r, pagination)
+	return sendJSON(w, http.StatusOK, resp)
+}
+
+// RestoreInstanceRevision rolls the configuration of an instance back to a
+// revision. The restore is recorded as a new revision.
+func (a *API) RestoreInstanceRevision(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	i := getInstance(ctx)
+	if err := checkIfMatch(r, i); err != nil {
+		return err
+	}
+	if err := checkNotDeleted(i); err != nil {
+		return err
+	}
+
+	number, err := strconv.Atoi(chi.URLParam(r, "revision"))
+	if err != nil {
+		return badRequestError("Invalid revision: %q", chi.URLParam(r, "revision"))
+	}
+	revision, err := a.conn(ctx).GetInstanceRevision(i.ID, number)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError("Instance revision not found")
+		}
+		return internalServerError("Database error loading instance revision").WithInternalError(err)
+	}
+
+	i.BaseConfig = revision.BaseConfig
+	if err := a.updateInstance(ctx, i); err != nil {
+		return err
+	}
+	if err := a.recordRevision(ctx, i, revision.Revision); err != nil {
+		return err
+	}
+	return a.sendInstance(w, http.StatusOK, i)
+}
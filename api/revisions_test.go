@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceRevisions(t *testing.T) {
+	api := newOperatorAPI(t)
+	instance := createTestInstance(t, api, "uuid-1", &conf.Configuration{
+		JWT:    testJWT,
+		GitHub: conf.GitHubConfig{AccessToken: "github-token", Repo: "owner/site"},
+		Roles:  []string{"admin"},
+	})
+	path := "/instances/" + instance.ID
+
+	w := operatorRequest(t, api, http.MethodPut, path, InstanceRequestParams{BaseConfig: &conf.Configuration{
+		JWT:    testJWT,
+		GitHub: conf.GitHubConfig{Repo: "owner/broken"},
+	}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = operatorRequest(t, api, http.MethodGet, path+"/revisions", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotContains(t, w.Body.String(), "github-token")
+	revisions := []*InstanceRevisionResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &revisions))
+	require.Len(t, revisions, 2)
+	assert.Equal(t, 2, revisions[0].Revision)
+	assert.Equal(t, "owner/broken", revisions[0].BaseConfig.GitHub.Repo)
+	assert.Equal(t, "owner/site", revisions[1].BaseConfig.GitHub.Repo)
+	assert.Equal(t, defaultOperatorName, revisions[1].ChangedBy)
+	assert.True(t, revisions[1].Secrets["github.access_token"])
+
+	w = operatorRequest(t, api, http.MethodPost, path+"/revisions/1/restore", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	restored := &InstanceResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), restored))
+	assert.Equal(t, "owner/site", restored.BaseConfig.GitHub.Repo)
+	assert.Equal(t, []string{"admin"}, restored.BaseConfig.Roles)
+	assert.True(t, restored.Secrets["github.access_token"])
+
+	w = operatorRequest(t, api, http.MethodGet, path+"/revisions?per_page=1", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &revisions))
+	require.Len(t, revisions, 1)
+	assert.Equal(t, 3, revisions[0].Revision)
+	assert.Equal(t, 1, revisions[0].RestoredFrom)
+	assert.Equal(t, "3", w.Header().Get("X-Total-Count"))
+
+	w = operatorRequest(t, api, http.MethodPost, path+"/revisions/9/restore", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -30,6 +30,9 @@ func (r *router) Post(pattern string, fn apiHandler) {
 func (r *router) Put(pattern string, fn apiHandler) {
 	r.chi.Put(pattern, handler(fn))
 }
+func (r *router) Patch(pattern string, fn apiHandler) {
+	r.chi.Patch(pattern, handler(fn))
+}
 func (r *router) Delete(pattern string, fn apiHandler) {
 	r.chi.Delete(pattern, handler(fn))
 }
@@ -43,6 +46,11 @@ func (r *router) With(fn middlewareHandler) *router {
 	return &router{c}
 }
 
+func (r *router) WithBypass(fn func(next http.Handler) http.Handler) *router {
+	c := r.chi.With(fn)
+	return &router{c}
+}
+
 func (r *router) Use(fn middlewareHandler) {
 	r.chi.Use(middleware(fn))
 }
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/pborman/uuid"
+)
+
+// TokenParams describes a token to mint for testing.
+type TokenParams struct {
+	Subject   string
+	Email     string
+	Roles     []string
+	ExpiresIn time.Duration
+	// Audience replaces the first configured audience.
+	Audience string
+}
+
+// MintToken signs an HS256 token with the JWT secret of config, carrying
+// the first configured issuer and audience so it's accepted as it is.
+func MintToken(config *conf.JWTConfiguration, params TokenParams) (string, error) {
+	if config.Secret == "" {
+		return "", errors.New("minting tokens requires a JWT secret")
+	}
+	now := time.Now()
+	claims := &GatewayClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   params.Subject,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(params.ExpiresIn).Unix(),
+		},
+		Email: params.Email,
+	}
+	if len(config.Issuers) > 0 {
+		claims.Issuer = config.Issuers[0]
+	}
+	if params.Audience != "" {
+		claims.Audience = params.Audience
+	} else if len(config.Audiences) > 0 {
+		claims.Audience = config.Audiences[0]
+	}
+	if len(params.Roles) > 0 {
+		roles := make([]interface{}, len(params.Roles))
+		for i, role := range params.Roles {
+			roles[i] = role
+		}
+		claims.AppMetaData = map[string]interface{}{"roles": roles}
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.Secret))
+}
+
+// TokenInspection explains whether a token is accepted for a request.
+type TokenInspection struct {
+	Header map[string]interface{} `json:"header"`
+	Claims map[string]interface{} `json:"claims"`
+	Roles  []string               `json:"roles"`
+	// Endpoint is the endpoint group of the inspected path
+	Endpoint string `json:"endpoint,omitempty"`
+	Accepted bool   `json:"accepted"`
+	// Reasons explain why the token is rejected
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// InspectToken checks a token the way a request with method to path would,
+// path being a gateway path such as "/github/contents/post.md". Without a
+// path only the roles allowed by the configuration are checked. audience
+// is the value of the X-JWT-AUD header.
+func InspectToken(globalConfig *conf.GlobalConfiguration, config *conf.Configuration, token, method, path, audience string) (*TokenInspection, error) {
+	inspection := &TokenInspection{Roles: []string{}}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("a JWT has three dot separated parts")
+	}
+	// the token is decoded for display, it's only checked by parseJWTClaims
+	for i, v := range []*map[string]interface{}{&inspection.Header, &inspection.Claims} {
+		segment, err := jwt.DecodeSegment(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("decoding token: %v", err)
+		}
+		if err := json.Unmarshal(segment, v); err != nil {
+			return nil, fmt.Errorf("decoding token: %v", err)
+		}
+	}
+	reject := func(err error) {
+		if e, ok := err.(*HTTPError); ok {
+			inspection.Reasons = append(inspection.Reasons, e.Message)
+			return
+		}
+		inspection.Reasons = append(inspection.Reasons, err.Error())
+	}
+
+	r, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if audience != "" {
+		r.Header.Set(audHeaderName, audience)
+	}
+	r = r.WithContext(withConfig(r.Context(), config))
+
+	a := &API{config: globalConfig, jwks: newJWKSCache()}
+	ctx, err := a.parseJWTClaims(token, r)
+	if err != nil {
+		reject(err)
+		return inspection, nil
+	}
+	r = r.WithContext(ctx)
+	inspection.Roles = userRoles(getClaims(ctx))
+
+	var endpoint endpointGroupFunc
+	switch {
+	case strings.HasPrefix(path, "/github/"):
+		endpoint = githubEndpointGroup
+	case strings.HasPrefix(path, "/gitlab/"):
+		endpoint = gitlabEndpointGroup
+	case strings.HasPrefix(path, "/bitbucket/"):
+		endpoint = bitbucketEndpointGroup
+	}
+	switch {
+	case endpoint != nil:
+		inspection.Endpoint = endpoint(path)
+		if inspection.Endpoint == endpointOther {
+			reject(fmt.Errorf("the gateway doesn't allow requests to %s", path))
+		} else if err := authorizeRoles(r, inspection.Endpoint); err != nil {
+			reject(err)
+		}
+	case path != "":
+		reject(fmt.Errorf("%s isn't a gateway path, it must start with /github/, /gitlab/ or /bitbucket/", path))
+	case len(config.Roles) > 0 && !hasAnyRole(inspection.Roles, config.Roles):
+		reject(fmt.Errorf("none of the roles %v is allowed, the configuration allows %s", inspection.Roles, strings.Join(config.Roles, ", ")))
+	}
+
+	inspection.Accepted = len(inspection.Reasons) == 0
+	return inspection, nil
+}
+
+// SignatureParams describes an operator signature to mint.
+type SignatureParams struct {
+	InstanceID string
+	NetlifyID  string
+	SiteURL    string
+	Host       string
+	Path       string
+	ExpiresIn  time.Duration
+}
+
+// SignOperatorRequest mints an x-nf-sign signature with an operator
+// credential. It names the credential in its "kid" header and carries a
+// unique jti, so it's accepted with replay protection.
+func SignOperatorRequest(credential conf.OperatorCredential, params SignatureParams) (string, error) {
+	if !credential.HasScope(conf.OperatorScopeSigning) {
+		return "", fmt.Errorf("operator credential %q doesn't have the %s scope", credential.Name, conf.OperatorScopeSigning)
+	}
+	now := time.Now()
+	claims := &NetlifyMicroserviceClaims{
+		InstanceID: params.InstanceID,
+		NetlifyID:  params.NetlifyID,
+		SiteURL:    params.SiteURL,
+		Host:       params.Host,
+		Path:       params.Path,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.NewRandom().String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(params.ExpiresIn).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = credential.Name
+	return token.SignedString([]byte(credential.Token))
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMintAndInspectToken(t *testing.T) {
+	globalConfig := &conf.GlobalConfiguration{}
+	config := &conf.Configuration{
+		JWT: conf.JWTConfiguration{
+			Secret:    "secret",
+			Issuers:   []string{"https://identity.example.com"},
+			Audiences: []string{"site-a", "site-b"},
+		},
+		Roles: []string{"viewer", "editor"},
+		Permissions: conf.PermissionMatrix{
+			"viewer": {{Methods: []string{"GET"}, Endpoints: []string{"contents"}}},
+			"editor": {{Methods: []string{"*"}, Endpoints: []string{"*"}}},
+		},
+	}
+
+	token, err := MintToken(&config.JWT, TokenParams{Email: "jane@example.com", Roles: []string{"viewer"}, ExpiresIn: time.Hour})
+	require.NoError(t, err)
+
+	inspection, err := InspectToken(globalConfig, config, token, http.MethodGet, "/github/contents/README.md", "")
+	require.NoError(t, err)
+	assert.True(t, inspection.Accepted, inspection.Reasons)
+	assert.Equal(t, []string{"viewer"}, inspection.Roles)
+	assert.Equal(t, endpointContents, inspection.Endpoint)
+	assert.Equal(t, "jane@example.com", inspection.Claims["email"])
+	assert.Equal(t, "https://identity.example.com", inspection.Claims["iss"])
+
+	reasons := func(token, method, path, audience string) []string {
+		inspection, err := InspectToken(globalConfig, config, token, method, path, audience)
+		require.NoError(t, err)
+		assert.False(t, inspection.Accepted)
+		return inspection.Reasons
+	}
+	assert.Len(t, reasons(token, http.MethodPut, "/github/contents/README.md", ""), 1)
+	assert.Len(t, reasons(token, http.MethodGet, "/github/contents/README.md", "site-b"), 1)
+	assert.Len(t, reasons(token, http.MethodGet, "/github/user", ""), 1)
+	assert.Len(t, reasons(token, http.MethodGet, "/contents/README.md", ""), 1)
+
+	expired, err := MintToken(&config.JWT, TokenParams{Roles: []string{"editor"}, ExpiresIn: -time.Minute})
+	require.NoError(t, err)
+	expiredReasons := reasons(expired, http.MethodGet, "", "")
+	require.Len(t, expiredReasons, 1)
+	assert.Contains(t, expiredReasons[0], "expired")
+
+	hs512, err := jwt.NewWithClaims(jwt.SigningMethodHS512, testClaims()).SignedString([]byte(config.JWT.Secret))
+	require.NoError(t, err)
+	algReasons := reasons(hs512, http.MethodGet, "", "")
+	require.Len(t, algReasons, 1)
+	assert.Contains(t, algReasons[0], "HS512")
+
+	other, err := MintToken(&conf.JWTConfiguration{Secret: "other", Audiences: []string{"site-a"}}, TokenParams{Roles: []string{"editor"}, ExpiresIn: time.Hour})
+	require.NoError(t, err)
+	assert.Len(t, reasons(other, http.MethodGet, "", ""), 1)
+
+	guest, err := MintToken(&config.JWT, TokenParams{Roles: []string{"guest"}, ExpiresIn: time.Hour})
+	require.NoError(t, err)
+	assert.Len(t, reasons(guest, http.MethodGet, "", ""), 1)
+
+	_, err = InspectToken(globalConfig, config, "not-a-token", http.MethodGet, "", "")
+	assert.Error(t, err)
+	_, err = MintToken(&conf.JWTConfiguration{}, TokenParams{ExpiresIn: time.Hour})
+	assert.Error(t, err)
+}
+
+func TestSignOperatorRequest(t *testing.T) {
+	api := &API{
+		config: &conf.GlobalConfiguration{
+			Operators: conf.OperatorCredentials{
+				{Name: "signer", Token: "signer-token", Scopes: []string{conf.OperatorScopeSigning}},
+				{Name: "admin", Token: "admin-token", Scopes: []string{conf.OperatorScopeInstanceAdmin}},
+			},
+			Signature: conf.SignatureConfig{BindRequest: true, ReplayProtection: true},
+		},
+		replay: newReplayCache(),
+	}
+	creds := api.config.OperatorCredentials()
+
+	signature, err := SignOperatorRequest(creds[0], SignatureParams{
+		InstanceID: "uuid-1",
+		Host:       "gateway.example.com",
+		Path:       "/github/contents/README.md",
+		ExpiresIn:  time.Minute,
+	})
+	require.NoError(t, err)
+
+	claims := &NetlifyMicroserviceClaims{}
+	name, err := api.verifySignature(signature, claims)
+	require.NoError(t, err)
+	assert.Equal(t, "signer", name)
+	assert.Equal(t, "uuid-1", claims.InstanceID)
+
+	req := httptest.NewRequest(http.MethodGet, "http://gateway.example.com/github/contents/README.md", nil)
+	require.NoError(t, api.checkSignatureClaims(req, claims))
+	assert.Error(t, api.checkSignatureClaims(req, claims), "signatures are single use")
+
+	_, err = SignOperatorRequest(creds[1], SignatureParams{InstanceID: "uuid-1", ExpiresIn: time.Minute})
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/netlify/git-gateway/api")
+
+// traceRequest starts the server span of a request, continuing the trace of
+// an incoming traceparent header. The span is named after the route once the
+// request is served, see spanName.
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetName(spanName(r))
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if id := getInstanceID(ctx); id != "" {
+			span.SetAttributes(attribute.String("instance_id", id))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// spanName names a server span after the endpoint group of gateway requests
+// and after the route pattern of the others, never after the raw path, so
+// the number of span names stays bounded.
+func spanName(r *http.Request) string {
+	path := r.URL.Path
+	var provider string
+	var endpoint endpointGroupFunc
+	switch {
+	case strings.HasPrefix(path, "/github/"):
+		provider, endpoint = "github", githubEndpointGroup
+	case strings.HasPrefix(path, "/gitlab/"):
+		provider, endpoint = "gitlab", gitlabEndpointGroup
+	case strings.HasPrefix(path, "/bitbucket/"):
+		provider, endpoint = "bitbucket", bitbucketEndpointGroup
+	}
+	if endpoint != nil {
+		return r.Method + " /" + provider + "/" + endpoint(path)
+	}
+
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || len(rctx.RoutePatterns) == 0 {
+		return r.Method
+	}
+	// mounted routers leave a "/*" between the patterns they join
+	pattern := strings.Replace(strings.Join(rctx.RoutePatterns, ""), "/*/", "/", -1)
+	return r.Method + " " + pattern
+}
+
+// traced records a middleware as a span of the request. The context handed
+// to the next handler keeps the request span as parent, so later spans
+// aren't nested under a finished middleware span.
+func traced(name string, fn middlewareHandler) middlewareHandler {
+	return func(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+		parent := trace.SpanFromContext(r.Context())
+		ctx, span := tracer.Start(r.Context(), name)
+		next, err := fn(w, r.WithContext(ctx))
+		endSpan(span, err)
+		if next == nil {
+			return nil, err
+		}
+		return trace.ContextWithSpan(next, parent), err
+	}
+}
+
+// tracedRoundTrip sends r upstream as a client span of the request and
+// propagates the trace context to the git provider. Baggage set by clients
+// isn't forwarded, it's only meant for our own services.
+func tracedRoundTrip(provider string, r *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(r.Context(), provider+" "+r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.URL.Host),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+
+	r.Header.Del("Baggage")
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(r.Header))
+	resp, err := http.DefaultTransport.RoundTrip(r.WithContext(ctx))
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	_, err := conf.ConfigureTracing(&conf.TracingConfig{})
+	require.NoError(t, err)
+
+	var upstreamHeaders http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = r.Header
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	config := &conf.Configuration{
+		JWT:    conf.JWTConfiguration{Secret: "secret"},
+		GitHub: conf.GitHubConfig{AccessToken: "token", Endpoint: upstream.URL, Repo: "owner/repo"},
+	}
+	ctx, err := WithInstanceConfig(context.Background(), config, "")
+	require.NoError(t, err)
+	api := NewAPIWithVersion(ctx, &conf.GlobalConfiguration{}, nil, "test")
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/github/contents/README.md", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	req.Header.Set(requestIDHeaderName, "client-request-1")
+	req.Header.Set("baggage", "user=secret")
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, "client-request-1", w.Header().Get(requestIDHeaderName))
+	require.NotNil(t, upstreamHeaders)
+	assert.Equal(t, "client-request-1", upstreamHeaders.Get(requestIDHeaderName))
+	assert.Contains(t, upstreamHeaders.Get("traceparent"), traceID)
+	assert.Empty(t, upstreamHeaders.Get("baggage"), "client baggage isn't forwarded upstream")
+
+	names := []string{}
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, traceID, span.SpanContext().TraceID().String())
+		names = append(names, span.Name())
+	}
+	assert.Contains(t, names, "addRequestID")
+	assert.Contains(t, names, "requireAuthentication")
+	assert.Contains(t, names, "github GET")
+	assert.Contains(t, names, "GET /github/contents")
+	assert.NotContains(t, names, "GET /github/contents/README.md")
+}
+
+func TestSpanName(t *testing.T) {
+	var name string
+	r := newRouter()
+	r.UseBypass(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req)
+			name = spanName(req)
+		})
+	})
+	ok := func(w http.ResponseWriter, r *http.Request) error { return nil }
+	r.Route("/instances", func(r *router) {
+		r.Get("/", ok)
+		r.Route("/{instance_id}", func(r *router) {
+			r.Get("/", ok)
+			r.Get("/audit", ok)
+		})
+	})
+	r.Mount("/github", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cases := map[string]string{
+		"/instances":                              "GET /instances/",
+		"/instances/d5f4e95d/":                    "GET /instances/{instance_id}/",
+		"/instances/d5f4e95d/audit":               "GET /instances/{instance_id}/audit",
+		"/github/contents/posts/2017-01-01-hi.md": "GET /github/contents",
+		"/github/pulls/12/merge":                  "GET /github/merges",
+		"/github/issues":                          "GET /github/other",
+		"/unknown/path":                           "GET",
+	}
+	for path, expected := range cases {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, expected, name, path)
+	}
+}
+
+func TestAddRequestID(t *testing.T) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestIDHeaderName, "bad id\n")
+	ctx, err := addRequestID(w, req)
+	require.NoError(t, err)
+	id := getRequestID(ctx)
+	assert.NotEqual(t, "bad id\n", id)
+	assert.Equal(t, id, w.Header().Get(requestIDHeaderName))
+}
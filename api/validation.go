@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/bitbucket"
+)
+
+const verifyTimeout = 10 * time.Second
+
+// validateInstance checks the configuration of the instance before it's
+// saved. With ?verify=true, the configured access tokens are also tried
+// against their repos.
+func (a *API) validateInstance(r *http.Request, i *models.Instance) error {
+	if i.BaseConfig == nil {
+		return unprocessableEntityError("Invalid instance configuration").
+			WithErrors(conf.ValidationErrors{{Field: "config", Message: "is required"}})
+	}
+	if err := i.BaseConfig.Validate(); err != nil {
+		return unprocessableEntityError("Invalid instance configuration").WithErrors(err)
+	}
+	if err := a.config.ValidateInstanceJWKS(&i.BaseConfig.JWT); err != nil {
+		return unprocessableEntityError("Invalid instance configuration").WithErrors(err)
+	}
+
+	if r.URL.Query().Get("verify") != "true" {
+		return nil
+	}
+	config, err := i.Config()
+	if err != nil {
+		return internalServerError("Error loading instance configuration").WithInternalError(err)
+	}
+	if errs := verifyConfig(r.Context(), config); len(errs) > 0 {
+		return unprocessableEntityError("Instance configuration failed verification").WithErrors(errs)
+	}
+	return nil
+}
+
+// verifyConfig makes a test call to every configured provider, checking
+// that the access token can see the repo.
+func verifyConfig(ctx context.Context, config *conf.Configuration) conf.ValidationErrors {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+
+	errs := conf.ValidationErrors{}
+	if config.GitHub.Repo != "" {
+		err := verifyRepo(ctx, "github", config.GitHub.Endpoint+"/repos/"+config.GitHub.Repo, func(h http.Header) {
+			h.Set("Authorization", "Bearer "+config.GitHub.AccessToken)
+		})
+		if err != nil {
+			errs = append(errs, conf.FieldError{Field: "github.repo", Message: err.Error()})
+		}
+	}
+
+	if config.GitLab.Repo != "" {
+		gitlab := config.GitLab
+		err := verifyRepo(ctx, "gitlab", gitlab.Endpoint+"/projects/"+url.PathEscape(gitlab.Repo), func(h http.Header) {
+			if gitlab.AccessTokenType == tokenTypePAT || strings.HasPrefix(gitlab.AccessToken, gitlabPATPrefix) {
+				h.Set("Private-Token", gitlab.AccessToken)
+			} else {
+				h.Set("Authorization", "Bearer "+gitlab.AccessToken)
+			}
+		})
+		if err != nil {
+			errs = append(errs, conf.FieldError{Field: "gitlab.repo", Message: err.Error()})
+		}
+	}
+
+	if config.BitBucket.Repo != "" {
+		bb := config.BitBucket
+		oauthConfig := &oauth2.Config{
+			ClientID:     bb.ClientID,
+			ClientSecret: bb.ClientSecret,
+			Endpoint:     bitbucket.Endpoint,
+		}
+		token, err := oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: bb.RefreshToken}).Token()
+		if err != nil {
+			errs = append(errs, conf.FieldError{Field: "bitbucket.refresh_token", Message: "can't obtain an access token"})
+		} else {
+			err = verifyRepo(ctx, "bitbucket", bb.Endpoint+"/repositories/"+bb.Repo, func(h http.Header) {
+				h.Set("Authorization", "Bearer "+token.AccessToken)
+			})
+			if err != nil {
+				errs = append(errs, conf.FieldError{Field: "bitbucket.repo", Message: err.Error()})
+			}
+		}
+	}
+	return errs
+}
+
+func verifyRepo(ctx context.Context, provider, endpoint string, authorize func(http.Header)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	authorize(req.Header)
+	if id := getRequestID(ctx); id != "" {
+		req.Header.Set(requestIDHeaderName, id)
+	}
+
+	resp, err := tracedRoundTrip(provider, req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed", provider)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("the access token was rejected by %s", provider)
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		return errors.New("the repo isn't visible with the access token")
+	default:
+		return fmt.Errorf("%s responded with %d", provider, resp.StatusCode)
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateInstance(t *testing.T) {
+	api := newOperatorAPI(t)
+
+	w := operatorRequest(t, api, http.MethodPost, "/instances", InstanceRequestParams{UUID: "uuid-1", BaseConfig: &conf.Configuration{
+		JWT:    testJWT,
+		GitHub: conf.GitHubConfig{Repo: "not-a-repo"},
+	}})
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	resp := struct {
+		Code   int               `json:"code"`
+		Errors []conf.FieldError `json:"errors"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Equal(t, []conf.FieldError{{Field: "github.repo", Message: `must be in the "owner/repo" format`}}, resp.Errors)
+
+	instance := createTestInstance(t, api, "uuid-1", &conf.Configuration{JWT: testJWT})
+	path := "/instances/" + instance.ID
+	w = operatorRequest(t, api, http.MethodPatch, path, map[string]interface{}{
+		"config": map[string]interface{}{"gitlab": map[string]interface{}{"access_token_type": "session"}},
+	})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	w = operatorRequest(t, api, http.MethodPut, path, InstanceRequestParams{BaseConfig: &conf.Configuration{GitHub: conf.GitHubConfig{Repo: "not-a-repo"}}})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+}
+
+func TestVerifyInstance(t *testing.T) {
+	api := newOperatorAPI(t)
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/owner/site" && r.Header.Get("Authorization") == "Bearer github-token":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.RawPath == "/projects/group%2Fsite" && r.Header.Get("Private-Token") == "glpat-token":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer provider.Close()
+
+	config := &conf.Configuration{
+		JWT:    testJWT,
+		GitHub: conf.GitHubConfig{Endpoint: provider.URL, AccessToken: "github-token", Repo: "owner/site"},
+		GitLab: conf.GitLabConfig{Endpoint: provider.URL, AccessToken: "glpat-token", Repo: "group/site"},
+	}
+	w := operatorRequest(t, api, http.MethodPost, "/instances?verify=true", InstanceRequestParams{UUID: "uuid-1", BaseConfig: config})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	config.GitHub.Repo = "owner/private"
+	w = operatorRequest(t, api, http.MethodPost, "/instances?verify=true", InstanceRequestParams{UUID: "uuid-2", BaseConfig: config})
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"field":"github.repo"`)
+	assert.NotContains(t, w.Body.String(), `"field":"gitlab.repo"`)
+
+	// without verify the configuration is only checked for its format
+	w = operatorRequest(t, api, http.MethodPost, "/instances", InstanceRequestParams{UUID: "uuid-2", BaseConfig: config})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+}
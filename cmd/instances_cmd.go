@@ -0,0 +1,484 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/netlify/git-gateway/storage/dial"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// cliChangedBy is recorded as the author of the revisions made from the
+// command line.
+const cliChangedBy = "cli"
+
+var (
+	instancesOutput      string
+	instancesShowSecrets bool
+	instancesFilter      models.InstanceFilter
+	instanceUUID         string
+	instancesExportFile  string
+
+	instancesAllowMissingSecrets bool
+)
+
+var instancesCmd = cobra.Command{
+	Use:   "instances",
+	Short: "Manage the instances of the multi-tenant server",
+	Long: "Manage the instances of the multi-tenant server directly in the database. " +
+		"Configuration files may be JSON or YAML. Secrets are redacted from the output unless --show-secrets is set.",
+}
+
+var instancesListCmd = cobra.Command{
+	Use:   "list",
+	Short: "List the instances",
+	Args:  cobra.NoArgs,
+	Run:   listInstances,
+}
+
+var instancesGetCmd = cobra.Command{
+	Use:   "get <id or uuid>",
+	Short: "Show an instance",
+	Args:  cobra.ExactArgs(1),
+	Run:   getInstance,
+}
+
+var instancesCreateCmd = cobra.Command{
+	Use:   "create <config file>",
+	Short: "Create an instance from a configuration file, - reading it from stdin",
+	Args:  cobra.ExactArgs(1),
+	Run:   createInstance,
+}
+
+var instancesUpdateCmd = cobra.Command{
+	Use:   "update <id or uuid> <config file>",
+	Short: "Replace the configuration of an instance, secrets included",
+	Args:  cobra.ExactArgs(2),
+	Run:   updateInstance,
+}
+
+var instancesDeleteCmd = cobra.Command{
+	Use:   "delete <id or uuid>",
+	Short: "Mark an instance deleted, it can be restored until purged",
+	Args:  cobra.ExactArgs(1),
+	Run:   deleteInstance,
+}
+
+var instancesExportCmd = cobra.Command{
+	Use:   "export",
+	Short: "Export every instance, deleted ones included. Set --show-secrets for a backup that can be fully restored",
+	Args:  cobra.NoArgs,
+	Run:   exportInstances,
+}
+
+var instancesImportCmd = cobra.Command{
+	Use:   "import <export file>",
+	Short: "Create or update the instances of an export. Secrets missing from it are kept from the existing instances",
+	Long: "Create or update the instances of an export. Secrets missing from it are kept from the existing instances, " +
+		"new instances are refused when they miss secrets unless --allow-missing-secrets is set. " +
+		"Every configuration is validated before anything is imported. Timestamps and versions aren't imported, " +
+		"new instances start at version 1 and existing ones get the next version.",
+	Args: cobra.ExactArgs(1),
+	Run:  importInstances,
+}
+
+func init() {
+	flags := instancesCmd.PersistentFlags()
+	flags.StringVarP(&instancesOutput, "output", "o", "json", "the output format, json or yaml")
+	flags.BoolVar(&instancesShowSecrets, "show-secrets", false, "include secrets in the output")
+
+	flags = instancesListCmd.Flags()
+	flags.StringVar(&instancesFilter.UUID, "uuid", "", "only list the instance with this Netlify UUID")
+	flags.StringVar(&instancesFilter.Provider, "provider", "", "only list instances configured for a git provider")
+	flags.StringVar(&instancesFilter.Repo, "repo", "", "only list instances proxying a repo")
+	flags.StringVar(&instancesFilter.State, "state", "", "only list instances in a state, deleted ones are only listed when asked for")
+
+	instancesCreateCmd.Flags().StringVar(&instanceUUID, "uuid", "", "the Netlify UUID of the instance")
+	instancesExportCmd.Flags().StringVarP(&instancesExportFile, "file", "f", "", "write the export to a file rather than stdout")
+	instancesImportCmd.Flags().BoolVar(&instancesAllowMissingSecrets, "allow-missing-secrets", false,
+		"create instances missing secrets, e.g. from an export made without --show-secrets")
+
+	instancesCmd.AddCommand(&instancesListCmd, &instancesGetCmd, &instancesCreateCmd, &instancesUpdateCmd,
+		&instancesDeleteCmd, &instancesExportCmd, &instancesImportCmd)
+}
+
+// instancesExport is the content of an export file.
+type instancesExport struct {
+	Instances []*models.Instance `json:"instances"`
+}
+
+func withInstances(fn func(db storage.Connection)) {
+	globalConfig, err := conf.LoadGlobal(configFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load configuration: %+v", err)
+	}
+	db, err := dial.Dial(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+	fn(db)
+}
+
+// findInstance looks an instance up by ID, and then by Netlify UUID.
+func findInstance(db storage.Connection, ref string) *models.Instance {
+	i, err := db.GetInstance(ref)
+	if models.IsNotFoundError(err) {
+		i, err = db.GetInstanceByUUID(ref)
+	}
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			logrus.Fatalf("Instance %s not found", ref)
+		}
+		logrus.Fatalf("Error loading instance: %+v", err)
+	}
+	return i
+}
+
+func recordCLIRevision(db storage.Connection, i *models.Instance) {
+	revision := &models.InstanceRevision{
+		ID:         uuid.NewRandom().String(),
+		InstanceID: i.ID,
+		BaseConfig: i.BaseConfig,
+		ChangedBy:  cliChangedBy,
+	}
+	if err := db.CreateInstanceRevision(revision); err != nil {
+		logrus.Fatalf("Error recording instance revision: %+v", err)
+	}
+}
+
+func listInstances(cmd *cobra.Command, args []string) {
+	withInstances(func(db storage.Connection) {
+		instances, err := db.FindInstances(&instancesFilter, nil, nil)
+		if err != nil {
+			logrus.Fatalf("Error loading instances: %+v", err)
+		}
+		writeOutput(os.Stdout, outputInstances(instances))
+	})
+}
+
+func getInstance(cmd *cobra.Command, args []string) {
+	withInstances(func(db storage.Connection) {
+		writeOutput(os.Stdout, outputInstance(findInstance(db, args[0])))
+	})
+}
+
+func createInstance(cmd *cobra.Command, args []string) {
+	config := readConfigFile(args[0])
+	withInstances(func(db storage.Connection) {
+		i := &models.Instance{
+			ID:         uuid.NewRandom().String(),
+			UUID:       instanceUUID,
+			BaseConfig: config,
+		}
+		if err := db.CreateInstance(i); err != nil {
+			if models.IsDuplicateUUIDError(err) {
+				logrus.Fatalf("An instance with UUID %s already exists", instanceUUID)
+			}
+			logrus.Fatalf("Error creating instance: %+v", err)
+		}
+		recordCLIRevision(db, i)
+		writeOutput(os.Stdout, outputInstance(i))
+	})
+}
+
+func updateInstance(cmd *cobra.Command, args []string) {
+	config := readConfigFile(args[1])
+	withInstances(func(db storage.Connection) {
+		i := findInstance(db, args[0])
+		if i.State == models.InstanceStateDeleted {
+			logrus.Fatalf("Instance %s has been deleted", i.ID)
+		}
+		i.BaseConfig = config
+		if err := db.UpdateInstance(i); err != nil {
+			if models.IsVersionConflictError(err) {
+				logrus.Fatalf("Instance %s has been modified concurrently", i.ID)
+			}
+			logrus.Fatalf("Error updating instance: %+v", err)
+		}
+		recordCLIRevision(db, i)
+		writeOutput(os.Stdout, outputInstance(i))
+	})
+}
+
+func deleteInstance(cmd *cobra.Command, args []string) {
+	withInstances(func(db storage.Connection) {
+		i := findInstance(db, args[0])
+		if i.State == models.InstanceStateDeleted {
+			logrus.Fatalf("Instance %s has already been deleted", i.ID)
+		}
+		if err := db.DeleteInstance(i); err != nil {
+			logrus.Fatalf("Error deleting instance: %+v", err)
+		}
+		logrus.Infof("Deleted instance %s", i.ID)
+	})
+}
+
+func exportInstances(cmd *cobra.Command, args []string) {
+	withInstances(func(db storage.Connection) {
+		export, err := exportAll(db)
+		if err != nil {
+			logrus.Fatalf("Error loading instances: %+v", err)
+		}
+
+		if instancesExportFile == "" {
+			writeOutput(os.Stdout, export)
+			return
+		}
+		// the export may hold secrets
+		f, err := os.OpenFile(instancesExportFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			logrus.Fatalf("Error writing export: %+v", err)
+		}
+		writeOutput(f, export)
+		if err := f.Close(); err != nil {
+			logrus.Fatalf("Error writing export: %+v", err)
+		}
+		logrus.Infof("Exported %d instances to %s", len(export.Instances), instancesExportFile)
+	})
+}
+
+// exportAll exports every instance, redacted unless --show-secrets is set.
+func exportAll(db storage.Connection) (*instancesExport, error) {
+	export := &instancesExport{Instances: []*models.Instance{}}
+	// deleted instances are only found by state
+	for _, state := range []string{models.InstanceStateActive, models.InstanceStateSuspended, models.InstanceStateDeleted} {
+		instances, err := db.FindInstances(&models.InstanceFilter{State: state}, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		export.Instances = append(export.Instances, outputInstances(instances)...)
+	}
+	return export, nil
+}
+
+func importInstances(cmd *cobra.Command, args []string) {
+	export := &instancesExport{}
+	if err := readFile(args[0], export); err != nil {
+		logrus.Fatalf("Error reading export: %+v", err)
+	}
+
+	withInstances(func(db storage.Connection) {
+		if err := importAll(db, export, instancesAllowMissingSecrets); err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Imported %d instances", len(export.Instances))
+	})
+}
+
+// importAll imports the instances of an export, once every one of them has
+// been checked, so an invalid export doesn't leave a partial import.
+func importAll(db storage.Connection, export *instancesExport, allowMissingSecrets bool) error {
+	// deleted instances go first, so they can't hold the UUIDs of the
+	// instances replacing them
+	sort.SliceStable(export.Instances, func(i, j int) bool {
+		return export.Instances[i].State == models.InstanceStateDeleted && export.Instances[j].State != models.InstanceStateDeleted
+	})
+
+	for _, imported := range export.Instances {
+		if imported.ID == "" || imported.BaseConfig == nil {
+			return errors.New("Every exported instance must have an id and a config")
+		}
+		if _, _, err := importedConfig(db, imported, allowMissingSecrets); err != nil {
+			return errors.Wrapf(err, "Error importing instance %s", imported.ID)
+		}
+	}
+	for _, imported := range export.Instances {
+		if err := importInstance(db, imported, allowMissingSecrets); err != nil {
+			return errors.Wrapf(err, "Error importing instance %s", imported.ID)
+		}
+		logrus.WithField("instance_id", imported.ID).Debug("Imported instance")
+	}
+	return nil
+}
+
+// importInstance creates the imported instance, or updates it when it
+// exists. The created_at, updated_at and version of the export are
+// discarded: they're reset by the import like by any other change.
+func importInstance(db storage.Connection, imported *models.Instance, allowMissingSecrets bool) error {
+	state := imported.State
+	if state == "" {
+		state = models.InstanceStateActive
+	}
+
+	i, config, err := importedConfig(db, imported, allowMissingSecrets)
+	if err != nil {
+		return err
+	}
+	if i == nil {
+		i = &models.Instance{ID: imported.ID, UUID: imported.UUID, BaseConfig: config}
+		if state == models.InstanceStateSuspended {
+			i.State = state
+		}
+		if err := db.CreateInstance(i); err != nil {
+			return err
+		}
+	} else {
+		i.UUID, i.BaseConfig = imported.UUID, config
+		if state != models.InstanceStateDeleted {
+			i.State, i.DeletedAt = state, nil
+		}
+		if err := db.UpdateInstance(i); err != nil {
+			return err
+		}
+	}
+	if err := db.CreateInstanceRevision(&models.InstanceRevision{
+		ID:         uuid.NewRandom().String(),
+		InstanceID: i.ID,
+		BaseConfig: i.BaseConfig,
+		ChangedBy:  cliChangedBy,
+	}); err != nil {
+		return err
+	}
+
+	if state == models.InstanceStateDeleted && i.State != models.InstanceStateDeleted {
+		return db.DeleteInstance(i)
+	}
+	return nil
+}
+
+// importedConfig returns the configuration an imported instance is stored
+// with, along with the instance it replaces, if any. Secrets missing from
+// the import are kept from the existing instance, a new instance may only
+// miss them when allowMissingSecrets is set.
+func importedConfig(db storage.Connection, imported *models.Instance, allowMissingSecrets bool) (*models.Instance, *conf.Configuration, error) {
+	i, err := db.GetInstance(imported.ID)
+	switch {
+	case models.IsNotFoundError(err):
+		i = nil
+	case err != nil:
+		return nil, nil, err
+	}
+
+	config := imported.BaseConfig
+	if i != nil {
+		if config, err = config.KeepSecrets(i.BaseConfig); err != nil {
+			return nil, nil, err
+		}
+	} else if missing := missingSecrets(config); len(missing) > 0 && !allowMissingSecrets {
+		return nil, nil, fmt.Errorf("new instance misses %s, export with --show-secrets or import with --allow-missing-secrets",
+			strings.Join(missing, ", "))
+	}
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return i, config, nil
+}
+
+// missingSecrets lists the secrets the configuration needs but leaves empty,
+// as a redacted export does.
+func missingSecrets(config *conf.Configuration) []string {
+	missing := []string{}
+	if config.JWT.Secret == "" && config.JWT.JWKSSource() == "" {
+		missing = append(missing, "jwt.secret")
+	}
+	if config.GitHub.Repo != "" && config.GitHub.AccessToken == "" {
+		missing = append(missing, "github.access_token")
+	}
+	if config.GitLab.Repo != "" && config.GitLab.AccessToken == "" {
+		missing = append(missing, "gitlab.access_token")
+	}
+	if config.BitBucket.Repo != "" && config.BitBucket.RefreshToken == "" {
+		missing = append(missing, "bitbucket.refresh_token")
+	}
+	return missing
+}
+
+func outputInstance(i *models.Instance) *models.Instance {
+	if instancesShowSecrets {
+		return i
+	}
+	redacted := *i
+	redacted.BaseConfig = i.BaseConfig.Redacted()
+	return &redacted
+}
+
+func outputInstances(instances []*models.Instance) []*models.Instance {
+	out := make([]*models.Instance, len(instances))
+	for n, i := range instances {
+		out[n] = outputInstance(i)
+	}
+	return out
+}
+
+// writeOutput writes v as JSON or YAML. YAML is converted from the JSON
+// encoding so both use the same field names.
+func writeOutput(w io.Writer, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logrus.Fatalf("Error encoding output: %+v", err)
+	}
+	switch instancesOutput {
+	case "json":
+		data = append(data, '\n')
+	case "yaml":
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			logrus.Fatalf("Error encoding output: %+v", err)
+		}
+		if data, err = yaml.Marshal(doc); err != nil {
+			logrus.Fatalf("Error encoding output: %+v", err)
+		}
+	default:
+		logrus.Fatalf("Unknown output format %q, use json or yaml", instancesOutput)
+	}
+	if _, err := w.Write(data); err != nil {
+		logrus.Fatalf("Error writing output: %+v", err)
+	}
+}
+
+// readConfigFile reads an instance configuration and validates it.
+func readConfigFile(path string) *conf.Configuration {
+	config := &conf.Configuration{}
+	if err := readFile(path, config); err != nil {
+		logrus.Fatalf("Error reading configuration: %+v", err)
+	}
+	if err := config.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+	return config
+}
+
+// readFile decodes a JSON or YAML file into v, - reading stdin. YAML being
+// a superset of JSON, both are read as YAML and decoded through JSON, so
+// they use the same field names.
+func readFile(path string, v interface{}) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("decoding %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/netlify/git-gateway/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testInstanceConfig(repo, token string) *conf.Configuration {
+	return &conf.Configuration{
+		JWT:    conf.JWTConfiguration{Secret: "jwt-" + token},
+		GitHub: conf.GitHubConfig{AccessToken: token, Repo: repo},
+	}
+}
+
+// roundTrip exports the instances of db and reads the export back the way
+// `instances import` does.
+func roundTrip(t *testing.T, db storage.Connection, showSecrets bool) *instancesExport {
+	defer func(show bool) { instancesShowSecrets = show }(instancesShowSecrets)
+	instancesShowSecrets = showSecrets
+
+	export, err := exportAll(db)
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	writeOutput(out, export)
+
+	dir, err := ioutil.TempDir("", "git-gateway-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.json")
+	require.NoError(t, ioutil.WriteFile(path, out.Bytes(), 0600))
+
+	imported := &instancesExport{}
+	require.NoError(t, readFile(path, imported))
+	return imported
+}
+
+func TestImportExportWithSecrets(t *testing.T) {
+	source := memory.New()
+	active := &models.Instance{ID: "active", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/active", "token-1")}
+	suspended := &models.Instance{ID: "suspended", UUID: "uuid-2", BaseConfig: testInstanceConfig("owner/suspended", "token-2"),
+		State: models.InstanceStateSuspended}
+	deleted := &models.Instance{ID: "deleted", UUID: "uuid-3", BaseConfig: testInstanceConfig("owner/deleted", "token-3")}
+	for _, i := range []*models.Instance{active, suspended, deleted} {
+		require.NoError(t, source.CreateInstance(i))
+	}
+	require.NoError(t, source.DeleteInstance(deleted))
+
+	export := roundTrip(t, source, true)
+	require.Len(t, export.Instances, 3)
+
+	target := memory.New()
+	require.NoError(t, importAll(target, export, false))
+	for _, expected := range []*models.Instance{active, suspended, deleted} {
+		i, err := target.GetInstance(expected.ID)
+		require.NoError(t, err)
+		assert.Equal(t, expected.UUID, i.UUID)
+		assert.Equal(t, expected.State, i.State, expected.ID)
+		assert.Equal(t, expected.BaseConfig, i.BaseConfig, expected.ID)
+
+		revisions, err := target.FindInstanceRevisions(i.ID, nil)
+		require.NoError(t, err)
+		assert.Len(t, revisions, 1, "imports are recorded as revisions")
+	}
+	deletedCopy, err := target.GetInstance("deleted")
+	require.NoError(t, err)
+	assert.NotNil(t, deletedCopy.DeletedAt)
+
+	// importing again updates the instances
+	require.NoError(t, importAll(target, roundTrip(t, source, true), false))
+	i, err := target.GetInstance("active")
+	require.NoError(t, err)
+	assert.Equal(t, 2, i.Version)
+}
+
+func TestImportRedactedKeepsSecrets(t *testing.T) {
+	db := memory.New()
+	i := &models.Instance{ID: "active", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/site", "token-1")}
+	require.NoError(t, db.CreateInstance(i))
+	suspended := &models.Instance{ID: "suspended", UUID: "uuid-2", BaseConfig: testInstanceConfig("owner/other", "token-2")}
+	require.NoError(t, db.CreateInstance(suspended))
+
+	export := roundTrip(t, db, false)
+	for _, exported := range export.Instances {
+		assert.Empty(t, exported.BaseConfig.GitHub.AccessToken, "exports are redacted by default")
+		assert.Empty(t, exported.BaseConfig.JWT.Secret)
+		if exported.ID == "active" {
+			exported.BaseConfig.GitHub.Repo = "owner/renamed"
+		} else {
+			exported.State = models.InstanceStateSuspended
+		}
+	}
+	require.NoError(t, importAll(db, export, false))
+
+	imported, err := db.GetInstance("active")
+	require.NoError(t, err)
+	assert.Equal(t, "owner/renamed", imported.BaseConfig.GitHub.Repo)
+	assert.Equal(t, "token-1", imported.BaseConfig.GitHub.AccessToken)
+	assert.Equal(t, "jwt-token-1", imported.BaseConfig.JWT.Secret)
+
+	imported, err = db.GetInstance("suspended")
+	require.NoError(t, err)
+	assert.Equal(t, models.InstanceStateSuspended, imported.State)
+	assert.Equal(t, "token-2", imported.BaseConfig.GitHub.AccessToken)
+}
+
+func TestImportDeletedStates(t *testing.T) {
+	db := memory.New()
+	restored := &models.Instance{ID: "restored", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/restored", "token-1")}
+	removed := &models.Instance{ID: "removed", UUID: "uuid-2", BaseConfig: testInstanceConfig("owner/removed", "token-2")}
+	require.NoError(t, db.CreateInstance(restored))
+	require.NoError(t, db.CreateInstance(removed))
+	require.NoError(t, db.DeleteInstance(restored))
+
+	export := &instancesExport{Instances: []*models.Instance{
+		{ID: "restored", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/restored", "token-1"), State: models.InstanceStateActive},
+		{ID: "removed", UUID: "uuid-2", BaseConfig: testInstanceConfig("owner/removed", "token-2"), State: models.InstanceStateDeleted},
+	}}
+	require.NoError(t, importAll(db, export, false))
+
+	i, err := db.GetInstance("restored")
+	require.NoError(t, err)
+	assert.Equal(t, models.InstanceStateActive, i.State)
+	assert.Nil(t, i.DeletedAt)
+	i, err = db.GetInstance("removed")
+	require.NoError(t, err)
+	assert.Equal(t, models.InstanceStateDeleted, i.State)
+	assert.NotNil(t, i.DeletedAt)
+}
+
+func TestImportUUIDOrdering(t *testing.T) {
+	db := memory.New()
+	old := &models.Instance{ID: "old", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/old", "token-1")}
+	require.NoError(t, db.CreateInstance(old))
+
+	// the replacement is listed first, the old instance has to be deleted
+	// before it takes the UUID
+	export := &instancesExport{Instances: []*models.Instance{
+		{ID: "new", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/new", "token-2")},
+		{ID: "old", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/old", "token-1"), State: models.InstanceStateDeleted},
+	}}
+	require.NoError(t, importAll(db, export, false))
+
+	i, err := db.GetInstanceByUUID("uuid-1")
+	require.NoError(t, err)
+	assert.Equal(t, "new", i.ID)
+	i, err = db.GetInstance("old")
+	require.NoError(t, err)
+	assert.Equal(t, models.InstanceStateDeleted, i.State)
+}
+
+func TestImportChecksConfigs(t *testing.T) {
+	db := memory.New()
+
+	// a redacted export can't create instances
+	redacted := &instancesExport{Instances: []*models.Instance{
+		{ID: "valid", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/valid", "token-1")},
+		{ID: "redacted", UUID: "uuid-2", BaseConfig: testInstanceConfig("owner/redacted", "token-2").Redacted()},
+	}}
+	err := importAll(db, redacted, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "jwt.secret, github.access_token")
+	_, err = db.GetInstance("valid")
+	assert.True(t, models.IsNotFoundError(err), "nothing is imported when an instance is refused")
+
+	// unless asked for, as long as the instance can verify tokens
+	noJWT := &instancesExport{Instances: []*models.Instance{
+		{ID: "redacted", UUID: "uuid-2", BaseConfig: testInstanceConfig("owner/redacted", "token-2").Redacted()},
+	}}
+	assert.Error(t, importAll(db, noJWT, true))
+	jwks := testInstanceConfig("owner/redacted", "token-2").Redacted()
+	jwks.JWT.JWKSURL = "https://identity.example.com/.well-known/jwks.json"
+	require.NoError(t, importAll(db, &instancesExport{Instances: []*models.Instance{{ID: "redacted", UUID: "uuid-2", BaseConfig: jwks}}}, true))
+	i, err := db.GetInstance("redacted")
+	require.NoError(t, err)
+	assert.Empty(t, i.BaseConfig.GitHub.AccessToken)
+
+	// invalid configs are refused
+	invalid := &instancesExport{Instances: []*models.Instance{
+		{ID: "invalid", UUID: "uuid-3", BaseConfig: testInstanceConfig("not-a-repo", "token-3")},
+	}}
+	err = importAll(db, invalid, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "github.repo")
+	_, err = db.GetInstance("invalid")
+	assert.True(t, models.IsNotFoundError(err))
+}
+
+func TestImportResetsTimestamps(t *testing.T) {
+	db := memory.New()
+	existing := &models.Instance{ID: "existing", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/existing", "token-1")}
+	require.NoError(t, db.CreateInstance(existing))
+
+	long := time.Now().Add(-24 * time.Hour)
+	export := &instancesExport{Instances: []*models.Instance{
+		{ID: "existing", UUID: "uuid-1", BaseConfig: testInstanceConfig("owner/existing", "token-1"), Version: 9, CreatedAt: long, UpdatedAt: long},
+		{ID: "new", UUID: "uuid-2", BaseConfig: testInstanceConfig("owner/new", "token-2"), Version: 9, CreatedAt: long, UpdatedAt: long},
+	}}
+	require.NoError(t, importAll(db, export, false))
+
+	i, err := db.GetInstance("existing")
+	require.NoError(t, err)
+	assert.Equal(t, 2, i.Version)
+	assert.Equal(t, existing.CreatedAt.Unix(), i.CreatedAt.Unix())
+	i, err = db.GetInstance("new")
+	require.NoError(t, err)
+	assert.Equal(t, 1, i.Version)
+	assert.True(t, i.CreatedAt.After(long.Add(time.Hour)), "created_at is the time of the import")
+}
@@ -1,7 +1,14 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
 	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/storage"
 	"github.com/netlify/git-gateway/storage/dial"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -9,25 +16,130 @@ import (
 
 var migrateCmd = cobra.Command{
 	Use:  "migrate",
-	Long: "Migrate database structures. This will create new tables and add missing columns and indexes.",
-	Run: func(cmd *cobra.Command, args []string) {
-		execWithConfig(cmd, migrate)
-	},
+	Long: "Migrate database structures. Without a subcommand, this applies every pending migration.",
+	Run:  migrateUp,
+}
+
+var migrateUpCmd = cobra.Command{
+	Use:   "up",
+	Short: "Apply every pending migration",
+	Args:  cobra.NoArgs,
+	Run:   migrateUp,
+}
+
+var migrateDownCmd = cobra.Command{
+	Use:   "down",
+	Short: "Revert the latest applied migration",
+	Args:  cobra.NoArgs,
+	Run:   migrateDown,
+}
+
+var migrateStatusCmd = cobra.Command{
+	Use:   "status",
+	Short: "List the migrations and whether they were applied",
+	Args:  cobra.NoArgs,
+	Run:   migrateStatus,
+}
+
+var migrateToCmd = cobra.Command{
+	Use:   "to <version>",
+	Short: "Apply or revert migrations until the schema is at a version, 0 reverting them all",
+	Args:  cobra.ExactArgs(1),
+	Run:   migrateTo,
 }
 
-func migrate(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
+func init() {
+	migrateCmd.AddCommand(&migrateUpCmd, &migrateDownCmd, &migrateStatusCmd, &migrateToCmd)
+}
+
+// withMigrator runs fn with the migrator of the configured database.
+func withMigrator(fn func(m storage.Migrator)) {
+	globalConfig, err := conf.LoadGlobal(configFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load configuration: %+v", err)
+	}
+	// the schema must be left as it is until asked
+	globalConfig.DB.Automigrate = false
+
 	db, err := dial.Dial(globalConfig)
 	if err != nil {
 		logrus.Fatalf("Error opening database: %+v", err)
 	}
-
 	defer db.Close()
 
-	err = db.Automigrate()
-	if err != nil {
-		logrus.Fatalf("Error automigrating database: %+v", err)
+	m, ok := storage.AsMigrator(db)
+	if !ok {
+		logrus.Fatalf("The %s storage has no schema to migrate", globalConfig.DB.Driver)
 	}
+	fn(m)
+}
+
+func migrateUp(cmd *cobra.Command, args []string) {
+	withMigrator(func(m storage.Migrator) {
+		migrations, err := m.Migrations()
+		if err != nil {
+			logrus.Fatalf("Error loading migrations: %+v", err)
+		}
+		latest := migrations[len(migrations)-1].Version
+		if err := m.MigrateTo(latest); err != nil {
+			logrus.Fatalf("Error migrating database: %+v", err)
+		}
+		logrus.Infof("Database is at version %d", latest)
+	})
+}
+
+func migrateDown(cmd *cobra.Command, args []string) {
+	withMigrator(func(m storage.Migrator) {
+		migrations, err := m.Migrations()
+		if err != nil {
+			logrus.Fatalf("Error loading migrations: %+v", err)
+		}
+		applied := []int{0}
+		for _, migration := range migrations {
+			if migration.AppliedAt != nil {
+				applied = append(applied, migration.Version)
+			}
+		}
+		if len(applied) == 1 {
+			logrus.Info("No migration to revert")
+			return
+		}
+		version := applied[len(applied)-2]
+		if err := m.MigrateTo(version); err != nil {
+			logrus.Fatalf("Error migrating database: %+v", err)
+		}
+		logrus.Infof("Database is at version %d", version)
+	})
+}
 
-	logrus.Info("Automigration successful")
+func migrateTo(cmd *cobra.Command, args []string) {
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		logrus.Fatalf("Invalid version %q", args[0])
+	}
+	withMigrator(func(m storage.Migrator) {
+		if err := m.MigrateTo(version); err != nil {
+			logrus.Fatalf("Error migrating database: %+v", err)
+		}
+		logrus.Infof("Database is at version %d", version)
+	})
+}
 
+func migrateStatus(cmd *cobra.Command, args []string) {
+	withMigrator(func(m storage.Migrator) {
+		migrations, err := m.Migrations()
+		if err != nil {
+			logrus.Fatalf("Error loading migrations: %+v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, migration := range migrations {
+			applied := "pending"
+			if migration.AppliedAt != nil {
+				applied = migration.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", migration.Version, migration.Name, applied)
+		}
+		w.Flush()
+	})
 }
@@ -24,10 +24,16 @@ func multi(cmd *cobra.Command, args []string) {
 	if err != nil {
 		logrus.Fatalf("Failed to load configuration: %+v", err)
 	}
-	if globalConfig.OperatorToken == "" {
-		logrus.Fatal("Operator token secret is required")
+	if len(globalConfig.OperatorCredentials()) == 0 {
+		logrus.Fatal("An operator token or operator credentials are required")
 	}
 
+	shutdownTracing, err := conf.ConfigureTracing(&globalConfig.Tracing)
+	if err != nil {
+		logrus.Fatalf("Error configuring tracing: %+v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	var db storage.Connection
 	// try a couple times to connect to the database
 	for i := 1; i <= 3; i++ {
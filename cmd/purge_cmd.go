@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/storage/dial"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const defaultPurgeRetention = 30 * 24 * time.Hour
+
+var purgeRetention time.Duration
+
+var purgeCmd = cobra.Command{
+	Use:  "purge",
+	Long: "Permanently remove instances that were deleted longer ago than the retention period, along with their revisions.",
+	Run:  purge,
+}
+
+func init() {
+	purgeCmd.Flags().DurationVar(&purgeRetention, "retention", defaultPurgeRetention, "how long deleted instances are kept")
+}
+
+func purge(cmd *cobra.Command, args []string) {
+	globalConfig, err := conf.LoadGlobal(configFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load configuration: %+v", err)
+	}
+
+	db, err := dial.Dial(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	deletedBefore := time.Now().Add(-purgeRetention)
+	count, err := db.PurgeInstances(deletedBefore)
+	if err != nil {
+		logrus.Fatalf("Error purging instances: %+v", err)
+	}
+
+	logrus.Infof("Purged %d instances deleted before %s", count, deletedBefore.Format(time.RFC3339))
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/netlify/git-gateway/storage/dial"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const rekeyBatchSize = 100
+
+var rekeyCmd = cobra.Command{
+	Use:  "rekey",
+	Long: "Re-encrypt the secrets of every instance and instance revision with the active encryption key. Versions and ETags are left unchanged.",
+	Run:  rekey,
+}
+
+func rekey(cmd *cobra.Command, args []string) {
+	globalConfig, err := conf.LoadGlobal(configFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load configuration: %+v", err)
+	}
+
+	db, err := dial.Dial(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	if models.Encryption == nil {
+		logrus.Fatal("No encryption key is configured")
+	}
+	keyID := models.Encryption.ActiveKeyID()
+
+	instances, revisions, err := rekeyInstances(db)
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+	logrus.Infof("Re-encrypted %d instances and %d revisions with key %s", instances, revisions, keyID)
+}
+
+// rekeyInstances saves every instance and its revisions again, so their
+// data keys are encrypted with the active key. Instance versions are kept, so
+// operators don't see their ETags change.
+func rekeyInstances(db storage.Connection) (instances, revisions int, err error) {
+	// deleted instances are only found by state, and may still be restored
+	for _, state := range []string{models.InstanceStateActive, models.InstanceStateSuspended, models.InstanceStateDeleted} {
+		filter := &models.InstanceFilter{State: state}
+		pagination := &models.Pagination{Page: 1, PerPage: rekeyBatchSize}
+		for {
+			batch, err := db.FindInstances(filter, nil, pagination)
+			if err != nil {
+				return instances, revisions, errors.Wrap(err, "Error loading instances")
+			}
+			for _, instance := range batch {
+				log := logrus.WithFields(logrus.Fields{"instance_id": instance.ID, "old_key_id": instance.KeyID()})
+				if err := rekeyInstance(db, instance); err != nil {
+					return instances, revisions, errors.Wrapf(err, "Error re-encrypting instance %s", instance.ID)
+				}
+				n, err := rekeyRevisions(db, instance.ID)
+				revisions += n
+				if err != nil {
+					return instances, revisions, err
+				}
+				log.WithField("revisions", n).Debug("Re-encrypted instance")
+				instances++
+			}
+			if uint64(len(batch)) < rekeyBatchSize {
+				break
+			}
+			pagination.Page++
+		}
+	}
+	return instances, revisions, nil
+}
+
+// rekeyInstance re-encrypts an instance, reloading it when it was updated
+// since it was read.
+func rekeyInstance(db storage.Connection, instance *models.Instance) error {
+	for {
+		err := db.RekeyInstance(instance)
+		if _, ok := err.(models.InstanceVersionConflictError); !ok {
+			return err
+		}
+		if instance, err = db.GetInstance(instance.ID); err != nil {
+			return err
+		}
+	}
+}
+
+// rekeyRevisions saves every revision of an instance again. Revisions aren't
+// renumbered, so paging through them while saving is safe.
+func rekeyRevisions(db storage.Connection, instanceID string) (int, error) {
+	count := 0
+	pagination := &models.Pagination{Page: 1, PerPage: rekeyBatchSize}
+	for {
+		batch, err := db.FindInstanceRevisions(instanceID, pagination)
+		if err != nil {
+			return count, errors.Wrapf(err, "Error loading revisions of instance %s", instanceID)
+		}
+		for _, revision := range batch {
+			if err := db.UpdateInstanceRevision(revision); err != nil {
+				return count, errors.Wrapf(err, "Error re-encrypting revision %d of instance %s", revision.Revision, instanceID)
+			}
+			count++
+		}
+		if uint64(len(batch)) < rekeyBatchSize {
+			return count, nil
+		}
+		pagination.Page++
+	}
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage/memory"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, active string, ids ...string) *models.Keyring {
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id[:1]), conf.MasterKeySize)
+	}
+	k, err := models.NewKeyring(keys, active)
+	require.NoError(t, err)
+	return k
+}
+
+func TestRekeyInstances(t *testing.T) {
+	defer func() { models.Encryption = nil }()
+	models.Encryption = testKeyring(t, "old", "old")
+
+	db := memory.New()
+	i := &models.Instance{ID: uuid.NewRandom().String(), UUID: "uuid-1", BaseConfig: &conf.Configuration{
+		GitHub: conf.GitHubConfig{AccessToken: "token-1", Repo: "owner/repo"},
+	}}
+	require.NoError(t, db.CreateInstance(i))
+	for _, token := range []string{"token-1", "token-2"} {
+		i.BaseConfig.GitHub.AccessToken = token
+		require.NoError(t, db.CreateInstanceRevision(&models.InstanceRevision{
+			ID:         uuid.NewRandom().String(),
+			InstanceID: i.ID,
+			BaseConfig: i.BaseConfig,
+		}))
+	}
+	deleted := &models.Instance{ID: uuid.NewRandom().String(), UUID: "uuid-2", BaseConfig: &conf.Configuration{}}
+	require.NoError(t, db.CreateInstance(deleted))
+	require.NoError(t, db.DeleteInstance(deleted))
+
+	models.Encryption = testKeyring(t, "new", "old", "new")
+	instances, revisions, err := rekeyInstances(db)
+	require.NoError(t, err)
+	assert.Equal(t, 2, instances)
+	assert.Equal(t, 2, revisions)
+
+	// once the old key is dropped, old revisions can still be restored
+	models.Encryption = testKeyring(t, "new", "new")
+	stored, err := db.GetInstance(i.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "new", stored.KeyID())
+	assert.Equal(t, i.Version, stored.Version, "rekeying keeps the ETag")
+	first, err := db.GetInstanceRevision(i.ID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", first.BaseConfig.GitHub.AccessToken)
+
+	stored.BaseConfig = first.BaseConfig
+	require.NoError(t, db.UpdateInstance(stored))
+	restored, err := db.GetInstance(i.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", restored.BaseConfig.GitHub.AccessToken)
+}
@@ -18,7 +18,7 @@ var rootCmd = cobra.Command{
 
 // RootCommand will setup and return the root command
 func RootCommand() *cobra.Command {
-	rootCmd.AddCommand(&serveCmd, &migrateCmd, &multiCmd, &versionCmd)
+	rootCmd.AddCommand(&serveCmd, &migrateCmd, &multiCmd, &instancesCmd, &rekeyCmd, &purgeCmd, &tokenCmd, &versionCmd)
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "the config file to use")
 
 	return &rootCmd
@@ -20,6 +20,20 @@ var serveCmd = cobra.Command{
 }
 
 func serve(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
+	shutdownTracing, err := conf.ConfigureTracing(&globalConfig.Tracing)
+	if err != nil {
+		logrus.Fatalf("Error configuring tracing: %+v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// a single instance never reads instances from the database
+	if globalConfig.DB.Driver == "" && globalConfig.DB.URL == "" {
+		logrus.Info("No database configured, using in-memory storage")
+		globalConfig.DB.Driver = "memory"
+	}
+	if globalConfig.DB.Driver == "memory" {
+		logrus.Warn("Audit entries are kept in memory and lost on restart, configure a database to keep them")
+	}
 	db, err := dial.Dial(globalConfig)
 	if err != nil {
 		logrus.Fatalf("Error opening database: %+v", err)
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/netlify/git-gateway/api"
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	tokenInstance  string
+	tokenParams    = api.TokenParams{}
+	tokenInspect   = struct{ method, path, audience string }{}
+	tokenSignature = api.SignatureParams{}
+	tokenOperator  string
+)
+
+var tokenCmd = cobra.Command{
+	Use:   "token",
+	Short: "Mint and inspect tokens to test the gateway with",
+	Long: "Mint and inspect user tokens with the JWT configuration, by default the one loaded from the " +
+		"environment, or the one of an instance with --instance, and mint operator signatures for instances.",
+}
+
+var tokenMintCmd = cobra.Command{
+	Use:   "mint",
+	Short: "Mint an HS256 user token signed with the JWT secret",
+	Args:  cobra.NoArgs,
+	Run:   mintToken,
+}
+
+var tokenInspectCmd = cobra.Command{
+	Use:   "inspect <jwt>",
+	Short: "Explain whether the gateway accepts a user token, exiting with an error when it doesn't",
+	Args:  cobra.ExactArgs(1),
+	Run:   inspectToken,
+}
+
+var tokenSignCmd = cobra.Command{
+	Use:   "sign <id or uuid>",
+	Short: "Mint an x-nf-sign operator signature for an instance",
+	Args:  cobra.ExactArgs(1),
+	Run:   signToken,
+}
+
+func init() {
+	tokenCmd.PersistentFlags().StringVar(&tokenInstance, "instance", "", "use the JWT configuration of the instance with this ID or UUID")
+
+	flags := tokenMintCmd.Flags()
+	flags.StringVar(&tokenParams.Email, "email", "", "the email claim")
+	flags.StringVar(&tokenParams.Subject, "sub", "", "the sub claim")
+	flags.StringSliceVar(&tokenParams.Roles, "roles", nil, "the roles stored in app_metadata")
+	flags.StringVar(&tokenParams.Audience, "aud", "", "the aud claim, by default the first configured audience")
+	flags.DurationVar(&tokenParams.ExpiresIn, "exp", time.Hour, "how long the token is valid")
+
+	flags = tokenInspectCmd.Flags()
+	flags.StringVar(&tokenInspect.method, "method", http.MethodGet, "the method of the request")
+	flags.StringVar(&tokenInspect.path, "path", "", "the gateway path of the request, e.g. /github/contents/README.md, checked against the permissions")
+	flags.StringVar(&tokenInspect.audience, "aud", "", "the audience requested with the X-JWT-AUD header")
+
+	flags = tokenSignCmd.Flags()
+	flags.StringVar(&tokenOperator, "operator", "", "the name of the signing credential, by default the first active one")
+	flags.StringVar(&tokenSignature.Host, "host", "", "the host of the request the signature is bound to")
+	flags.StringVar(&tokenSignature.Path, "path", "", "the path of the request the signature is bound to")
+	flags.StringVar(&tokenSignature.SiteURL, "site-url", "", "the site_url claim")
+	flags.DurationVar(&tokenSignature.ExpiresIn, "exp", time.Minute, "how long the signature is valid")
+
+	tokenCmd.AddCommand(&tokenMintCmd, &tokenInspectCmd, &tokenSignCmd)
+}
+
+// withTokenConfig loads the configuration tokens are checked against.
+func withTokenConfig(cmd *cobra.Command, fn func(globalConfig *conf.GlobalConfiguration, config *conf.Configuration)) {
+	if tokenInstance == "" {
+		execWithConfig(cmd, fn)
+		return
+	}
+	withInstances(func(db storage.Connection) {
+		config, err := findInstance(db, tokenInstance).Config()
+		if err != nil {
+			logrus.Fatalf("Error loading instance config: %+v", err)
+		}
+		globalConfig, err := conf.LoadGlobal(configFile)
+		if err != nil {
+			logrus.Fatalf("Failed to load configuration: %+v", err)
+		}
+		fn(globalConfig, config)
+	})
+}
+
+func mintToken(cmd *cobra.Command, args []string) {
+	withTokenConfig(cmd, func(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
+		token, err := api.MintToken(&config.JWT, tokenParams)
+		if err != nil {
+			logrus.Fatalf("Error minting token: %v", err)
+		}
+		fmt.Println(token)
+	})
+}
+
+func inspectToken(cmd *cobra.Command, args []string) {
+	withTokenConfig(cmd, func(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
+		inspection, err := api.InspectToken(globalConfig, config, args[0], tokenInspect.method, tokenInspect.path, tokenInspect.audience)
+		if err != nil {
+			logrus.Fatalf("Error inspecting token: %v", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(inspection); err != nil {
+			logrus.Fatalf("Error writing output: %+v", err)
+		}
+		if !inspection.Accepted {
+			os.Exit(1)
+		}
+	})
+}
+
+func signToken(cmd *cobra.Command, args []string) {
+	withInstances(func(db storage.Connection) {
+		globalConfig, err := conf.LoadGlobal(configFile)
+		if err != nil {
+			logrus.Fatalf("Failed to load configuration: %+v", err)
+		}
+		maxAge := globalConfig.Signature.MaxAge
+		if maxAge <= 0 {
+			maxAge = conf.DefaultSignatureMaxAge
+		}
+		if tokenSignature.ExpiresIn > maxAge {
+			logrus.Fatalf("Signatures are valid at most %v", maxAge)
+		}
+		if globalConfig.Signature.BindRequest && (tokenSignature.Host == "" || tokenSignature.Path == "") {
+			logrus.Fatal("Signatures are bound to requests, --host and --path are required")
+		}
+
+		credential := signingCredential(globalConfig)
+		i := findInstance(db, args[0])
+		params := tokenSignature
+		params.InstanceID = i.ID
+		params.NetlifyID = i.UUID
+		signature, err := api.SignOperatorRequest(credential, params)
+		if err != nil {
+			logrus.Fatalf("Error signing: %v", err)
+		}
+		fmt.Println(signature)
+	})
+}
+
+// signingCredential picks the operator credential named by --operator, or
+// the first active one with the signing scope.
+func signingCredential(globalConfig *conf.GlobalConfiguration) conf.OperatorCredential {
+	now := time.Now()
+	for _, c := range globalConfig.OperatorCredentials() {
+		if tokenOperator == "" {
+			if c.HasScope(conf.OperatorScopeSigning) && c.Active(now) {
+				return c
+			}
+			continue
+		}
+		if c.Name == tokenOperator {
+			if !c.Active(now) {
+				logrus.Fatalf("Operator credential %s expired at %v", c.Name, c.ExpiresAt)
+			}
+			return c
+		}
+	}
+	if tokenOperator != "" {
+		logrus.Fatalf("Operator credential %s not found", tokenOperator)
+	}
+	logrus.Fatal("No operator credential with the signing scope is configured")
+	return conf.OperatorCredential{}
+}
@@ -0,0 +1,41 @@
+package conf
+
+import "encoding/json"
+
+// BranchRule allows roles to create, update or delete the branches matching
+// Pattern. Patterns use the same globs as path rules, e.g. "cms/**".
+type BranchRule struct {
+	Pattern string   `json:"pattern"`
+	Roles   []string `json:"roles"`
+}
+
+// BranchRules is an ordered list of rules. The first rule matching a branch
+// decides who may write it, branches without a matching rule can't be written.
+type BranchRules []BranchRule
+
+// Decode reads the rules from their JSON representation, so they can be
+// set through the environment.
+func (rules *BranchRules) Decode(value string) error {
+	return json.Unmarshal([]byte(value), rules)
+}
+
+// AllowsWrite reports whether any of the roles may write to branch.
+func (rules BranchRules) AllowsWrite(roles []string, branch string) bool {
+	for _, rule := range rules {
+		r := PathRule{Pattern: rule.Pattern, Roles: rule.Roles}
+		if r.Matches(branch) {
+			return r.grants(roles)
+		}
+	}
+	return false
+}
+
+// BranchProtection holds the branch write rules enforced by the gateway.
+type BranchProtection struct {
+	Rules BranchRules `envconfig:"RULES" json:"rules,omitempty"`
+	// MergeRoles may merge pull requests and merge requests. When empty any
+	// role may merge.
+	MergeRoles []string `split_words:"true" json:"merge_roles,omitempty"`
+	// DefaultBranch is assumed when a request doesn't name its branch.
+	DefaultBranch string `split_words:"true" json:"default_branch,omitempty"`
+}
@@ -1,6 +1,7 @@
 package conf
 
 import (
+	"errors"
 	"os"
 
 	"github.com/joho/godotenv"
@@ -11,40 +12,84 @@ const DefaultGitHubEndpoint = "https://api.github.com"
 const DefaultGitLabEndpoint = "https://gitlab.com/api/v4"
 const DefaultGitLabTokenType = "oauth"
 const DefaultBitBucketEndpoint = "https://api.bitbucket.org/2.0"
+const DefaultJWKSRefreshInterval = 3600
+
+// Commit author policies, see Configuration.CommitAuthor.
+const (
+	CommitAuthorOverride    = "override"
+	CommitAuthorFillMissing = "fill-if-missing"
+	CommitAuthorCoAuthor    = "co-author"
+)
 
 type GitHubConfig struct {
-	AccessToken string `envconfig:"ACCESS_TOKEN" json:"access_token,omitempty"`
+	AccessToken string `envconfig:"ACCESS_TOKEN" json:"access_token,omitempty" secret:"true"`
 	Endpoint    string `envconfig:"ENDPOINT" json:"endpoint"`
 	Repo        string `envconfig:"REPO" json:"repo"` // Should be "owner/repo" format
 }
 
 type GitLabConfig struct {
-	AccessToken     string `envconfig:"ACCESS_TOKEN" json:"access_token,omitempty"`
+	AccessToken     string `envconfig:"ACCESS_TOKEN" json:"access_token,omitempty" secret:"true"`
 	AccessTokenType string `envconfig:"ACCESS_TOKEN_TYPE" json:"access_token_type"`
 	Endpoint        string `envconfig:"ENDPOINT" json:"endpoint"`
 	Repo            string `envconfig:"REPO" json:"repo"` // Should be "owner/repo" format
 }
 
 type BitBucketConfig struct {
-	RefreshToken string `envconfig:"REFRESH_TOKEN" json:"refresh_token,omitempty"`
+	RefreshToken string `envconfig:"REFRESH_TOKEN" json:"refresh_token,omitempty" secret:"true"`
 	ClientID     string `envconfig:"CLIENT_ID" json:"client_id,omitempty"`
-	ClientSecret string `envconfig:"CLIENT_SECRET" json:"client_secret,omitempty"`
+	ClientSecret string `envconfig:"CLIENT_SECRET" json:"client_secret,omitempty" secret:"true"`
 	Endpoint     string `envconfig:"ENDPOINT" json:"endpoint"`
 	Repo         string `envconfig:"REPO" json:"repo"`
 }
 
-// DBConfiguration holds all the database related configuration.
+// DBConfiguration holds all the database related configuration. Driver
+// picks the storage backend, "sqlite3", "mysql", "postgres", "memory" or
+// "file". When it's empty the scheme of URL is used.
 type DBConfiguration struct {
 	Dialect     string `json:"dialect"`
-	Driver      string `json:"driver" required:"true"`
-	URL         string `json:"url" envconfig:"DATABASE_URL" required:"true"`
+	Driver      string `json:"driver"`
+	URL         string `json:"url" envconfig:"DATABASE_URL"`
 	Namespace   string `json:"namespace"`
 	Automigrate bool   `json:"automigrate"`
+	// AuditLimit is the number of audit entries the memory store keeps,
+	// 10000 by default. The memory store, which `serve` uses when no
+	// database is configured, loses its audit entries on restart.
+	AuditLimit int `json:"audit_limit" split_words:"true"`
+}
+
+// MetricsConfig configures the Prometheus metrics endpoint.
+type MetricsConfig struct {
+	// Address serves /metrics on a separate listener, e.g. "localhost:9100".
+	// When empty /metrics is served by the API to operator credentials.
+	Address string `json:"address"`
 }
 
 // JWTConfiguration holds all the JWT related configuration.
 type JWTConfiguration struct {
-	Secret string `json:"secret" required:"true"`
+	Secret string `json:"secret" secret:"true"`
+
+	// JWKSURL and JWKSFile point to a JSON Web Key Set used to verify
+	// asymmetrically signed (RS256/ES256) tokens. Only one of them is used,
+	// JWKSURL takes precedence. Instances of the multi-instance server are
+	// restricted to https URLs, see GlobalConfiguration.ValidateInstanceJWKS.
+	JWKSURL  string `envconfig:"JWKS_URL" json:"jwks_url,omitempty"`
+	JWKSFile string `envconfig:"JWKS_FILE" json:"jwks_file,omitempty"`
+	// JWKSRefreshInterval is the number of seconds keys are cached before
+	// the key set is fetched again.
+	JWKSRefreshInterval int `envconfig:"JWKS_REFRESH_INTERVAL" json:"jwks_refresh_interval,omitempty"`
+
+	// Issuers and Audiences restrict the accepted iss and aud claims. When
+	// Audiences is set, clients may pick one of them with the X-JWT-AUD header.
+	Issuers   []string `envconfig:"ISSUERS" json:"issuers,omitempty"`
+	Audiences []string `envconfig:"AUDIENCES" json:"audiences,omitempty"`
+}
+
+// JWKSSource returns the location of the configured key set, if any.
+func (c *JWTConfiguration) JWKSSource() string {
+	if c.JWKSURL != "" {
+		return c.JWKSURL
+	}
+	return c.JWKSFile
 }
 
 // GlobalConfiguration holds all the configuration that applies to all instances.
@@ -54,19 +99,42 @@ type GlobalConfiguration struct {
 		Port     int `envconfig:"PORT" default:"8081"`
 		Endpoint string
 	}
-	DB                DBConfiguration
-	Logging           LoggingConfig `envconfig:"LOG"`
-	OperatorToken     string        `split_words:"true"`
+	DB            DBConfiguration
+	Logging       LoggingConfig `envconfig:"LOG"`
+	Tracing       TracingConfig
+	Metrics       MetricsConfig
+	Encryption    EncryptionConfig
+	OperatorToken string `split_words:"true"`
+	// Operators are named operator credentials, as a JSON list
+	Operators         OperatorCredentials `envconfig:"OPERATORS"`
+	Signature         SignatureConfig
 	MultiInstanceMode bool
+	// JWKSAllowedHosts lists the hosts instances may fetch their key sets
+	// from, redirects included. When empty instances can't use key sets.
+	JWKSAllowedHosts []string `envconfig:"JWKS_ALLOWED_HOSTS"`
 }
 
-// Configuration holds all the per-instance configuration.
+// Configuration holds all the per-instance configuration. Fields tagged
+// `secret:"true"` are redacted from API responses.
 type Configuration struct {
 	JWT       JWTConfiguration `json:"jwt"`
 	GitHub    GitHubConfig     `envconfig:"GITHUB" json:"github"`
 	GitLab    GitLabConfig     `envconfig:"GITLAB" json:"gitlab"`
 	BitBucket BitBucketConfig  `envconfig:"BITBUCKET" json:"bitbucket"`
 	Roles     []string         `envconfig:"ROLES" json:"roles"`
+	// Permissions restricts what each role may do. When empty, any of
+	// the Roles has full access.
+	Permissions PermissionMatrix `envconfig:"PERMISSIONS" json:"permissions,omitempty"`
+	// PathRules restricts which roles may write which repository files.
+	// When empty, files can be written anywhere in the repo.
+	PathRules PathRules `envconfig:"PATH_RULES" json:"path_rules,omitempty"`
+	// Branches restricts which roles may write to which branches.
+	Branches BranchProtection `envconfig:"BRANCHES" json:"branches"`
+	// CommitAuthor attributes commits to the editor making them: "override"
+	// replaces the author and committer, "fill-if-missing" only sets them when
+	// the client didn't and "co-author" adds a Co-authored-by trailer. When
+	// empty commits are left untouched.
+	CommitAuthor string `envconfig:"COMMIT_AUTHOR" json:"commit_author,omitempty"`
 }
 
 func loadEnvironment(filename string) error {
@@ -109,6 +177,9 @@ func LoadConfig(filename string) (*Configuration, error) {
 	if err := envconfig.Process("gitgateway", config); err != nil {
 		return nil, err
 	}
+	if config.JWT.Secret == "" && config.JWT.JWKSSource() == "" {
+		return nil, errors.New("either a JWT secret or a JWKS url/file is required")
+	}
 	config.ApplyDefaults()
 	return config, nil
 }
@@ -127,4 +198,7 @@ func (config *Configuration) ApplyDefaults() {
 	if config.BitBucket.Endpoint == "" {
 		config.BitBucket.Endpoint = DefaultBitBucketEndpoint
 	}
+	if config.JWT.JWKSRefreshInterval == 0 {
+		config.JWT.JWKSRefreshInterval = DefaultJWKSRefreshInterval
+	}
 }
@@ -0,0 +1,71 @@
+package conf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// MasterKeySize is the size in bytes of the AES-256 master keys.
+const MasterKeySize = 32
+
+// EncryptionConfig holds the master keys instance secrets are encrypted with
+// at rest. Keys are named by an ID so they can be rotated: secrets encrypted
+// with an older key can still be read, new secrets use the KeyID key.
+type EncryptionConfig struct {
+	// Keys maps key IDs to base64 encoded keys, e.g. "2024:a2V5...,2023:b2xk..."
+	Keys map[string]string `json:"keys,omitempty"`
+	// KeyFile is a JSON object mapping key IDs to base64 encoded keys.
+	KeyFile string `split_words:"true" json:"key_file"`
+	// KeyID picks the key new secrets are encrypted with. It may be left
+	// empty when a single key is configured.
+	KeyID string `envconfig:"KEY_ID" json:"key_id"`
+}
+
+// MasterKeys decodes the configured keys and returns them with the ID of the
+// key used for encryption. No keys are returned when encryption is disabled.
+func (c *EncryptionConfig) MasterKeys() (map[string][]byte, string, error) {
+	encoded := map[string]string{}
+	if c.KeyFile != "" {
+		data, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := json.Unmarshal(data, &encoded); err != nil {
+			return nil, "", fmt.Errorf("error parsing key file %s: %v", c.KeyFile, err)
+		}
+	}
+	for id, key := range c.Keys {
+		encoded[id] = key
+	}
+	if len(encoded) == 0 {
+		return nil, "", nil
+	}
+
+	keys := map[string][]byte{}
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("error decoding encryption key %q: %v", id, err)
+		}
+		if len(key) != MasterKeySize {
+			return nil, "", fmt.Errorf("encryption key %q must be %d bytes long", id, MasterKeySize)
+		}
+		keys[id] = key
+	}
+
+	active := c.KeyID
+	if active == "" {
+		if len(keys) > 1 {
+			return nil, "", fmt.Errorf("a key id is required when several encryption keys are configured")
+		}
+		for id := range keys {
+			active = id
+		}
+	}
+	if _, ok := keys[active]; !ok {
+		return nil, "", fmt.Errorf("unknown encryption key id %q", active)
+	}
+	return keys, active, nil
+}
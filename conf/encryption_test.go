@@ -0,0 +1,45 @@
+package conf
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMasterKeys(t *testing.T) {
+	key := func(c string) string {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(c, MasterKeySize)))
+	}
+
+	keys, active, err := (&EncryptionConfig{}).MasterKeys()
+	require.NoError(t, err)
+	assert.Nil(t, keys)
+	assert.Empty(t, active)
+
+	keys, active, err = (&EncryptionConfig{Keys: map[string]string{"one": key("a")}}).MasterKeys()
+	require.NoError(t, err)
+	assert.Equal(t, "one", active)
+	assert.Len(t, keys["one"], MasterKeySize)
+
+	f, err := ioutil.TempFile("", "git-gateway-keys-")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"old":"` + key("o") + `"}`)
+	f.Close()
+
+	keys, active, err = (&EncryptionConfig{KeyFile: f.Name(), Keys: map[string]string{"new": key("n")}, KeyID: "new"}).MasterKeys()
+	require.NoError(t, err)
+	assert.Equal(t, "new", active)
+	assert.Len(t, keys, 2)
+
+	_, _, err = (&EncryptionConfig{KeyFile: f.Name(), Keys: map[string]string{"new": key("n")}}).MasterKeys()
+	assert.Error(t, err, "several keys need a key id")
+
+	_, _, err = (&EncryptionConfig{Keys: map[string]string{"short": base64.StdEncoding.EncodeToString([]byte("short"))}}).MasterKeys()
+	assert.Error(t, err)
+}
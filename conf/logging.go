@@ -1,6 +1,7 @@
 package conf
 
 import (
+	"fmt"
 	"os"
 	"time"
 
@@ -14,24 +15,36 @@ type LoggingConfig struct {
 	QuoteEmptyFields bool                   `mapstructure:"quote_empty_fields" split_words:"true" json:"quote_empty_fields"`
 	TSFormat         string                 `mapstructure:"ts_format" json:"ts_format"`
 	Fields           map[string]interface{} `mapstructure:"fields" json:"fields"`
-	UseNewLogger     bool                   `mapstructure:"use_new_logger" split_words:"true"`
+	// Format is either "text" (the default) or "json"
+	Format string `mapstructure:"log_format" json:"log_format"`
 }
 
+// ConfigureLogging sets up the standard logger used throughout the gateway.
+// Credentials are redacted from every line whatever the format.
 func ConfigureLogging(config *LoggingConfig) (*logrus.Entry, error) {
-	logger := logrus.New()
+	logger := logrus.StandardLogger()
 
 	tsFormat := time.RFC3339Nano
 	if config.TSFormat != "" {
 		tsFormat = config.TSFormat
 	}
-	// always use the full timestamp
-	logger.Formatter = &logrus.TextFormatter{
-		FullTimestamp:    true,
-		DisableTimestamp: false,
-		TimestampFormat:  tsFormat,
-		DisableColors:    config.DisableColors,
-		QuoteEmptyFields: config.QuoteEmptyFields,
+	var formatter logrus.Formatter
+	switch config.Format {
+	case "json":
+		formatter = &logrus.JSONFormatter{TimestampFormat: tsFormat}
+	case "text", "":
+		// always use the full timestamp
+		formatter = &logrus.TextFormatter{
+			FullTimestamp:    true,
+			DisableTimestamp: false,
+			TimestampFormat:  tsFormat,
+			DisableColors:    config.DisableColors,
+			QuoteEmptyFields: config.QuoteEmptyFields,
+		}
+	default:
+		return nil, fmt.Errorf("unknown log format %q", config.Format)
 	}
+	logger.Formatter = &RedactingFormatter{formatter}
 
 	// use a file if you want
 	if config.File != "" {
@@ -0,0 +1,92 @@
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Operator scopes. A read-only credential may list and get instances, an
+// instance-admin credential may also change them and a signing credential
+// signs the x-nf-sign header of gateway requests.
+const (
+	OperatorScopeReadOnly      = "read-only"
+	OperatorScopeInstanceAdmin = "instance-admin"
+	OperatorScopeSigning       = "signing"
+)
+
+// LegacyOperatorName names the credential made from OperatorToken.
+const LegacyOperatorName = "operator"
+
+// OperatorCredential is a named operator token limited to some scopes. To
+// rotate a credential, add its replacement, move the clients over and then
+// remove it or let it expire.
+type OperatorCredential struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token" secret:"true"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt retires the credential, e.g. at the end of a rotation.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Active reports whether the credential hasn't expired at now.
+func (c *OperatorCredential) Active(now time.Time) bool {
+	return c.ExpiresAt.IsZero() || now.Before(c.ExpiresAt)
+}
+
+// HasScope reports whether the credential was granted scope. Instance admins
+// may read too.
+func (c *OperatorCredential) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope || (s == OperatorScopeInstanceAdmin && scope == OperatorScopeReadOnly) {
+			return true
+		}
+	}
+	return false
+}
+
+// OperatorCredentials lists the configured operator credentials.
+type OperatorCredentials []OperatorCredential
+
+// Decode reads the credentials from their JSON representation, so they can
+// be set through the environment.
+func (o *OperatorCredentials) Decode(value string) error {
+	creds := OperatorCredentials{}
+	if err := json.Unmarshal([]byte(value), &creds); err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, c := range creds {
+		if c.Name == "" || c.Token == "" {
+			return errors.New("operator credentials require a name and a token")
+		}
+		if names[c.Name] || c.Name == LegacyOperatorName {
+			return fmt.Errorf("duplicate operator credential %q", c.Name)
+		}
+		names[c.Name] = true
+		for _, scope := range c.Scopes {
+			switch scope {
+			case OperatorScopeReadOnly, OperatorScopeInstanceAdmin, OperatorScopeSigning:
+			default:
+				return fmt.Errorf("unknown scope %q of operator credential %q", scope, c.Name)
+			}
+		}
+	}
+	*o = creds
+	return nil
+}
+
+// OperatorCredentials returns every operator credential, including one
+// named "operator" with all scopes when OperatorToken is set.
+func (config *GlobalConfiguration) OperatorCredentials() OperatorCredentials {
+	creds := OperatorCredentials{}
+	if config.OperatorToken != "" {
+		creds = append(creds, OperatorCredential{
+			Name:   LegacyOperatorName,
+			Token:  config.OperatorToken,
+			Scopes: []string{OperatorScopeInstanceAdmin, OperatorScopeSigning},
+		})
+	}
+	return append(creds, config.Operators...)
+}
@@ -0,0 +1,37 @@
+package conf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperatorCredentials(t *testing.T) {
+	creds := OperatorCredentials{}
+	require.NoError(t, creds.Decode(`[
+		{"name":"reader","token":"r","scopes":["read-only"]},
+		{"name":"admin","token":"a","scopes":["instance-admin"],"expires_at":"2020-01-01T00:00:00Z"}
+	]`))
+	require.Len(t, creds, 2)
+
+	reader, admin := creds[0], creds[1]
+	assert.True(t, reader.HasScope(OperatorScopeReadOnly))
+	assert.False(t, reader.HasScope(OperatorScopeInstanceAdmin))
+	assert.True(t, admin.HasScope(OperatorScopeReadOnly), "instance admins may read")
+	assert.False(t, admin.HasScope(OperatorScopeSigning))
+	assert.True(t, reader.Active(time.Now()))
+	assert.False(t, admin.Active(time.Now()))
+
+	assert.Error(t, creds.Decode(`[{"name":"reader","token":"r"},{"name":"reader","token":"s"}]`))
+	assert.Error(t, creds.Decode(`[{"name":"reader"}]`))
+	assert.Error(t, creds.Decode(`[{"name":"reader","token":"r","scopes":["root"]}]`))
+
+	config := &GlobalConfiguration{OperatorToken: "legacy", Operators: OperatorCredentials{reader}}
+	all := config.OperatorCredentials()
+	require.Len(t, all, 2)
+	assert.Equal(t, LegacyOperatorName, all[0].Name)
+	assert.True(t, all[0].HasScope(OperatorScopeInstanceAdmin))
+	assert.True(t, all[0].HasScope(OperatorScopeSigning))
+}
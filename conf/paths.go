@@ -0,0 +1,144 @@
+package conf
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathRule grants write access to the repository files matching Pattern.
+// Patterns are globs where "*" matches within a path segment and "**"
+// matches across segments, e.g. "content/blog/**".
+type PathRule struct {
+	Pattern string   `json:"pattern"`
+	Roles   []string `json:"roles"`
+}
+
+// PathRules is an ordered list of rules. The first rule matching a path
+// decides who may write it, paths without a matching rule can't be written.
+type PathRules []PathRule
+
+// Decode reads the rules from their JSON representation, so they can be
+// set through the environment.
+func (rules *PathRules) Decode(value string) error {
+	return json.Unmarshal([]byte(value), rules)
+}
+
+// AllowsWrite reports whether any of the roles may write the file at p,
+// relative to the repository root.
+func (rules PathRules) AllowsWrite(roles []string, p string) bool {
+	p, ok := cleanPath(p)
+	if !ok {
+		return false
+	}
+	for _, rule := range rules {
+		if rule.Matches(p) {
+			return rule.grants(roles)
+		}
+	}
+	return false
+}
+
+// AllowsTreeWrite reports whether any of the roles may replace the whole
+// directory at dir. This requires every rule that could apply to a file
+// below dir to grant one of the roles.
+func (rules PathRules) AllowsTreeWrite(roles []string, dir string) bool {
+	dir, ok := cleanPath(dir)
+	if !ok {
+		return false
+	}
+	for _, rule := range rules {
+		if !rule.overlaps(dir) {
+			continue
+		}
+		if !rule.grants(roles) {
+			return false
+		}
+		if rule.covers(dir) {
+			// later rules never apply below dir
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath normalizes a path relative to the repository root. Absolute
+// paths and paths leaving the root, e.g. "docs/../../x", are refused.
+func cleanPath(p string) (string, bool) {
+	if strings.HasPrefix(p, "/") {
+		return "", false
+	}
+	p = path.Clean(p)
+	if p == "." {
+		return "", true
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	return p, true
+}
+
+// Matches reports whether path matches the rule pattern.
+func (rule PathRule) Matches(path string) bool {
+	re, err := globRegexp(rule.Pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(strings.Trim(path, "/"))
+}
+
+func (rule PathRule) grants(roles []string) bool {
+	for _, role := range roles {
+		for _, r := range rule.Roles {
+			if r == PermissionWildcard || r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// covers reports whether the rule matches every file below dir, at any depth.
+func (rule PathRule) covers(dir string) bool {
+	return rule.Matches(dir+"/**") && rule.Matches(dir+"/**/**")
+}
+
+// overlaps reports whether the rule could match dir or a file below it.
+func (rule PathRule) overlaps(dir string) bool {
+	prefix := strings.Trim(rule.Pattern, "/")
+	if i := strings.IndexAny(prefix, "*?"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if dir == "" {
+		return true
+	}
+	return strings.HasPrefix(prefix, dir+"/") || strings.HasPrefix(dir+"/", prefix) || prefix == dir
+}
+
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.Trim(pattern, "/")
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
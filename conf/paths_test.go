@@ -0,0 +1,29 @@
+package conf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathRulesCleanPaths(t *testing.T) {
+	rules := PathRules{
+		{Pattern: "docs/**", Roles: []string{"writer"}},
+		{Pattern: "**", Roles: []string{"admin"}},
+	}
+	roles := []string{"writer"}
+
+	assert.True(t, rules.AllowsWrite(roles, "docs/guide.md"))
+	assert.True(t, rules.AllowsWrite(roles, "docs/./guide/../index.md"))
+	assert.True(t, rules.AllowsTreeWrite(roles, "docs/guide/"))
+
+	assert.False(t, rules.AllowsWrite(roles, "docs/../.github/workflows/x.yml"))
+	assert.False(t, rules.AllowsWrite(roles, "docs/../../x.md"))
+	assert.False(t, rules.AllowsWrite(roles, "/docs/guide.md"))
+	assert.False(t, rules.AllowsTreeWrite(roles, "docs/.."))
+	assert.False(t, rules.AllowsTreeWrite(roles, "/docs"))
+
+	// the admin rule matches everything, but paths must still stay in the repo
+	assert.True(t, rules.AllowsWrite([]string{"admin"}, ".github/workflows/x.yml"))
+	assert.False(t, rules.AllowsWrite([]string{"admin"}, "../x.md"))
+}
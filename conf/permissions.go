@@ -0,0 +1,54 @@
+package conf
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// PermissionWildcard matches any method or endpoint group.
+const PermissionWildcard = "*"
+
+// RolePermission grants access to a set of endpoint groups for the given
+// HTTP methods.
+type RolePermission struct {
+	Methods   []string `json:"methods"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// PermissionMatrix maps role names to the permissions they grant.
+type PermissionMatrix map[string][]RolePermission
+
+// Decode reads the matrix from its JSON representation, so it can be set
+// through the environment.
+func (m *PermissionMatrix) Decode(value string) error {
+	return json.Unmarshal([]byte(value), m)
+}
+
+// Allows reports whether any of the roles may call endpoint with method.
+func (m PermissionMatrix) Allows(roles []string, method, endpoint string) bool {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	for _, role := range roles {
+		for _, p := range m[role] {
+			if p.allows(method, endpoint) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p RolePermission) allows(method, endpoint string) bool {
+	return matchesAny(p.Methods, method, strings.EqualFold) && matchesAny(p.Endpoints, endpoint, func(a, b string) bool { return a == b })
+}
+
+func matchesAny(list []string, value string, equal func(a, b string) bool) bool {
+	for _, v := range list {
+		if v == PermissionWildcard || equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
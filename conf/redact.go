@@ -0,0 +1,80 @@
+package conf
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveFields are log field names whose values are always redacted.
+var sensitiveFields = []string{
+	"authorization",
+	"private-token",
+	"private_token",
+	"access_token",
+	"refresh_token",
+	"client_secret",
+	"secret",
+	"token",
+	"password",
+}
+
+var redactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// Authorization header values
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9\-._~+/]{12,}=*`), "$1 " + redacted},
+	{regexp.MustCompile(`(?i)\b(token)\s+[A-Za-z0-9\-._~+/]{20,}=*`), "$1 " + redacted},
+	// credentials in headers, query strings, form bodies and JSON
+	{regexp.MustCompile(`(?i)\b(private[-_]token|access_token|refresh_token|client_secret|password)("?\s*[:=]\s*"?)[^\s"&,;}]+`), "$1$2" + redacted},
+	// JWTs anywhere else
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9\-_]*\.[A-Za-z0-9\-_]+\.[A-Za-z0-9\-_]*`), redacted},
+	// credentials in URLs
+	{regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), "$1" + redacted + "@"},
+}
+
+// Redact scrubs bearer tokens, private tokens, refresh tokens and client
+// secrets from s.
+func Redact(s string) string {
+	for _, r := range redactions {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+// RedactingFormatter scrubs credentials from the message and fields of every
+// entry before handing it to Formatter.
+type RedactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *RedactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	clean := *entry
+	clean.Message = Redact(entry.Message)
+	clean.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		clean.Data[k] = redactField(k, v)
+	}
+	return f.Formatter.Format(&clean)
+}
+
+func redactField(key string, value interface{}) interface{} {
+	for _, name := range sensitiveFields {
+		if strings.EqualFold(key, name) {
+			return redacted
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return Redact(v)
+	case error:
+		if s := v.Error(); Redact(s) != s {
+			return Redact(s)
+		}
+	}
+	return value
+}
@@ -0,0 +1,117 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+)
+
+// secretTag marks configuration fields that must never be returned by the
+// API, e.g. `secret:"true"`.
+const secretTag = "secret"
+
+// Redacted returns a copy of the configuration with every secret cleared.
+func (config *Configuration) Redacted() *Configuration {
+	if config == nil {
+		return nil
+	}
+	c := *config
+	walkSecrets(reflect.ValueOf(&c).Elem(), "", true, func(path string, field reflect.Value) {
+		field.Set(reflect.Zero(field.Type()))
+	})
+	return &c
+}
+
+// MapSecrets returns a copy of the configuration with every secret replaced
+// by the result of fn.
+func (config *Configuration) MapSecrets(fn func(path, value string) (string, error)) (*Configuration, error) {
+	if config == nil {
+		return nil, nil
+	}
+	c := *config
+	var err error
+	walkSecrets(reflect.ValueOf(&c).Elem(), "", true, func(path string, field reflect.Value) {
+		if err != nil || field.Kind() != reflect.String {
+			return
+		}
+		var value string
+		if value, err = fn(path, field.String()); err == nil {
+			field.SetString(value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// KeepSecrets returns a copy of the configuration with the secrets it leaves
+// empty, e.g. in a redacted copy, filled with those of existing.
+func (config *Configuration) KeepSecrets(existing *Configuration) (*Configuration, error) {
+	secrets := map[string]string{}
+	if _, err := existing.MapSecrets(func(path, value string) (string, error) {
+		secrets[path] = value
+		return value, nil
+	}); err != nil {
+		return nil, err
+	}
+	return config.MapSecrets(func(path, value string) (string, error) {
+		if value == "" {
+			return secrets[path], nil
+		}
+		return value, nil
+	})
+}
+
+// Secrets reports for every secret whether it's set, keyed by its JSON path,
+// e.g. "github.access_token".
+func (config *Configuration) Secrets() map[string]bool {
+	secrets := map[string]bool{}
+	if config == nil {
+		return secrets
+	}
+	walkSecrets(reflect.ValueOf(config).Elem(), "", false, func(path string, field reflect.Value) {
+		secrets[path] = !field.IsZero()
+	})
+	return secrets
+}
+
+// walkSecrets calls fn with every field tagged as secret in the struct v and
+// the structs nested in it. With copyPointers, nested struct pointers are
+// replaced by copies before descending, so fn may modify them without
+// touching the original.
+func walkSecrets(v reflect.Value, prefix string, copyPointers bool, fn func(path string, field reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		field := v.Field(i)
+		path := prefix + jsonName(f)
+
+		if f.Tag.Get(secretTag) == "true" {
+			fn(path, field)
+			continue
+		}
+
+		switch {
+		case field.Kind() == reflect.Struct:
+			walkSecrets(field, path+".", copyPointers, fn)
+		case field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct && !field.IsNil():
+			if copyPointers {
+				c := reflect.New(field.Type().Elem())
+				c.Elem().Set(field.Elem())
+				field.Set(c)
+			}
+			walkSecrets(field.Elem(), path+".", copyPointers, fn)
+		}
+	}
+}
+
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
@@ -0,0 +1,77 @@
+package conf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedacted(t *testing.T) {
+	config := &Configuration{
+		JWT:       JWTConfiguration{Secret: "jwt-secret"},
+		GitHub:    GitHubConfig{AccessToken: "github-token", Repo: "owner/repo"},
+		GitLab:    GitLabConfig{AccessToken: "gitlab-token"},
+		BitBucket: BitBucketConfig{RefreshToken: "refresh-token", ClientID: "client-id"},
+	}
+
+	redacted := config.Redacted()
+	assert.Empty(t, redacted.JWT.Secret)
+	assert.Empty(t, redacted.GitHub.AccessToken)
+	assert.Empty(t, redacted.GitLab.AccessToken)
+	assert.Empty(t, redacted.BitBucket.RefreshToken)
+	assert.Equal(t, "owner/repo", redacted.GitHub.Repo)
+	assert.Equal(t, "client-id", redacted.BitBucket.ClientID)
+
+	// the original is left untouched
+	assert.Equal(t, "github-token", config.GitHub.AccessToken)
+
+	assert.Equal(t, map[string]bool{
+		"jwt.secret":              true,
+		"github.access_token":     true,
+		"gitlab.access_token":     true,
+		"bitbucket.refresh_token": true,
+		"bitbucket.client_secret": false,
+	}, config.Secrets())
+}
+
+func TestKeepSecrets(t *testing.T) {
+	existing := &Configuration{
+		JWT:    JWTConfiguration{Secret: "jwt-secret"},
+		GitHub: GitHubConfig{AccessToken: "github-token", Repo: "owner/repo"},
+	}
+	update := &Configuration{
+		GitHub: GitHubConfig{Repo: "owner/other"},
+		GitLab: GitLabConfig{AccessToken: "gitlab-token"},
+	}
+
+	config, err := update.KeepSecrets(existing)
+	assert.NoError(t, err)
+	assert.Equal(t, "jwt-secret", config.JWT.Secret)
+	assert.Equal(t, "github-token", config.GitHub.AccessToken)
+	assert.Equal(t, "gitlab-token", config.GitLab.AccessToken)
+	assert.Equal(t, "owner/other", config.GitHub.Repo)
+	assert.Empty(t, update.GitHub.AccessToken, "the update is left untouched")
+
+	config, err = update.KeepSecrets(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, config.GitHub.AccessToken)
+}
+
+func TestRedactedNestedPointers(t *testing.T) {
+	type provider struct {
+		Token string `json:"token" secret:"true"`
+	}
+	type config struct {
+		Provider *provider `json:"provider"`
+	}
+
+	original := &config{Provider: &provider{Token: "token"}}
+	c := *original
+	walkSecrets(reflect.ValueOf(&c).Elem(), "", true, func(path string, field reflect.Value) {
+		assert.Equal(t, "provider.token", path)
+		field.SetString("")
+	})
+	assert.Empty(t, c.Provider.Token)
+	assert.Equal(t, "token", original.Provider.Token)
+}
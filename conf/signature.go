@@ -0,0 +1,18 @@
+package conf
+
+import "time"
+
+// DefaultSignatureMaxAge is how long an x-nf-sign signature stays valid
+// when MaxAge isn't set.
+const DefaultSignatureMaxAge = 5 * time.Minute
+
+// SignatureConfig restricts the x-nf-sign signatures operators make for
+// gateway requests. Signatures must always carry exp and iat claims.
+type SignatureConfig struct {
+	// MaxAge limits both the age and the lifetime of a signature.
+	MaxAge time.Duration `json:"max_age" split_words:"true" default:"5m"`
+	// ReplayProtection requires a jti claim and accepts each jti only once.
+	ReplayProtection bool `json:"replay_protection" split_words:"true"`
+	// BindRequest requires host and path claims matching the request.
+	BindRequest bool `json:"bind_request" split_words:"true"`
+}
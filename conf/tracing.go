@@ -0,0 +1,83 @@
+package conf
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	TracingExporterOTLP = "otlp"
+	TracingExporterFile = "file"
+)
+
+type TracingConfig struct {
+	Enabled bool `json:"enabled"`
+	// Exporter is either "otlp" or "file"
+	Exporter    string  `json:"exporter" default:"otlp"`
+	Endpoint    string  `json:"endpoint"` // OTLP/HTTP collector host:port, defaults to the OTEL_EXPORTER_OTLP_* variables
+	Insecure    bool    `json:"insecure"`
+	File        string  `json:"file"` // path spans are appended to with the file exporter
+	ServiceName string  `json:"service_name" split_words:"true" default:"git-gateway"`
+	SampleRate  float64 `json:"sample_rate" split_words:"true" default:"1"`
+}
+
+// ConfigureTracing installs the global tracer provider and the W3C trace
+// context propagator. The returned function flushes and stops the exporter.
+func ConfigureTracing(config *TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	noop := func(context.Context) error { return nil }
+	if !config.Enabled {
+		return noop, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case TracingExporterOTLP, "":
+		opts := []otlptracehttp.Option{}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case TracingExporterFile:
+		if config.File == "" {
+			return noop, fmt.Errorf("a file is required for the %s tracing exporter", TracingExporterFile)
+		}
+		f, errOpen := os.OpenFile(config.File, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0664)
+		if errOpen != nil {
+			return noop, errOpen
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return noop, fmt.Errorf("unknown tracing exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return noop, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", config.ServiceName)))
+	if err != nil {
+		return noop, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRate))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,163 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// GitLab access token types, see GitLabConfig.AccessTokenType.
+const (
+	GitLabTokenTypeOAuth          = DefaultGitLabTokenType
+	GitLabTokenTypePersonalAccess = "personal_access"
+)
+
+// FieldError describes an invalid configuration field by its JSON path.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every problem found in a configuration.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Field + ": " + err.Message
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the configuration for malformed values. It returns
+// ValidationErrors when there is any.
+func (config *Configuration) Validate() error {
+	errs := ValidationErrors{}
+
+	if config.JWT.Secret == "" && config.JWT.JWKSSource() == "" {
+		errs.add("jwt.secret", "either a JWT secret or a JWKS url/file is required")
+	}
+	validateURL(&errs, "jwt.jwks_url", config.JWT.JWKSURL)
+
+	validateURL(&errs, "github.endpoint", config.GitHub.Endpoint)
+	validateRepo(&errs, "github.repo", config.GitHub.Repo, false)
+
+	validateURL(&errs, "gitlab.endpoint", config.GitLab.Endpoint)
+	validateRepo(&errs, "gitlab.repo", config.GitLab.Repo, true)
+	switch config.GitLab.AccessTokenType {
+	case "", GitLabTokenTypeOAuth, GitLabTokenTypePersonalAccess:
+	default:
+		errs.add("gitlab.access_token_type", "must be %q or %q", GitLabTokenTypeOAuth, GitLabTokenTypePersonalAccess)
+	}
+
+	validateURL(&errs, "bitbucket.endpoint", config.BitBucket.Endpoint)
+	validateRepo(&errs, "bitbucket.repo", config.BitBucket.Repo, false)
+	bb := config.BitBucket
+	if bb.RefreshToken != "" || bb.ClientID != "" || bb.ClientSecret != "" {
+		for field, value := range map[string]string{
+			"bitbucket.refresh_token": bb.RefreshToken,
+			"bitbucket.client_id":     bb.ClientID,
+			"bitbucket.client_secret": bb.ClientSecret,
+		} {
+			if value == "" {
+				errs.add(field, "refresh_token, client_id and client_secret must be set together")
+			}
+		}
+	}
+
+	switch config.CommitAuthor {
+	case "", CommitAuthorOverride, CommitAuthorFillMissing, CommitAuthorCoAuthor:
+	default:
+		errs.add("commit_author", "must be one of %q, %q or %q", CommitAuthorOverride, CommitAuthorFillMissing, CommitAuthorCoAuthor)
+	}
+
+	if len(errs) > 0 {
+		// map iteration order varies, report errors consistently
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return errs
+	}
+	return nil
+}
+
+// ValidateInstanceJWKS checks the key set of an instance of the
+// multi-instance server. Instances may not read files on the gateway host,
+// and only fetch key sets over https from the allowed hosts.
+func (config *GlobalConfiguration) ValidateInstanceJWKS(jwt *JWTConfiguration) error {
+	errs := ValidationErrors{}
+	if jwt.JWKSFile != "" {
+		errs.add("jwt.jwks_file", "can't be set for an instance, use jwks_url")
+	}
+	if jwt.JWKSURL != "" {
+		u, err := url.Parse(jwt.JWKSURL)
+		if err == nil {
+			err = config.CheckInstanceJWKSURL(u)
+		}
+		if err != nil {
+			errs.add("jwt.jwks_url", "%v", err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// CheckInstanceJWKSURL checks a URL an instance fetches its key set from,
+// including every redirect followed on the way. It must use https and name
+// one of JWKSAllowedHosts, without an allowlist instances can't use key sets
+// at all.
+func (config *GlobalConfiguration) CheckInstanceJWKSURL(u *url.URL) error {
+	switch {
+	case u.Scheme != "https" || u.Host == "":
+		return errors.New("must be an absolute https URL")
+	case len(config.JWKSAllowedHosts) == 0:
+		return errors.New("no JWKS hosts are allowed for instances, see JWKS_ALLOWED_HOSTS")
+	case !containsHost(config.JWKSAllowedHosts, u.Hostname()):
+		return fmt.Errorf("host %q isn't allowed", u.Hostname())
+	}
+	return nil
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateURL(errs *ValidationErrors, field, value string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.add(field, "must be an absolute http or https URL")
+	}
+}
+
+// validateRepo checks for the "owner/repo" format. GitLab repos may live in
+// nested groups, e.g. "group/subgroup/repo".
+func validateRepo(errs *ValidationErrors, field, value string, nested bool) {
+	if value == "" {
+		return
+	}
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || (!nested && len(parts) > 2) {
+		errs.add(field, "must be in the \"owner/repo\" format")
+		return
+	}
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " \t\n?#%") {
+			errs.add(field, "must be in the \"owner/repo\" format")
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package conf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	valid := &Configuration{
+		JWT:       JWTConfiguration{Secret: "secret"},
+		GitHub:    GitHubConfig{Endpoint: "https://github.example.com/api/v3", Repo: "owner/repo"},
+		GitLab:    GitLabConfig{Repo: "group/subgroup/repo", AccessTokenType: GitLabTokenTypePersonalAccess},
+		BitBucket: BitBucketConfig{RefreshToken: "refresh", ClientID: "id", ClientSecret: "secret"},
+	}
+	assert.NoError(t, valid.Validate())
+
+	invalid := &Configuration{
+		JWT:          JWTConfiguration{JWKSURL: "jwks.json"},
+		GitHub:       GitHubConfig{Endpoint: "ftp://github.com", Repo: "owner/group/repo"},
+		GitLab:       GitLabConfig{Repo: "repo", AccessTokenType: "session"},
+		BitBucket:    BitBucketConfig{RefreshToken: "refresh"},
+		CommitAuthor: "nobody",
+	}
+	err := invalid.Validate()
+	require.Error(t, err)
+	errs, ok := err.(ValidationErrors)
+	require.True(t, ok, "expected ValidationErrors, got %T", err)
+
+	fields := []string{}
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{
+		"bitbucket.client_id",
+		"bitbucket.client_secret",
+		"commit_author",
+		"github.endpoint",
+		"github.repo",
+		"gitlab.access_token_type",
+		"gitlab.repo",
+		"jwt.jwks_url",
+	}, fields)
+}
+
+func TestValidateRequiresJWT(t *testing.T) {
+	err := (&Configuration{}).Validate()
+	require.Error(t, err)
+	assert.Equal(t, "jwt.secret", err.(ValidationErrors)[0].Field)
+}
+
+func TestValidateInstanceJWKS(t *testing.T) {
+	global := &GlobalConfiguration{}
+	assert.NoError(t, global.ValidateInstanceJWKS(&JWTConfiguration{Secret: "secret"}))
+	assert.Error(t, global.ValidateInstanceJWKS(&JWTConfiguration{JWKSURL: "https://identity.example.com/jwks.json"}), "no hosts are allowed by default")
+	assert.Error(t, global.ValidateInstanceJWKS(&JWTConfiguration{JWKSFile: "/etc/passwd"}))
+
+	global.JWKSAllowedHosts = []string{"identity.example.com"}
+	assert.Error(t, global.ValidateInstanceJWKS(&JWTConfiguration{JWKSURL: "http://identity.example.com/jwks.json"}))
+	assert.NoError(t, global.ValidateInstanceJWKS(&JWTConfiguration{JWKSURL: "https://Identity.example.com/jwks.json"}))
+	err := global.ValidateInstanceJWKS(&JWTConfiguration{JWKSURL: "https://internal.example.com/jwks.json"})
+	require.Error(t, err)
+	assert.Equal(t, "jwt.jwks_url", err.(ValidationErrors)[0].Field)
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// AuditEntry records a mutating request proxied to a git provider.
+type AuditEntry struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"instance_id" gorm:"index"`
+
+	// JWT subject and email of the editor
+	UserID string `json:"user_id" gorm:"index"`
+	Email  string `json:"email"`
+
+	Provider  string `json:"provider"`
+	Method    string `json:"method"`
+	Path      string `json:"path" gorm:"size:1024"`
+	Branch    string `json:"branch,omitempty"`
+	Status    int    `json:"status"`
+	CommitSHA string `json:"commit_sha,omitempty"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+// TableName returns the table name used for the AuditEntry model
+func (e *AuditEntry) TableName() string {
+	return tableName("audit_entries")
+}
+
+// AuditFilter restricts the audit entries returned by a query.
+type AuditFilter struct {
+	// User matches either the user ID or the email
+	User string
+	From time.Time
+	To   time.Time
+	// Path matches entries whose path starts with it
+	Path string
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encryptedPrefix marks secret values encrypted with the data key of their
+// instance.
+const encryptedPrefix = "enc:v1:"
+
+// Encryption holds the master keys used to encrypt instance secrets at rest.
+// When nil, secrets are stored in plain text.
+var Encryption *Keyring
+
+// Keyring holds the master keys by ID. Every instance gets its own data key,
+// which encrypts its secrets and is itself stored encrypted with the active
+// master key (envelope encryption).
+type Keyring struct {
+	keys   map[string][]byte
+	active string
+}
+
+// NewKeyring creates a keyring encrypting new data keys with the active key.
+func NewKeyring(keys map[string][]byte, active string) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("unknown encryption key id %q", active)
+	}
+	return &Keyring{keys: keys, active: active}, nil
+}
+
+// ActiveKeyID is the ID of the master key new data keys are encrypted with.
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// newDataKey generates a data key, returning it in the clear and wrapped
+// with the active master key as "<key id>:<ciphertext>".
+func (k *Keyring) newDataKey(aad string) ([]byte, string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, "", err
+	}
+	wrapped, err := seal(k.keys[k.active], key, aad)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, k.active + ":" + wrapped, nil
+}
+
+// unwrapDataKey decrypts a data key with the master key it names.
+func (k *Keyring) unwrapDataKey(wrapped string, aad string) ([]byte, error) {
+	parts := strings.SplitN(wrapped, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed data key")
+	}
+	master, ok := k.keys[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key id %q", parts[0])
+	}
+	return open(master, parts[1], aad)
+}
+
+// seal encrypts plaintext with AES-GCM, returning the base64 encoded nonce
+// and ciphertext. aad binds the ciphertext to where it's stored.
+func seal(key, plaintext []byte, aad string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, []byte(aad))
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func open(key []byte, sealed string, aad string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, []byte(aad))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
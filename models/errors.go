@@ -9,6 +9,8 @@ func IsNotFoundError(err error) bool {
 		return true
 	case InstanceNotFoundError:
 		return true
+	case InstanceRevisionNotFoundError:
+		return true
 	}
 	return false
 }
@@ -33,3 +35,40 @@ type InstanceNotFoundError struct{}
 func (e InstanceNotFoundError) Error() string {
 	return "Instance not found"
 }
+
+// InstanceRevisionNotFoundError represents when an instance revision is not found.
+type InstanceRevisionNotFoundError struct{}
+
+func (e InstanceRevisionNotFoundError) Error() string {
+	return "Instance revision not found"
+}
+
+// DuplicateInstanceUUIDError represents when another instance has the UUID
+// of an instance being created or restored.
+type DuplicateInstanceUUIDError struct{}
+
+func (e DuplicateInstanceUUIDError) Error() string {
+	return "An instance with that UUID already exists"
+}
+
+// IsDuplicateUUIDError returns whether an error represents a UUID already
+// taken by another instance.
+func IsDuplicateUUIDError(err error) bool {
+	_, ok := err.(DuplicateInstanceUUIDError)
+	return ok
+}
+
+// InstanceVersionConflictError represents when an instance was changed
+// since it was loaded.
+type InstanceVersionConflictError struct{}
+
+func (e InstanceVersionConflictError) Error() string {
+	return "Instance was modified concurrently"
+}
+
+// IsVersionConflictError returns whether an error represents a concurrent
+// modification.
+func IsVersionConflictError(err error) bool {
+	_, ok := err.(InstanceVersionConflictError)
+	return ok
+}
@@ -3,6 +3,9 @@ package models
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/netlify/git-gateway/conf"
@@ -10,6 +13,21 @@ import (
 
 const baseConfigKey = ""
 
+// Git providers an instance can be configured for.
+const (
+	ProviderGitHub    = "github"
+	ProviderGitLab    = "gitlab"
+	ProviderBitBucket = "bitbucket"
+)
+
+// Instance states. Suspended instances keep their configuration but don't
+// serve requests, deleted instances are purged after a retention period.
+const (
+	InstanceStateActive    = "active"
+	InstanceStateSuspended = "suspended"
+	InstanceStateDeleted   = "deleted"
+)
+
 type Instance struct {
 	ID string `json:"id" bson:"_id,omitempty"`
 	// Netlify UUID
@@ -18,6 +36,21 @@ type Instance struct {
 	// force usage of text column type
 	RawBaseConfig string              `json:"-" bson:"-" gorm:"size:65535"`
 	BaseConfig    *conf.Configuration `json:"config"`
+	// DataKey is the key the secrets in RawBaseConfig are encrypted with,
+	// itself encrypted with a master key. Empty when secrets are in plain text.
+	DataKey string `json:"-" bson:"-" gorm:"size:1024"`
+
+	// repos of the configured providers, copied from BaseConfig on save so
+	// instances can be searched
+	GitHubRepo    string `json:"-" bson:"-" gorm:"column:github_repo;index"`
+	GitLabRepo    string `json:"-" bson:"-" gorm:"column:gitlab_repo;index"`
+	BitBucketRepo string `json:"-" bson:"-" gorm:"column:bitbucket_repo;index"`
+
+	// Version is incremented by every update, guarding against concurrent
+	// modifications
+	Version int `json:"version" gorm:"not null;default:0"`
+
+	State string `json:"state" gorm:"size:32;not null;default:'active';index"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
@@ -37,13 +70,21 @@ func (i *Instance) AfterFind() error {
 			return err
 		}
 	}
-	return nil
+	return i.decryptSecrets()
 }
 
 // BeforeSave database callback.
 func (i *Instance) BeforeSave() error {
 	if i.BaseConfig != nil {
-		data, err := json.Marshal(i.BaseConfig)
+		i.GitHubRepo = i.BaseConfig.GitHub.Repo
+		i.GitLabRepo = i.BaseConfig.GitLab.Repo
+		i.BitBucketRepo = i.BaseConfig.BitBucket.Repo
+
+		config, err := i.encryptSecrets()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(config)
 		if err != nil {
 			return err
 		}
@@ -52,6 +93,107 @@ func (i *Instance) BeforeSave() error {
 	return nil
 }
 
+// ETag is the entity tag of the current version of the instance.
+func (i *Instance) ETag() string {
+	return strconv.Quote(strconv.Itoa(i.Version))
+}
+
+// InstanceFilter restricts the instances returned by a query.
+type InstanceFilter struct {
+	UUID string
+	// Provider matches instances configured for a git provider
+	Provider string
+	// Repo matches instances proxying the repo with any provider
+	Repo string
+	// State matches instances in a state, deleted instances are only found
+	// when asked for
+	State string
+}
+
+// KeyID returns the ID of the master key the secrets of the instance are
+// encrypted with, or an empty string when they are stored in plain text.
+func (i *Instance) KeyID() string {
+	if i.DataKey == "" {
+		return ""
+	}
+	return strings.SplitN(i.DataKey, ":", 2)[0]
+}
+
+// encryptSecrets returns a copy of the configuration with its secrets
+// encrypted with a new data key, or the configuration itself when
+// encryption is disabled.
+func (i *Instance) encryptSecrets() (*conf.Configuration, error) {
+	config, dataKey, err := encryptConfig(i.ID, i.BaseConfig)
+	if err != nil {
+		return nil, err
+	}
+	i.DataKey = dataKey
+	return config, nil
+}
+
+// decryptSecrets decrypts the secrets of the loaded configuration in place.
+func (i *Instance) decryptSecrets() error {
+	config, err := decryptConfig(i.ID, i.BaseConfig, i.DataKey)
+	if err != nil {
+		return err
+	}
+	i.BaseConfig = config
+	return nil
+}
+
+// encryptConfig encrypts the secrets of config with a new data key, bound
+// to the record id. It returns the encrypted copy and the wrapped data key,
+// or config itself and no key when encryption is disabled.
+func encryptConfig(id string, config *conf.Configuration) (*conf.Configuration, string, error) {
+	if Encryption == nil || config == nil {
+		return config, "", nil
+	}
+	key, wrapped, err := Encryption.newDataKey(id)
+	if err != nil {
+		return nil, "", err
+	}
+	encrypted, err := config.MapSecrets(func(path, value string) (string, error) {
+		if value == "" {
+			return value, nil
+		}
+		sealed, err := seal(key, []byte(value), id+"/"+path)
+		if err != nil {
+			return "", err
+		}
+		return encryptedPrefix + sealed, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return encrypted, wrapped, nil
+}
+
+// decryptConfig returns a copy of config with the secrets encrypted with
+// dataKey decrypted. Secrets stored before encryption was enabled are left
+// as they are.
+func decryptConfig(id string, config *conf.Configuration, dataKey string) (*conf.Configuration, error) {
+	if dataKey == "" || config == nil {
+		return config, nil
+	}
+	if Encryption == nil {
+		return nil, errors.New("secrets are encrypted but no encryption key is configured")
+	}
+	key, err := Encryption.unwrapDataKey(dataKey, id)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data key of %s: %v", id, err)
+	}
+	return config.MapSecrets(func(path, value string) (string, error) {
+		if !strings.HasPrefix(value, encryptedPrefix) {
+			return value, nil
+		}
+		plaintext, err := open(key, strings.TrimPrefix(value, encryptedPrefix), id+"/"+path)
+		if err != nil {
+			return "", fmt.Errorf("error decrypting %s of %s: %v", path, id, err)
+		}
+		return string(plaintext), nil
+	})
+}
+
 // Config loads the base configuration values with defaults.
 func (i *Instance) Config() (*conf.Configuration, error) {
 	if i.BaseConfig == nil {
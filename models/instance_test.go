@@ -0,0 +1,75 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, active string, ids ...string) *Keyring {
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id[:1]), conf.MasterKeySize)
+	}
+	k, err := NewKeyring(keys, active)
+	require.NoError(t, err)
+	return k
+}
+
+func TestInstanceSecretsEncryption(t *testing.T) {
+	defer func() { Encryption = nil }()
+	Encryption = testKeyring(t, "old", "old")
+
+	i := &Instance{ID: "instance-1", BaseConfig: &conf.Configuration{
+		GitHub:    conf.GitHubConfig{AccessToken: "github-token", Repo: "owner/repo"},
+		BitBucket: conf.BitBucketConfig{ClientSecret: "client-secret"},
+	}}
+	require.NoError(t, i.BeforeSave())
+	assert.NotContains(t, i.RawBaseConfig, "github-token")
+	assert.NotContains(t, i.RawBaseConfig, "client-secret")
+	assert.Contains(t, i.RawBaseConfig, "owner/repo")
+	assert.Equal(t, "old", i.KeyID())
+	assert.Equal(t, "github-token", i.BaseConfig.GitHub.AccessToken)
+
+	loaded := &Instance{ID: i.ID, RawBaseConfig: i.RawBaseConfig, DataKey: i.DataKey}
+	require.NoError(t, loaded.AfterFind())
+	assert.Equal(t, "github-token", loaded.BaseConfig.GitHub.AccessToken)
+	assert.Equal(t, "client-secret", loaded.BaseConfig.BitBucket.ClientSecret)
+
+	// rotate: the old key still decrypts, saving re-encrypts with the new one
+	Encryption = testKeyring(t, "new", "old", "new")
+	loaded = &Instance{ID: i.ID, RawBaseConfig: i.RawBaseConfig, DataKey: i.DataKey}
+	require.NoError(t, loaded.AfterFind())
+	require.NoError(t, loaded.BeforeSave())
+	assert.Equal(t, "new", loaded.KeyID())
+
+	Encryption = testKeyring(t, "new", "new")
+	rekeyed := &Instance{ID: i.ID, RawBaseConfig: loaded.RawBaseConfig, DataKey: loaded.DataKey}
+	require.NoError(t, rekeyed.AfterFind())
+	assert.Equal(t, "github-token", rekeyed.BaseConfig.GitHub.AccessToken)
+
+	// ciphertexts are bound to their instance
+	moved := &Instance{ID: "instance-2", RawBaseConfig: loaded.RawBaseConfig, DataKey: loaded.DataKey}
+	assert.Error(t, moved.AfterFind())
+
+	Encryption = nil
+	locked := &Instance{ID: i.ID, RawBaseConfig: loaded.RawBaseConfig, DataKey: loaded.DataKey}
+	assert.Error(t, locked.AfterFind())
+}
+
+func TestInstancePlaintextSecrets(t *testing.T) {
+	i := &Instance{ID: "instance-1", BaseConfig: &conf.Configuration{GitHub: conf.GitHubConfig{AccessToken: "github-token"}}}
+	require.NoError(t, i.BeforeSave())
+	assert.Contains(t, i.RawBaseConfig, "github-token")
+	assert.Empty(t, i.KeyID())
+
+	// plain text rows keep loading once encryption is enabled
+	defer func() { Encryption = nil }()
+	Encryption = testKeyring(t, "key", "key")
+	loaded := &Instance{ID: i.ID, RawBaseConfig: i.RawBaseConfig}
+	require.NoError(t, loaded.AfterFind())
+	assert.Equal(t, "github-token", loaded.BaseConfig.GitHub.AccessToken)
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// SchemaMigration records a schema migration applied to the database.
+type SchemaMigration struct {
+	Version   int       `json:"version" gorm:"primary_key;type:integer"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// TableName returns the table name used for the SchemaMigration model
+func (m *SchemaMigration) TableName() string {
+	return tableName("schema_migrations")
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/netlify/git-gateway/conf"
+)
+
+// InstanceRevision is a snapshot of the configuration of an instance, taken
+// every time it changes. Secrets are encrypted like the instance's own.
+type InstanceRevision struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"instance_id" gorm:"unique_index:idx_instance_revision"`
+	// Revision numbers the revisions of an instance from 1
+	Revision int `json:"revision" gorm:"unique_index:idx_instance_revision"`
+
+	RawBaseConfig string              `json:"-" gorm:"size:65535"`
+	BaseConfig    *conf.Configuration `json:"config" gorm:"-"`
+	DataKey       string              `json:"-" gorm:"size:1024"`
+
+	// ChangedBy names the operator credential that made the change
+	ChangedBy string `json:"changed_by"`
+	// RestoredFrom is set when the revision restored an earlier one
+	RestoredFrom int `json:"restored_from,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the table name used for the InstanceRevision model
+func (r *InstanceRevision) TableName() string {
+	return tableName("instance_revisions")
+}
+
+// AfterFind database callback.
+func (r *InstanceRevision) AfterFind() error {
+	if r.RawBaseConfig != "" {
+		if err := json.Unmarshal([]byte(r.RawBaseConfig), &r.BaseConfig); err != nil {
+			return err
+		}
+	}
+	config, err := decryptConfig(r.ID, r.BaseConfig, r.DataKey)
+	if err != nil {
+		return err
+	}
+	r.BaseConfig = config
+	return nil
+}
+
+// BeforeSave database callback.
+func (r *InstanceRevision) BeforeSave() error {
+	config, dataKey, err := encryptConfig(r.ID, r.BaseConfig)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	r.RawBaseConfig = string(data)
+	r.DataKey = dataKey
+	return nil
+}
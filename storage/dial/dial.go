@@ -1,22 +1,53 @@
 package dial
 
 import (
+	"net/url"
+	"strings"
+
 	"github.com/netlify/git-gateway/conf"
 	"github.com/netlify/git-gateway/models"
 	"github.com/netlify/git-gateway/storage"
-	"github.com/netlify/git-gateway/storage/sql"
+	"github.com/pkg/errors"
+
+	// register the storage backends
+	_ "github.com/netlify/git-gateway/storage/file"
+	_ "github.com/netlify/git-gateway/storage/memory"
+	_ "github.com/netlify/git-gateway/storage/sql"
 )
 
-// Dial will connect to that storage engine
+// Dial will connect to the storage backend registered for DB.Driver, or for
+// the scheme of DB.URL when no driver is set.
 func Dial(config *conf.GlobalConfiguration) (storage.Connection, error) {
 	if config.DB.Namespace != "" {
 		models.Namespace = config.DB.Namespace
 	}
 
-	var conn storage.Connection
-	var err error
-	conn, err = sql.Dial(config)
+	keys, keyID, err := config.Encryption.MasterKeys()
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		if models.Encryption, err = models.NewKeyring(keys, keyID); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.DB.Driver == "" && config.DB.URL != "" {
+		u, err := url.Parse(config.DB.URL)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing db connection url")
+		}
+		config.DB.Driver = u.Scheme
+	}
+	if config.DB.Driver == "" {
+		return nil, errors.New("a database driver or URL is required")
+	}
+	dialer, ok := storage.Lookup(config.DB.Driver)
+	if !ok {
+		return nil, errors.Errorf("unknown database driver %q, use one of %s", config.DB.Driver, strings.Join(storage.Drivers(), ", "))
+	}
 
+	conn, err := dialer(config)
 	if err != nil {
 		return nil, err
 	}
@@ -28,5 +59,5 @@ func Dial(config *conf.GlobalConfiguration) (storage.Connection, error) {
 		}
 	}
 
-	return conn, nil
+	return storage.WithMetrics(conn), nil
 }
@@ -0,0 +1,330 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/netlify/git-gateway/storage/memory"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	storage.Register("file", func(config *conf.GlobalConfiguration) (storage.Connection, error) {
+		return Dial(config)
+	})
+}
+
+// Connection is a storage.Connection persisting to a JSON file, for small
+// self-hosted deployments. Every call takes a lock on the file, so several
+// processes can share it, and reloads it when another process changed it.
+// Changes are written to a new file replacing the old one, so it's never
+// left half written. Audit entries are appended to a separate JSON lines
+// file instead, so recording a request doesn't rewrite the store.
+type Connection struct {
+	path      string
+	auditPath string
+	lock      *os.File
+
+	mu     sync.Mutex // guards mem and loaded
+	mem    *memory.Connection
+	loaded os.FileInfo
+}
+
+// Dial opens the file store at DB.URL, either a path or a file:// URL. The
+// file is created on the first change, audit entries are kept next to it
+// with an ".audit.jsonl" suffix.
+func Dial(config *conf.GlobalConfiguration) (*Connection, error) {
+	path := strings.TrimPrefix(config.DB.URL, "file://")
+	if path == "" {
+		return nil, errors.New("the file storage requires a path as database URL")
+	}
+
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening lock file")
+	}
+	conn := &Connection{path: path, auditPath: path + ".audit.jsonl", lock: lock, mem: memory.New()}
+	if err := conn.read(func(*memory.Connection) error { return nil }); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (conn *Connection) read(fn func(*memory.Connection) error) error {
+	return conn.do(false, fn)
+}
+
+func (conn *Connection) write(fn func(*memory.Connection) error) error {
+	return conn.do(true, fn)
+}
+
+// do runs fn against the current content of the file, saving it afterwards
+// when write is set.
+func (conn *Connection) do(write bool, fn func(*memory.Connection) error) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	unlock, err := lockFile(conn.lock, write)
+	if err != nil {
+		return errors.Wrap(err, "locking storage file")
+	}
+	defer unlock()
+
+	if err := conn.reload(); err != nil {
+		return err
+	}
+	if err := fn(conn.mem); err != nil {
+		return err
+	}
+	if write {
+		return conn.save()
+	}
+	return nil
+}
+
+// reload reads the file unless it's unchanged since it was last loaded.
+func (conn *Connection) reload() error {
+	info, err := os.Stat(conn.path)
+	if os.IsNotExist(err) {
+		if conn.loaded != nil {
+			conn.mem, conn.loaded = memory.New(), nil
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading storage file")
+	}
+	if conn.loaded != nil && os.SameFile(conn.loaded, info) &&
+		conn.loaded.ModTime().Equal(info.ModTime()) && conn.loaded.Size() == info.Size() {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(conn.path)
+	if err != nil {
+		return errors.Wrap(err, "reading storage file")
+	}
+	data := &memory.Data{}
+	if err := json.Unmarshal(content, data); err != nil {
+		return errors.Wrapf(err, "parsing storage file %s", conn.path)
+	}
+	conn.mem, conn.loaded = memory.NewWithData(data), info
+	return nil
+}
+
+// save replaces the file with the content of the store.
+func (conn *Connection) save() error {
+	// whatever happens, the next call reloads the file
+	conn.loaded = nil
+
+	content, err := json.MarshalIndent(conn.mem.Data(), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding storage file")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(conn.path), filepath.Base(conn.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "writing storage file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing storage file")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing storage file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "writing storage file")
+	}
+	if err := os.Rename(tmp.Name(), conn.path); err != nil {
+		return errors.Wrap(err, "replacing storage file")
+	}
+
+	info, err := os.Stat(conn.path)
+	if err != nil {
+		return errors.Wrap(err, "reading storage file")
+	}
+	conn.loaded = info
+	return nil
+}
+
+// Automigrate has nothing to migrate.
+func (conn *Connection) Automigrate() error {
+	return nil
+}
+
+// Close releases the lock file.
+func (conn *Connection) Close() error {
+	return conn.lock.Close()
+}
+
+func (conn *Connection) GetInstance(instanceID string) (i *models.Instance, err error) {
+	err = conn.read(func(m *memory.Connection) error {
+		i, err = m.GetInstance(instanceID)
+		return err
+	})
+	return i, err
+}
+
+func (conn *Connection) GetInstanceByUUID(uuid string) (i *models.Instance, err error) {
+	err = conn.read(func(m *memory.Connection) error {
+		i, err = m.GetInstanceByUUID(uuid)
+		return err
+	})
+	return i, err
+}
+
+func (conn *Connection) FindInstances(filter *models.InstanceFilter, sort *models.SortParams, pagination *models.Pagination) (instances []*models.Instance, err error) {
+	err = conn.read(func(m *memory.Connection) error {
+		instances, err = m.FindInstances(filter, sort, pagination)
+		return err
+	})
+	return instances, err
+}
+
+func (conn *Connection) CreateInstance(instance *models.Instance) error {
+	return conn.write(func(m *memory.Connection) error {
+		return m.CreateInstance(instance)
+	})
+}
+
+func (conn *Connection) RekeyInstance(instance *models.Instance) error {
+	return conn.write(func(m *memory.Connection) error {
+		return m.RekeyInstance(instance)
+	})
+}
+
+func (conn *Connection) UpdateInstance(instance *models.Instance) error {
+	version := instance.Version
+	err := conn.write(func(m *memory.Connection) error {
+		return m.UpdateInstance(instance)
+	})
+	if err != nil {
+		instance.Version = version
+	}
+	return err
+}
+
+func (conn *Connection) DeleteInstance(instance *models.Instance) error {
+	return conn.write(func(m *memory.Connection) error {
+		return m.DeleteInstance(instance)
+	})
+}
+
+func (conn *Connection) PurgeInstances(deletedBefore time.Time) (n int64, err error) {
+	err = conn.write(func(m *memory.Connection) error {
+		n, err = m.PurgeInstances(deletedBefore)
+		return err
+	})
+	return n, err
+}
+
+func (conn *Connection) CreateInstanceRevision(revision *models.InstanceRevision) error {
+	return conn.write(func(m *memory.Connection) error {
+		return m.CreateInstanceRevision(revision)
+	})
+}
+
+func (conn *Connection) UpdateInstanceRevision(revision *models.InstanceRevision) error {
+	return conn.write(func(m *memory.Connection) error {
+		return m.UpdateInstanceRevision(revision)
+	})
+}
+
+func (conn *Connection) GetInstanceRevision(instanceID string, revision int) (r *models.InstanceRevision, err error) {
+	err = conn.read(func(m *memory.Connection) error {
+		r, err = m.GetInstanceRevision(instanceID, revision)
+		return err
+	})
+	return r, err
+}
+
+func (conn *Connection) FindInstanceRevisions(instanceID string, pagination *models.Pagination) (revisions []*models.InstanceRevision, err error) {
+	err = conn.read(func(m *memory.Connection) error {
+		revisions, err = m.FindInstanceRevisions(instanceID, pagination)
+		return err
+	})
+	return revisions, err
+}
+
+// CreateAuditEntry appends the entry to the audit file.
+func (conn *Connection) CreateAuditEntry(entry *models.AuditEntry) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	unlock, err := lockFile(conn.lock, true)
+	if err != nil {
+		return errors.Wrap(err, "locking storage file")
+	}
+	defer unlock()
+
+	entry.CreatedAt = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "encoding audit entry")
+	}
+	f, err := os.OpenFile(conn.auditPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening audit file")
+	}
+	// end a line left incomplete by a crash, so it doesn't swallow this one
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing audit file")
+	}
+	return errors.Wrap(f.Close(), "writing audit file")
+}
+
+// FindAuditEntries reads the audit file.
+func (conn *Connection) FindAuditEntries(instanceID string, filter *models.AuditFilter, pagination *models.Pagination) (entries []*models.AuditEntry, err error) {
+	err = conn.read(func(*memory.Connection) error {
+		all, err := conn.readAuditEntries()
+		if err != nil {
+			return err
+		}
+		entries, err = memory.NewWithData(&memory.Data{AuditEntries: all}).FindAuditEntries(instanceID, filter, pagination)
+		return err
+	})
+	return entries, err
+}
+
+// readAuditEntries decodes the audit file. A line left incomplete by a crash
+// is skipped.
+func (conn *Connection) readAuditEntries() ([]*models.AuditEntry, error) {
+	content, err := ioutil.ReadFile(conn.auditPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading audit file")
+	}
+
+	entries := []*models.AuditEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		entry := &models.AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errors.Wrap(scanner.Err(), "reading audit file")
+}
@@ -0,0 +1,126 @@
+package file
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestFileTestSuite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-gateway-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := &conf.GlobalConfiguration{DB: conf.DBConfiguration{Driver: "file", URL: filepath.Join(dir, "gateway.json")}}
+
+	conn, err := Dial(config)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	suite.Run(t, &test.StorageTestSuite{
+		C: conn,
+		// the connection starts over when the file is gone
+		BeforeTest: func() {
+			require.NoError(t, os.RemoveAll(config.DB.URL))
+			require.NoError(t, os.RemoveAll(config.DB.URL+".audit.jsonl"))
+		},
+	})
+}
+
+func TestFileStorageSharedByConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-gateway-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := &conf.GlobalConfiguration{DB: conf.DBConfiguration{Driver: "file", URL: filepath.Join(dir, "gateway.json")}}
+
+	first, err := Dial(config)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := Dial(config)
+	require.NoError(t, err)
+	defer second.Close()
+
+	instance := &models.Instance{ID: "instance-1", UUID: "uuid-1", BaseConfig: &conf.Configuration{
+		GitHub: conf.GitHubConfig{AccessToken: "github-token", Repo: "owner/repo"},
+	}}
+	require.NoError(t, first.CreateInstance(instance))
+
+	// the second connection sees changes made through the first
+	loaded, err := second.GetInstance("instance-1")
+	require.NoError(t, err)
+	assert.Equal(t, "github-token", loaded.BaseConfig.GitHub.AccessToken)
+	require.NoError(t, second.UpdateInstance(loaded))
+
+	// and the first one rejects its stale copy
+	err = first.UpdateInstance(instance)
+	assert.True(t, models.IsVersionConflictError(err), "expected a version conflict, got %v", err)
+	assert.Equal(t, 1, instance.Version)
+
+	// the store survives reopening
+	third, err := Dial(config)
+	require.NoError(t, err)
+	defer third.Close()
+	loaded, err = third.GetInstanceByUUID("uuid-1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, loaded.Version)
+	assert.Equal(t, "owner/repo", loaded.BaseConfig.GitHub.Repo)
+
+	info, err := os.Stat(config.DB.URL)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the file holds secrets")
+}
+
+func TestFileStorageAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-gateway-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := &conf.GlobalConfiguration{DB: conf.DBConfiguration{Driver: "file", URL: filepath.Join(dir, "gateway.json")}}
+
+	conn, err := Dial(config)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.CreateInstance(&models.Instance{ID: "instance-1", BaseConfig: &conf.Configuration{}}))
+	store, err := os.Stat(config.DB.URL)
+	require.NoError(t, err)
+
+	for _, path := range []string{"/github/contents/a.md", "/github/contents/b.md"} {
+		require.NoError(t, conn.CreateAuditEntry(&models.AuditEntry{ID: path, InstanceID: "instance-1", Path: path}))
+	}
+
+	// the store file isn't rewritten
+	info, err := os.Stat(config.DB.URL)
+	require.NoError(t, err)
+	assert.Equal(t, store.ModTime(), info.ModTime())
+	assert.Equal(t, store.Size(), info.Size())
+
+	content, err := ioutil.ReadFile(config.DB.URL + ".audit.jsonl")
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(content, []byte("\n")))
+	info, err = os.Stat(config.DB.URL + ".audit.jsonl")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// a line cut short by a crash is skipped
+	f, err := os.OpenFile(config.DB.URL+".audit.jsonl", os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(`{"id":"partial","instance_id":"inst`))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, conn.CreateAuditEntry(&models.AuditEntry{ID: "after", InstanceID: "instance-1", Path: "/github/contents/c.md"}))
+
+	entries, err := conn.FindAuditEntries("instance-1", &models.AuditFilter{Path: "/github/contents/b"}, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "/github/contents/b.md", entries[0].Path)
+	entries, err = conn.FindAuditEntries("instance-1", nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
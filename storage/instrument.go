@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/netlify/git-gateway/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var tracer = otel.Tracer("github.com/netlify/git-gateway/storage")
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "git_gateway",
+	Subsystem: "db",
+	Name:      "query_duration_seconds",
+	Help:      "Latency of storage calls.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"operation", "error"})
+
+// instrumentedConnection records the latency of every storage call, and
+// traces it as part of the request in ctx.
+type instrumentedConnection struct {
+	Connection
+	ctx context.Context
+}
+
+// WithMetrics wraps conn so the latency of its calls is exported as metrics.
+func WithMetrics(conn Connection) Connection {
+	return &instrumentedConnection{Connection: conn, ctx: context.Background()}
+}
+
+// WithContext returns conn tracing its calls as spans of the trace in ctx.
+// Connections that aren't instrumented are returned as they are.
+func WithContext(ctx context.Context, conn Connection) Connection {
+	if c, ok := conn.(*instrumentedConnection); ok {
+		return &instrumentedConnection{Connection: c.Connection, ctx: ctx}
+	}
+	return conn
+}
+
+// observe starts the span of a call. The returned function is deferred with
+// a pointer to the named error result, so it sees the error returned by the
+// call.
+func (c *instrumentedConnection) observe(operation string) func(err *error) {
+	start := time.Now()
+	_, span := tracer.Start(c.ctx, "storage."+operation)
+	return func(err *error) {
+		failed := "false"
+		if *err != nil && !models.IsNotFoundError(*err) {
+			failed = "true"
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+		queryDuration.WithLabelValues(operation, failed).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (c *instrumentedConnection) GetInstanceByUUID(uuid string) (i *models.Instance, err error) {
+	defer c.observe("get_instance_by_uuid")(&err)
+	return c.Connection.GetInstanceByUUID(uuid)
+}
+
+func (c *instrumentedConnection) GetInstance(instanceID string) (i *models.Instance, err error) {
+	defer c.observe("get_instance")(&err)
+	return c.Connection.GetInstance(instanceID)
+}
+
+func (c *instrumentedConnection) FindInstances(filter *models.InstanceFilter, sort *models.SortParams, pagination *models.Pagination) (instances []*models.Instance, err error) {
+	defer c.observe("find_instances")(&err)
+	return c.Connection.FindInstances(filter, sort, pagination)
+}
+
+func (c *instrumentedConnection) CreateInstance(instance *models.Instance) (err error) {
+	defer c.observe("create_instance")(&err)
+	return c.Connection.CreateInstance(instance)
+}
+
+func (c *instrumentedConnection) DeleteInstance(instance *models.Instance) (err error) {
+	defer c.observe("delete_instance")(&err)
+	return c.Connection.DeleteInstance(instance)
+}
+
+func (c *instrumentedConnection) UpdateInstance(instance *models.Instance) (err error) {
+	defer c.observe("update_instance")(&err)
+	return c.Connection.UpdateInstance(instance)
+}
+
+func (c *instrumentedConnection) RekeyInstance(instance *models.Instance) (err error) {
+	defer c.observe("rekey_instance")(&err)
+	return c.Connection.RekeyInstance(instance)
+}
+
+func (c *instrumentedConnection) PurgeInstances(deletedBefore time.Time) (n int64, err error) {
+	defer c.observe("purge_instances")(&err)
+	return c.Connection.PurgeInstances(deletedBefore)
+}
+
+func (c *instrumentedConnection) CreateInstanceRevision(revision *models.InstanceRevision) (err error) {
+	defer c.observe("create_instance_revision")(&err)
+	return c.Connection.CreateInstanceRevision(revision)
+}
+
+func (c *instrumentedConnection) UpdateInstanceRevision(revision *models.InstanceRevision) (err error) {
+	defer c.observe("update_instance_revision")(&err)
+	return c.Connection.UpdateInstanceRevision(revision)
+}
+
+func (c *instrumentedConnection) GetInstanceRevision(instanceID string, revision int) (r *models.InstanceRevision, err error) {
+	defer c.observe("get_instance_revision")(&err)
+	return c.Connection.GetInstanceRevision(instanceID, revision)
+}
+
+func (c *instrumentedConnection) FindInstanceRevisions(instanceID string, pagination *models.Pagination) (revisions []*models.InstanceRevision, err error) {
+	defer c.observe("find_instance_revisions")(&err)
+	return c.Connection.FindInstanceRevisions(instanceID, pagination)
+}
+
+func (c *instrumentedConnection) CreateAuditEntry(entry *models.AuditEntry) (err error) {
+	defer c.observe("create_audit_entry")(&err)
+	return c.Connection.CreateAuditEntry(entry)
+}
+
+func (c *instrumentedConnection) FindAuditEntries(instanceID string, filter *models.AuditFilter, pagination *models.Pagination) (entries []*models.AuditEntry, err error) {
+	defer c.observe("find_audit_entries")(&err)
+	return c.Connection.FindAuditEntries(instanceID, filter, pagination)
+}
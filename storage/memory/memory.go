@@ -0,0 +1,456 @@
+package memory
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	storage.Register("memory", func(config *conf.GlobalConfiguration) (storage.Connection, error) {
+		limit := config.DB.AuditLimit
+		if limit <= 0 {
+			limit = DefaultAuditLimit
+		}
+		return NewWithAuditLimit(limit), nil
+	})
+}
+
+// DefaultAuditLimit is the number of audit entries New keeps.
+const DefaultAuditLimit = 10000
+
+// Connection is a storage.Connection keeping everything in memory, for
+// tests and single instance mode. Nothing survives a restart.
+type Connection struct {
+	mu         sync.RWMutex
+	data       *Data
+	auditLimit int
+}
+
+// New creates an empty store keeping the latest DefaultAuditLimit audit
+// entries.
+func New() *Connection {
+	return NewWithAuditLimit(DefaultAuditLimit)
+}
+
+// NewWithAuditLimit creates an empty store keeping the latest limit audit
+// entries, dropping the oldest ones first.
+func NewWithAuditLimit(limit int) *Connection {
+	conn := NewWithData(&Data{})
+	conn.auditLimit = limit
+	return conn
+}
+
+// NewWithData creates a store holding data. Its audit entries aren't
+// limited.
+func NewWithData(data *Data) *Connection {
+	return &Connection{data: data}
+}
+
+// Data returns the content of the store. It must not be modified.
+func (conn *Connection) Data() *Data {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.data
+}
+
+// Automigrate has nothing to migrate.
+func (conn *Connection) Automigrate() error {
+	return nil
+}
+
+// Close releases nothing.
+func (conn *Connection) Close() error {
+	return nil
+}
+
+func (conn *Connection) findInstance(instanceID string) (int, *InstanceRecord) {
+	for idx, r := range conn.data.Instances {
+		if r.ID == instanceID {
+			return idx, r
+		}
+	}
+	return -1, nil
+}
+
+// GetInstance finds an instance by ID, deleted instances included.
+func (conn *Connection) GetInstance(instanceID string) (*models.Instance, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	if _, r := conn.findInstance(instanceID); r != nil {
+		return r.instance()
+	}
+	return nil, models.InstanceNotFoundError{}
+}
+
+// GetInstanceByUUID finds an instance by its Netlify UUID.
+func (conn *Connection) GetInstanceByUUID(uuid string) (*models.Instance, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	for _, r := range conn.data.Instances {
+		if r.UUID == uuid && r.DeletedAt == nil {
+			return r.instance()
+		}
+	}
+	return nil, models.InstanceNotFoundError{}
+}
+
+// FindInstances finds the instances matching filter, ordered by the sort
+// fields and then by ID. Deleted instances are only found when filtering on
+// their state.
+func (conn *Connection) FindInstances(filter *models.InstanceFilter, sortParams *models.SortParams, pagination *models.Pagination) ([]*models.Instance, error) {
+	if filter == nil {
+		filter = &models.InstanceFilter{}
+	}
+	var hasRepo func(r *InstanceRecord) bool
+	switch filter.Provider {
+	case models.ProviderGitHub:
+		hasRepo = func(r *InstanceRecord) bool { return r.GitHubRepo != "" }
+	case models.ProviderGitLab:
+		hasRepo = func(r *InstanceRecord) bool { return r.GitLabRepo != "" }
+	case models.ProviderBitBucket:
+		hasRepo = func(r *InstanceRecord) bool { return r.BitBucketRepo != "" }
+	case "":
+		hasRepo = func(r *InstanceRecord) bool { return true }
+	default:
+		return nil, errors.Errorf("unknown provider %q", filter.Provider)
+	}
+	fields := []models.SortField{}
+	if sortParams != nil {
+		for _, field := range sortParams.Fields {
+			switch field.Name {
+			case "created_at", "updated_at":
+			default:
+				return nil, errors.Errorf("unknown sort field %q", field.Name)
+			}
+			fields = append(fields, field)
+		}
+	}
+
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+
+	records := []*InstanceRecord{}
+	for _, r := range conn.data.Instances {
+		if filter.State != "" && r.State != filter.State || filter.State == "" && r.DeletedAt != nil {
+			continue
+		}
+		if filter.UUID != "" && r.UUID != filter.UUID || !hasRepo(r) {
+			continue
+		}
+		if filter.Repo != "" && r.GitHubRepo != filter.Repo && r.GitLabRepo != filter.Repo && r.BitBucketRepo != filter.Repo {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, field := range fields {
+			a, b := records[i].CreatedAt, records[j].CreatedAt
+			if field.Name == "updated_at" {
+				a, b = records[i].UpdatedAt, records[j].UpdatedAt
+			}
+			if a.Equal(b) {
+				continue
+			}
+			if field.Dir == models.Descending {
+				return a.After(b)
+			}
+			return a.Before(b)
+		}
+		return records[i].ID < records[j].ID
+	})
+
+	start, end := paginate(len(records), pagination)
+	instances := make([]*models.Instance, 0, end-start)
+	for _, r := range records[start:end] {
+		i, err := r.instance()
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+// CreateInstance stores a new instance. Its UUID may not be used by another
+// instance that isn't deleted.
+func (conn *Connection) CreateInstance(instance *models.Instance) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if _, r := conn.findInstance(instance.ID); r != nil {
+		return errors.Errorf("Error creating instance: duplicate id %q", instance.ID)
+	}
+	for _, r := range conn.data.Instances {
+		if instance.UUID != "" && r.UUID == instance.UUID && r.DeletedAt == nil {
+			return models.DuplicateInstanceUUIDError{}
+		}
+	}
+	if instance.Version == 0 {
+		instance.Version = 1
+	}
+	if instance.State == "" {
+		instance.State = models.InstanceStateActive
+	}
+	now := time.Now()
+	instance.CreatedAt, instance.UpdatedAt = now, now
+
+	r, err := newInstanceRecord(instance)
+	if err != nil {
+		return errors.Wrap(err, "Error creating instance")
+	}
+	conn.data.Instances = append(conn.data.Instances, r)
+	return nil
+}
+
+// UpdateInstance saves the instance if it's still at the version it was
+// loaded at, and increments its version. Otherwise an
+// InstanceVersionConflictError is returned. An instance that isn't deleted
+// may not take the UUID of another one that isn't.
+func (conn *Connection) UpdateInstance(instance *models.Instance) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	idx, stored := conn.findInstance(instance.ID)
+	if stored == nil || stored.Version != instance.Version {
+		return models.InstanceVersionConflictError{}
+	}
+	if instance.UUID != "" && instance.DeletedAt == nil {
+		for _, r := range conn.data.Instances {
+			if r.ID != instance.ID && r.UUID == instance.UUID && r.DeletedAt == nil {
+				return models.DuplicateInstanceUUIDError{}
+			}
+		}
+	}
+
+	instance.Version++
+	instance.UpdatedAt = time.Now()
+	r, err := newInstanceRecord(instance)
+	if err != nil {
+		instance.Version--
+		return errors.Wrap(err, "Error updating instance record")
+	}
+	conn.data.Instances[idx] = r
+	return nil
+}
+
+// RekeyInstance saves the configuration of an instance again, encrypting its
+// secrets with the active key. Its version and timestamps are left unchanged,
+// so the instance's ETag stays valid. An instance changed since it was read
+// fails with a version conflict.
+func (conn *Connection) RekeyInstance(instance *models.Instance) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	idx, stored := conn.findInstance(instance.ID)
+	if stored == nil || stored.Version != instance.Version {
+		return models.InstanceVersionConflictError{}
+	}
+	if err := instance.BeforeSave(); err != nil {
+		return errors.Wrap(err, "Error rekeying instance record")
+	}
+	r := *stored
+	r.RawBaseConfig, r.DataKey = instance.RawBaseConfig, instance.DataKey
+	conn.data.Instances[idx] = &r
+	return nil
+}
+
+// DeleteInstance marks the instance deleted. It's kept until purged.
+func (conn *Connection) DeleteInstance(instance *models.Instance) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	now := time.Now()
+	if _, r := conn.findInstance(instance.ID); r != nil {
+		r.State = models.InstanceStateDeleted
+		r.DeletedAt = copyTime(&now)
+	}
+	instance.State = models.InstanceStateDeleted
+	instance.DeletedAt = &now
+	return nil
+}
+
+// PurgeInstances removes the instances deleted before a time for good,
+// along with their revisions. Audit entries are kept.
+func (conn *Connection) PurgeInstances(deletedBefore time.Time) (int64, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	purged := map[string]bool{}
+	instances := conn.data.Instances[:0:0]
+	for _, r := range conn.data.Instances {
+		if r.State == models.InstanceStateDeleted && r.DeletedAt != nil && r.DeletedAt.Before(deletedBefore) {
+			purged[r.ID] = true
+			continue
+		}
+		instances = append(instances, r)
+	}
+	revisions := conn.data.Revisions[:0:0]
+	for _, r := range conn.data.Revisions {
+		if !purged[r.InstanceID] {
+			revisions = append(revisions, r)
+		}
+	}
+	conn.data.Instances, conn.data.Revisions = instances, revisions
+	return int64(len(purged)), nil
+}
+
+// CreateInstanceRevision stores a new revision, numbered after the latest
+// revision of its instance.
+func (conn *Connection) CreateInstanceRevision(revision *models.InstanceRevision) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	latest := 0
+	for _, r := range conn.data.Revisions {
+		if r.InstanceID == revision.InstanceID && r.Revision > latest {
+			latest = r.Revision
+		}
+	}
+	revision.Revision = latest + 1
+	revision.CreatedAt = time.Now()
+
+	r, err := newRevisionRecord(revision)
+	if err != nil {
+		return errors.Wrap(err, "Error creating instance revision")
+	}
+	conn.data.Revisions = append(conn.data.Revisions, r)
+	return nil
+}
+
+// UpdateInstanceRevision saves the configuration of a stored revision again,
+// encrypting its secrets with the active key. Its number and metadata are
+// left unchanged.
+func (conn *Connection) UpdateInstanceRevision(revision *models.InstanceRevision) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	for idx, stored := range conn.data.Revisions {
+		if stored.ID != revision.ID {
+			continue
+		}
+		if err := revision.BeforeSave(); err != nil {
+			return errors.Wrap(err, "Error updating instance revision")
+		}
+		r := *stored
+		r.RawBaseConfig, r.DataKey = revision.RawBaseConfig, revision.DataKey
+		conn.data.Revisions[idx] = &r
+		return nil
+	}
+	return models.InstanceRevisionNotFoundError{}
+}
+
+// GetInstanceRevision finds a revision of an instance by its number.
+func (conn *Connection) GetInstanceRevision(instanceID string, revision int) (*models.InstanceRevision, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	for _, r := range conn.data.Revisions {
+		if r.InstanceID == instanceID && r.Revision == revision {
+			return r.revision()
+		}
+	}
+	return nil, models.InstanceRevisionNotFoundError{}
+}
+
+// FindInstanceRevisions finds the revisions of an instance, newest first.
+func (conn *Connection) FindInstanceRevisions(instanceID string, pagination *models.Pagination) ([]*models.InstanceRevision, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+
+	records := []*RevisionRecord{}
+	for _, r := range conn.data.Revisions {
+		if r.InstanceID == instanceID {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Revision > records[j].Revision })
+
+	start, end := paginate(len(records), pagination)
+	revisions := make([]*models.InstanceRevision, 0, end-start)
+	for _, r := range records[start:end] {
+		revision, err := r.revision()
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+// CreateAuditEntry stores a new audit entry. Once the audit limit of the
+// store is reached, the oldest entry is dropped.
+func (conn *Connection) CreateAuditEntry(entry *models.AuditEntry) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	entry.CreatedAt = time.Now()
+	stored := *entry
+	entries := append(conn.data.AuditEntries, &stored)
+	if drop := len(entries) - conn.auditLimit; conn.auditLimit > 0 && drop > 0 {
+		// the array is reallocated when append grows the slice again, the
+		// dropped entries are cleared so they're released meanwhile
+		for n := 0; n < drop; n++ {
+			entries[n] = nil
+		}
+		entries = entries[drop:]
+	}
+	conn.data.AuditEntries = entries
+	return nil
+}
+
+// FindAuditEntries finds the audit entries of an instance, newest first.
+func (conn *Connection) FindAuditEntries(instanceID string, filter *models.AuditFilter, pagination *models.Pagination) ([]*models.AuditEntry, error) {
+	if filter == nil {
+		filter = &models.AuditFilter{}
+	}
+
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+
+	entries := []*models.AuditEntry{}
+	for _, e := range conn.data.AuditEntries {
+		if e.InstanceID != instanceID {
+			continue
+		}
+		if filter.User != "" && e.UserID != filter.User && e.Email != filter.User {
+			continue
+		}
+		if !filter.From.IsZero() && e.CreatedAt.Before(filter.From) || !filter.To.IsZero() && e.CreatedAt.After(filter.To) {
+			continue
+		}
+		if !strings.HasPrefix(e.Path, filter.Path) {
+			continue
+		}
+		entry := *e
+		entries = append(entries, &entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+
+	start, end := paginate(len(entries), pagination)
+	return entries[start:end], nil
+}
+
+// paginate returns the bounds of the page of n results, and sets the count
+// of the pagination.
+func paginate(n int, pagination *models.Pagination) (int, int) {
+	if pagination == nil {
+		return 0, n
+	}
+	pagination.Count = uint64(n)
+	start := pagination.Offset()
+	if start > uint64(n) {
+		return n, n
+	}
+	end := start + pagination.PerPage
+	if end > uint64(n) {
+		end = uint64(n)
+	}
+	return int(start), int(end)
+}
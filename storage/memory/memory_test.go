@@ -0,0 +1,34 @@
+package memory
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestMemoryTestSuite(t *testing.T) {
+	s := &test.StorageTestSuite{}
+	s.BeforeTest = func() { s.C = New() }
+	suite.Run(t, s)
+}
+
+func TestAuditLimit(t *testing.T) {
+	conn := NewWithAuditLimit(3)
+	for n := 1; n <= 5; n++ {
+		require.NoError(t, conn.CreateAuditEntry(&models.AuditEntry{ID: fmt.Sprint(n), InstanceID: "instance"}))
+	}
+
+	entries, err := conn.FindAuditEntries("instance", nil, nil)
+	require.NoError(t, err)
+	ids := []string{}
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	assert.ElementsMatch(t, []string{"3", "4", "5"}, ids, "the oldest entries are dropped")
+	assert.Len(t, conn.Data().AuditEntries, 3)
+}
@@ -0,0 +1,128 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/netlify/git-gateway/models"
+)
+
+// Data is the content of a store. Instances and revisions are kept the way
+// the SQL backend stores them: their configuration is encoded, and its
+// secrets encrypted, by the model callbacks.
+type Data struct {
+	Instances    []*InstanceRecord    `json:"instances"`
+	Revisions    []*RevisionRecord    `json:"revisions"`
+	AuditEntries []*models.AuditEntry `json:"audit_entries"`
+}
+
+// InstanceRecord is a stored instance.
+type InstanceRecord struct {
+	ID            string     `json:"id"`
+	UUID          string     `json:"uuid"`
+	RawBaseConfig string     `json:"raw_base_config"`
+	DataKey       string     `json:"data_key,omitempty"`
+	GitHubRepo    string     `json:"github_repo,omitempty"`
+	GitLabRepo    string     `json:"gitlab_repo,omitempty"`
+	BitBucketRepo string     `json:"bitbucket_repo,omitempty"`
+	Version       int        `json:"version"`
+	State         string     `json:"state"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+func newInstanceRecord(i *models.Instance) (*InstanceRecord, error) {
+	if err := i.BeforeSave(); err != nil {
+		return nil, err
+	}
+	return &InstanceRecord{
+		ID:            i.ID,
+		UUID:          i.UUID,
+		RawBaseConfig: i.RawBaseConfig,
+		DataKey:       i.DataKey,
+		GitHubRepo:    i.GitHubRepo,
+		GitLabRepo:    i.GitLabRepo,
+		BitBucketRepo: i.BitBucketRepo,
+		Version:       i.Version,
+		State:         i.State,
+		CreatedAt:     i.CreatedAt,
+		UpdatedAt:     i.UpdatedAt,
+		DeletedAt:     copyTime(i.DeletedAt),
+	}, nil
+}
+
+// instance decodes a copy of the stored instance.
+func (r *InstanceRecord) instance() (*models.Instance, error) {
+	i := &models.Instance{
+		ID:            r.ID,
+		UUID:          r.UUID,
+		RawBaseConfig: r.RawBaseConfig,
+		DataKey:       r.DataKey,
+		GitHubRepo:    r.GitHubRepo,
+		GitLabRepo:    r.GitLabRepo,
+		BitBucketRepo: r.BitBucketRepo,
+		Version:       r.Version,
+		State:         r.State,
+		CreatedAt:     r.CreatedAt,
+		UpdatedAt:     r.UpdatedAt,
+		DeletedAt:     copyTime(r.DeletedAt),
+	}
+	if err := i.AfterFind(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// RevisionRecord is a stored instance revision.
+type RevisionRecord struct {
+	ID            string    `json:"id"`
+	InstanceID    string    `json:"instance_id"`
+	Revision      int       `json:"revision"`
+	RawBaseConfig string    `json:"raw_base_config"`
+	DataKey       string    `json:"data_key,omitempty"`
+	ChangedBy     string    `json:"changed_by"`
+	RestoredFrom  int       `json:"restored_from,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func newRevisionRecord(r *models.InstanceRevision) (*RevisionRecord, error) {
+	if err := r.BeforeSave(); err != nil {
+		return nil, err
+	}
+	return &RevisionRecord{
+		ID:            r.ID,
+		InstanceID:    r.InstanceID,
+		Revision:      r.Revision,
+		RawBaseConfig: r.RawBaseConfig,
+		DataKey:       r.DataKey,
+		ChangedBy:     r.ChangedBy,
+		RestoredFrom:  r.RestoredFrom,
+		CreatedAt:     r.CreatedAt,
+	}, nil
+}
+
+// revision decodes a copy of the stored revision.
+func (r *RevisionRecord) revision() (*models.InstanceRevision, error) {
+	revision := &models.InstanceRevision{
+		ID:            r.ID,
+		InstanceID:    r.InstanceID,
+		Revision:      r.Revision,
+		RawBaseConfig: r.RawBaseConfig,
+		DataKey:       r.DataKey,
+		ChangedBy:     r.ChangedBy,
+		RestoredFrom:  r.RestoredFrom,
+		CreatedAt:     r.CreatedAt,
+	}
+	if err := revision.AfterFind(); err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
@@ -0,0 +1,30 @@
+package storage
+
+import "time"
+
+// Migrator is implemented by the backends with a versioned schema.
+type Migrator interface {
+	// MigrateTo applies or reverts migrations until the schema is at a
+	// version, 0 reverting them all.
+	MigrateTo(version int) error
+	// Migrations lists every known migration, oldest first.
+	Migrations() ([]MigrationStatus, error)
+}
+
+// MigrationStatus describes a schema migration.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is nil while the migration is pending
+	AppliedAt *time.Time
+}
+
+// AsMigrator returns the migrator of a connection, or false when its backend
+// has no schema to migrate.
+func AsMigrator(conn Connection) (Migrator, bool) {
+	if c, ok := conn.(*instrumentedConnection); ok {
+		conn = c.Connection
+	}
+	m, ok := conn.(Migrator)
+	return m, ok
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/netlify/git-gateway/conf"
+)
+
+// Dialer opens a connection to a storage backend.
+type Dialer func(config *conf.GlobalConfiguration) (Connection, error)
+
+var (
+	dialersMu sync.RWMutex
+	dialers   = map[string]Dialer{}
+)
+
+// Register makes a backend available under a DB.Driver name. Backends
+// register themselves from the init function of their package.
+func Register(driver string, dialer Dialer) {
+	dialersMu.Lock()
+	defer dialersMu.Unlock()
+	if _, ok := dialers[driver]; ok {
+		panic(fmt.Sprintf("storage: driver %q registered twice", driver))
+	}
+	dialers[driver] = dialer
+}
+
+// Lookup returns the dialer registered for a driver.
+func Lookup(driver string) (Dialer, bool) {
+	dialersMu.RLock()
+	defer dialersMu.RUnlock()
+	dialer, ok := dialers[driver]
+	return dialer, ok
+}
+
+// Drivers lists the registered driver names, sorted.
+func Drivers() []string {
+	dialersMu.RLock()
+	defer dialersMu.RUnlock()
+	drivers := make([]string, 0, len(dialers))
+	for driver := range dialers {
+		drivers = append(drivers, driver)
+	}
+	sort.Strings(drivers)
+	return drivers
+}
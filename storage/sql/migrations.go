@@ -0,0 +1,414 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// migration is a versioned change of the schema. Migrations aren't run in a
+// transaction, since MySQL can't roll back schema changes, so every step
+// checks the schema first and a failed migration can simply be run again.
+// That also lets the first migrations adopt databases created by gorm's
+// AutoMigrate before migrations were versioned.
+//
+// Migrations describe tables with their own structs rather than the models,
+// so they keep creating the schema of their version as the models change.
+type migration struct {
+	version int
+	name    string
+	up      func(db *gorm.DB) error
+	down    func(db *gorm.DB) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create_instances",
+		up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&instanceV1{}).Error
+		},
+		down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(&instanceV1{}).Error
+		},
+	},
+	{
+		version: 2,
+		name:    "add_instance_repos",
+		up: func(db *gorm.DB) error {
+			if err := db.AutoMigrate(&instanceReposV2{}).Error; err != nil {
+				return err
+			}
+			return fillInstanceRepos(db)
+		},
+		down: func(db *gorm.DB) error {
+			return dropColumns(db, []interface{}{&instanceV1{}}, "github_repo", "gitlab_repo", "bitbucket_repo")
+		},
+	},
+	{
+		version: 3,
+		name:    "add_instance_versions",
+		up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&instanceVersionV3{}).Error
+		},
+		down: func(db *gorm.DB) error {
+			return dropColumns(db, []interface{}{&instanceV1{}, &instanceReposV2{}}, "version")
+		},
+	},
+	{
+		version: 4,
+		name:    "add_instance_data_keys",
+		up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&instanceDataKeyV4{}).Error
+		},
+		down: func(db *gorm.DB) error {
+			return dropColumns(db, []interface{}{&instanceV1{}, &instanceReposV2{}, &instanceVersionV3{}}, "data_key")
+		},
+	},
+	{
+		version: 5,
+		name:    "create_instance_revisions",
+		up: func(db *gorm.DB) error {
+			if err := db.AutoMigrate(&instanceRevisionV5{}).Error; err != nil {
+				return err
+			}
+			// databases set up by AutoMigrate have the index under a name
+			// shared by all namespaces
+			table := (&instanceRevisionV5{}).TableName()
+			if db.Dialect().HasIndex(table, "idx_instance_revision") {
+				return nil
+			}
+			return db.Model(&instanceRevisionV5{}).AddUniqueIndex("idx_"+table+"_revision", "instance_id", "revision").Error
+		},
+		down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(&instanceRevisionV5{}).Error
+		},
+	},
+	{
+		version: 6,
+		name:    "create_audit_entries",
+		up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&auditEntryV6{}).Error
+		},
+		down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(&auditEntryV6{}).Error
+		},
+	},
+	{
+		version: 7,
+		name:    "add_instance_states",
+		up: func(db *gorm.DB) error {
+			if err := db.AutoMigrate(&instanceStateV7{}).Error; err != nil {
+				return err
+			}
+			return fillInstanceStates(db)
+		},
+		down: func(db *gorm.DB) error {
+			return dropColumns(db, []interface{}{&instanceV1{}, &instanceReposV2{}, &instanceVersionV3{}, &instanceDataKeyV4{}}, "state")
+		},
+	},
+	{
+		version: 8,
+		name:    "add_instance_uuid_index",
+		up:      addInstanceUUIDIndex,
+		down:    dropInstanceUUIDIndex,
+	},
+}
+
+func latestMigration() int {
+	return migrations[len(migrations)-1].version
+}
+
+type instanceV1 struct {
+	ID            string
+	UUID          string
+	RawBaseConfig string `gorm:"size:65535"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	DeletedAt     *time.Time
+}
+
+func (*instanceV1) TableName() string { return (&models.Instance{}).TableName() }
+
+type instanceReposV2 struct {
+	GitHubRepo    string `gorm:"column:github_repo;index"`
+	GitLabRepo    string `gorm:"column:gitlab_repo;index"`
+	BitBucketRepo string `gorm:"column:bitbucket_repo;index"`
+}
+
+func (*instanceReposV2) TableName() string { return (&models.Instance{}).TableName() }
+
+type instanceVersionV3 struct {
+	Version int `gorm:"not null;default:0"`
+}
+
+func (*instanceVersionV3) TableName() string { return (&models.Instance{}).TableName() }
+
+type instanceDataKeyV4 struct {
+	DataKey string `gorm:"size:1024"`
+}
+
+func (*instanceDataKeyV4) TableName() string { return (&models.Instance{}).TableName() }
+
+type instanceRevisionV5 struct {
+	ID            string
+	InstanceID    string
+	Revision      int
+	RawBaseConfig string `gorm:"size:65535"`
+	DataKey       string `gorm:"size:1024"`
+	ChangedBy     string
+	RestoredFrom  int
+	CreatedAt     time.Time
+}
+
+func (*instanceRevisionV5) TableName() string { return (&models.InstanceRevision{}).TableName() }
+
+type auditEntryV6 struct {
+	ID         string
+	InstanceID string `gorm:"index"`
+	UserID     string `gorm:"index"`
+	Email      string
+	Provider   string
+	Method     string
+	Path       string `gorm:"size:1024"`
+	Branch     string
+	Status     int
+	CommitSHA  string
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+func (*auditEntryV6) TableName() string { return (&models.AuditEntry{}).TableName() }
+
+type instanceStateV7 struct {
+	State string `gorm:"size:32;not null;default:'active';index"`
+}
+
+func (*instanceStateV7) TableName() string { return (&models.Instance{}).TableName() }
+
+// fillInstanceRepos sets the searchable repo columns of instances saved
+// before they were added.
+func fillInstanceRepos(db *gorm.DB) error {
+	instances := []*models.Instance{}
+	q := model(db, &models.Instance{}).Select("id, raw_base_config").
+		Where("github_repo = '' AND gitlab_repo = '' AND bitbucket_repo = ''").
+		Or("github_repo IS NULL AND gitlab_repo IS NULL AND bitbucket_repo IS NULL")
+	if err := q.Find(&instances).Error; err != nil {
+		return errors.Wrap(err, "error finding instances to fill repos")
+	}
+	for _, i := range instances {
+		if i.BaseConfig == nil || i.BaseConfig.GitHub.Repo == "" && i.BaseConfig.GitLab.Repo == "" && i.BaseConfig.BitBucket.Repo == "" {
+			continue
+		}
+		err := db.Model(i).UpdateColumns(map[string]interface{}{
+			"github_repo":    i.BaseConfig.GitHub.Repo,
+			"gitlab_repo":    i.BaseConfig.GitLab.Repo,
+			"bitbucket_repo": i.BaseConfig.BitBucket.Repo,
+		}).Error
+		if err != nil {
+			return errors.Wrap(err, "error filling instance repos")
+		}
+	}
+	return nil
+}
+
+// fillInstanceStates sets the state of instances saved before it was added.
+func fillInstanceStates(db *gorm.DB) error {
+	err := db.Unscoped().Model(&models.Instance{}).
+		Where("deleted_at IS NOT NULL AND state <> ?", models.InstanceStateDeleted).
+		UpdateColumn("state", models.InstanceStateDeleted).Error
+	if err != nil {
+		return errors.Wrap(err, "error filling instance states")
+	}
+	err = db.Unscoped().Model(&models.Instance{}).
+		Where("state IS NULL OR state = ''").
+		UpdateColumn("state", models.InstanceStateActive).Error
+	return errors.Wrap(err, "error filling instance states")
+}
+
+// instanceUUIDIndex names the unique index on the UUIDs of instances that
+// aren't deleted.
+func instanceUUIDIndex() string {
+	return "idx_" + (&models.Instance{}).TableName() + "_active_uuid"
+}
+
+// addInstanceUUIDIndex makes the UUIDs of instances that aren't deleted
+// unique. Deleted instances keep their UUID, so the index leaves them out.
+// MySQL has no partial indexes, there it covers a generated column only set
+// for instances that aren't deleted.
+func addInstanceUUIDIndex(db *gorm.DB) error {
+	table := (&models.Instance{}).TableName()
+	index := instanceUUIDIndex()
+	if db.Dialect().HasIndex(table, index) {
+		return nil
+	}
+
+	duplicates := []string{}
+	err := db.Table(table).Where("deleted_at IS NULL AND uuid <> ''").
+		Group("uuid").Having("COUNT(*) > 1").Pluck("uuid", &duplicates).Error
+	if err != nil {
+		return errors.Wrap(err, "error finding duplicate instance UUIDs")
+	}
+	if len(duplicates) > 0 {
+		return errors.Errorf("several instances have the UUIDs %s, delete all but one of each first", strings.Join(duplicates, ", "))
+	}
+
+	quote := db.Dialect().Quote
+	if db.Dialect().GetName() == "mysql" {
+		if !db.Dialect().HasColumn(table, "active_uuid") {
+			alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN active_uuid VARCHAR(255) AS (IF(deleted_at IS NULL AND uuid <> '', uuid, NULL)) STORED", quote(table))
+			if err := db.Exec(alter).Error; err != nil {
+				return errors.Wrap(err, "error adding the active_uuid column")
+			}
+		}
+		return db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (active_uuid)", index, quote(table))).Error
+	}
+	return db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (uuid) WHERE deleted_at IS NULL AND uuid <> ''", index, quote(table))).Error
+}
+
+func dropInstanceUUIDIndex(db *gorm.DB) error {
+	table := (&models.Instance{}).TableName()
+	if db.Dialect().HasIndex(table, instanceUUIDIndex()) {
+		if err := db.Dialect().RemoveIndex(table, instanceUUIDIndex()); err != nil {
+			return errors.Wrap(err, "error dropping the instance UUID index")
+		}
+	}
+	if db.Dialect().GetName() == "mysql" && db.Dialect().HasColumn(table, "active_uuid") {
+		return db.Table(table).DropColumn("active_uuid").Error
+	}
+	return nil
+}
+
+// dropColumns drops columns from the table of the structs describing what's
+// left of it. SQLite can't drop columns, so the table is rebuilt from the
+// structs there instead.
+func dropColumns(db *gorm.DB, rest []interface{}, columns ...string) error {
+	table := rest[0].(interface{ TableName() string }).TableName()
+	if !db.HasTable(table) {
+		return nil
+	}
+	if db.Dialect().GetName() != "sqlite3" {
+		for _, column := range columns {
+			if !db.Dialect().HasColumn(table, column) {
+				continue
+			}
+			if err := db.Table(table).DropColumn(column).Error; err != nil {
+				return errors.Wrapf(err, "error dropping column %s of %s", column, table)
+			}
+		}
+		return nil
+	}
+
+	// the indexes keep their names when the table is renamed, they must go
+	// before the new table gets its own
+	indexes := []string{}
+	if err := db.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table).Pluck("name", &indexes).Error; err != nil {
+		return errors.Wrapf(err, "error listing indexes of %s", table)
+	}
+	for _, index := range indexes {
+		if err := db.Exec(fmt.Sprintf("DROP INDEX %s", db.Dialect().Quote(index))).Error; err != nil {
+			return errors.Wrapf(err, "error dropping index %s", index)
+		}
+	}
+
+	old := table + "_old"
+	if err := db.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", db.Dialect().Quote(table), db.Dialect().Quote(old))).Error; err != nil {
+		return errors.Wrapf(err, "error renaming %s", table)
+	}
+	if err := db.AutoMigrate(rest...).Error; err != nil {
+		return errors.Wrapf(err, "error recreating %s", table)
+	}
+	kept := []string{}
+	for _, value := range rest {
+		for _, field := range db.NewScope(value).GetModelStruct().StructFields {
+			if field.IsNormal {
+				kept = append(kept, db.Dialect().Quote(field.DBName))
+			}
+		}
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) SELECT %[2]s FROM %s", db.Dialect().Quote(table), strings.Join(kept, ", "), db.Dialect().Quote(old))
+	if err := db.Exec(insert).Error; err != nil {
+		return errors.Wrapf(err, "error copying %s", table)
+	}
+	return errors.Wrapf(db.Exec(fmt.Sprintf("DROP TABLE %s", db.Dialect().Quote(old))).Error, "error dropping %s", old)
+}
+
+// MigrateTo applies or reverts migrations until the schema is at a version,
+// 0 reverting them all.
+func (conn *Connection) MigrateTo(version int) error {
+	if version < 0 || version > latestMigration() {
+		return errors.Errorf("unknown schema version %d, the latest is %d", version, latestMigration())
+	}
+	applied, err := conn.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version > version || applied[m.version] != nil {
+			continue
+		}
+		if err := m.up(conn.db); err != nil {
+			return errors.Wrapf(err, "error applying migration %d_%s", m.version, m.name)
+		}
+		record := &models.SchemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}
+		if err := conn.db.Create(record).Error; err != nil {
+			return errors.Wrapf(err, "error recording migration %d_%s", m.version, m.name)
+		}
+		logrus.Infof("Applied migration %d_%s", m.version, m.name)
+	}
+
+	for n := len(migrations) - 1; n >= 0; n-- {
+		m := migrations[n]
+		if m.version <= version || applied[m.version] == nil {
+			continue
+		}
+		if err := m.down(conn.db); err != nil {
+			return errors.Wrapf(err, "error reverting migration %d_%s", m.version, m.name)
+		}
+		if err := conn.db.Delete(&models.SchemaMigration{Version: m.version}).Error; err != nil {
+			return errors.Wrapf(err, "error recording migration %d_%s", m.version, m.name)
+		}
+		logrus.Infof("Reverted migration %d_%s", m.version, m.name)
+	}
+	return nil
+}
+
+// Migrations lists every known migration, oldest first.
+func (conn *Connection) Migrations() ([]storage.MigrationStatus, error) {
+	applied, err := conn.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]storage.MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := storage.MigrationStatus{Version: m.version, Name: m.name}
+		if record := applied[m.version]; record != nil {
+			s.AppliedAt = &record.AppliedAt
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// appliedMigrations loads the migrations recorded in the migrations table,
+// creating it on first use.
+func (conn *Connection) appliedMigrations() (map[int]*models.SchemaMigration, error) {
+	if err := conn.db.AutoMigrate(&models.SchemaMigration{}).Error; err != nil {
+		return nil, errors.Wrap(err, "error creating migrations table")
+	}
+	records := []*models.SchemaMigration{}
+	if err := model(conn.db, &models.SchemaMigration{}).Find(&records).Error; err != nil {
+		return nil, errors.Wrap(err, "error loading applied migrations")
+	}
+	applied := map[int]*models.SchemaMigration{}
+	for _, r := range records {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
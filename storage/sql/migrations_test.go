@@ -0,0 +1,79 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	conn := dialTestDB(t)
+
+	status, err := conn.Migrations()
+	require.NoError(t, err)
+	require.Len(t, status, len(migrations))
+	for _, s := range status {
+		assert.Nil(t, s.AppliedAt, "migration %d", s.Version)
+	}
+
+	require.NoError(t, conn.MigrateTo(latestMigration()))
+	status, err = conn.Migrations()
+	require.NoError(t, err)
+	for _, s := range status {
+		assert.NotNil(t, s.AppliedAt, "migration %d", s.Version)
+	}
+
+	instance := &models.Instance{ID: "instance-1", UUID: "uuid-1", BaseConfig: &conf.Configuration{
+		GitHub: conf.GitHubConfig{Repo: "owner/repo"},
+	}}
+	require.NoError(t, conn.CreateInstance(instance))
+	require.NoError(t, conn.DeleteInstance(instance))
+
+	// going down drops the state column, keeping the data
+	require.NoError(t, conn.MigrateTo(6))
+	assert.False(t, conn.db.Dialect().HasColumn("instances", "state"))
+	assert.True(t, conn.db.Dialect().HasColumn("instances", "github_repo"))
+	assert.True(t, conn.db.Dialect().HasIndex("instances", "idx_instances_github_repo"))
+	status, err = conn.Migrations()
+	require.NoError(t, err)
+	assert.NotNil(t, status[5].AppliedAt)
+	assert.Nil(t, status[6].AppliedAt)
+
+	// and going back up fills it again
+	require.NoError(t, conn.Automigrate())
+	loaded, err := conn.GetInstance("instance-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.InstanceStateDeleted, loaded.State)
+	assert.Equal(t, "owner/repo", loaded.BaseConfig.GitHub.Repo)
+
+	require.NoError(t, conn.MigrateTo(0))
+	for _, table := range []string{"instances", "instance_revisions", "audit_entries"} {
+		assert.False(t, conn.db.HasTable(table), "expected table %s to be dropped", table)
+	}
+
+	assert.Error(t, conn.MigrateTo(latestMigration()+1))
+}
+
+func TestMigrationsAdoptAutoMigratedDatabase(t *testing.T) {
+	conn := dialTestDB(t)
+
+	// the schema as gorm's AutoMigrate created it before migrations were
+	// versioned
+	require.NoError(t, conn.db.AutoMigrate(&models.Instance{}, &models.InstanceRevision{}, &models.AuditEntry{}).Error)
+	require.NoError(t, conn.db.Create(&models.Instance{ID: "instance-1", UUID: "uuid-1", Version: 1, State: models.InstanceStateActive}).Error)
+
+	require.NoError(t, conn.Automigrate())
+	status, err := conn.Migrations()
+	require.NoError(t, err)
+	for _, s := range status {
+		assert.NotNil(t, s.AppliedAt, "migration %d", s.Version)
+	}
+	assert.False(t, conn.db.Dialect().HasIndex("instance_revisions", "idx_instance_revisions_revision"), "the existing index is kept")
+
+	loaded, err := conn.GetInstanceByUUID("uuid-1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, loaded.Version)
+}
@@ -4,6 +4,9 @@ import (
 	// this is where we do the connections
 
 	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	// import drivers we might need
 	_ "github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/dialers/mysql"
@@ -15,10 +18,24 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/netlify/git-gateway/conf"
 	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+func init() {
+	dial := func(config *conf.GlobalConfiguration) (storage.Connection, error) {
+		conn, err := Dial(config)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	for _, driver := range []string{"sqlite3", "mysql", "postgres", "cloudsqlmysql", "cloudsqlpostgres"} {
+		storage.Register(driver, dial)
+	}
+}
+
 type logger struct {
 	entry *logrus.Entry
 }
@@ -32,10 +49,16 @@ type Connection struct {
 	db *gorm.DB
 }
 
-// Automigrate creates any missing tables and/or columns.
+// Automigrate applies the pending schema migrations.
 func (conn *Connection) Automigrate() error {
-	conn.db = conn.db.AutoMigrate(&models.Instance{})
-	return conn.db.Error
+	return conn.MigrateTo(latestMigration())
+}
+
+// model scopes a query to the table of a model. Queries loading slices would
+// otherwise use the table name gorm cached the first time it saw the model,
+// missing later changes of models.Namespace.
+func model(db *gorm.DB, m interface{ TableName() string }) *gorm.DB {
+	return db.Model(m).Table(m.TableName())
 }
 
 // Close closes the database connection.
@@ -43,10 +66,10 @@ func (conn *Connection) Close() error {
 	return conn.db.Close()
 }
 
-// GetInstance finds an instance by ID
+// GetInstance finds an instance by ID, deleted instances included.
 func (conn *Connection) GetInstance(instanceID string) (*models.Instance, error) {
 	instance := models.Instance{}
-	if rsp := conn.db.Where("id = ?", instanceID).First(&instance); rsp.Error != nil {
+	if rsp := conn.db.Unscoped().Where("id = ?", instanceID).First(&instance); rsp.Error != nil {
 		if rsp.RecordNotFound() {
 			return nil, models.InstanceNotFoundError{}
 		}
@@ -66,22 +89,342 @@ func (conn *Connection) GetInstanceByUUID(uuid string) (*models.Instance, error)
 	return &instance, nil
 }
 
+// FindInstances finds the instances matching filter, ordered by the sort
+// fields and then by ID. Deleted instances are only found when filtering on
+// their state.
+func (conn *Connection) FindInstances(filter *models.InstanceFilter, sort *models.SortParams, pagination *models.Pagination) ([]*models.Instance, error) {
+	q := model(conn.db, &models.Instance{})
+	if filter != nil {
+		if filter.State != "" {
+			q = q.Unscoped().Where("state = ?", filter.State)
+		}
+		if filter.UUID != "" {
+			q = q.Where("uuid = ?", filter.UUID)
+		}
+		switch filter.Provider {
+		case models.ProviderGitHub:
+			q = q.Where("github_repo <> ''")
+		case models.ProviderGitLab:
+			q = q.Where("gitlab_repo <> ''")
+		case models.ProviderBitBucket:
+			q = q.Where("bitbucket_repo <> ''")
+		case "":
+		default:
+			return nil, errors.Errorf("unknown provider %q", filter.Provider)
+		}
+		if filter.Repo != "" {
+			q = q.Where("github_repo = ? OR gitlab_repo = ? OR bitbucket_repo = ?", filter.Repo, filter.Repo, filter.Repo)
+		}
+	}
+
+	if pagination != nil {
+		var count uint64
+		if err := q.Count(&count).Error; err != nil {
+			return nil, errors.Wrap(err, "error counting instances")
+		}
+		pagination.Count = count
+		q = q.Offset(pagination.Offset()).Limit(pagination.PerPage)
+	}
+
+	if sort != nil {
+		for _, field := range sort.Fields {
+			switch field.Name {
+			case "created_at", "updated_at":
+			default:
+				return nil, errors.Errorf("unknown sort field %q", field.Name)
+			}
+			dir := models.Ascending
+			if field.Dir == models.Descending {
+				dir = models.Descending
+			}
+			q = q.Order(field.Name + " " + string(dir))
+		}
+	}
+
+	instances := []*models.Instance{}
+	if err := q.Order("id asc").Find(&instances).Error; err != nil {
+		return nil, errors.Wrap(err, "error finding instances")
+	}
+	return instances, nil
+}
+
+// CreateInstance stores a new instance. Its UUID may not be used by another
+// instance that isn't deleted.
 func (conn *Connection) CreateInstance(instance *models.Instance) error {
-	if result := conn.db.Create(instance); result.Error != nil {
+	if instance.Version == 0 {
+		instance.Version = 1
+	}
+	if instance.State == "" {
+		instance.State = models.InstanceStateActive
+	}
+
+	tx := conn.db.Begin()
+	if instance.UUID != "" {
+		var count int
+		if err := tx.Model(&models.Instance{}).Where("uuid = ?", instance.UUID).Count(&count).Error; err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "Error creating instance")
+		}
+		if count > 0 {
+			tx.Rollback()
+			return models.DuplicateInstanceUUIDError{}
+		}
+	}
+	if result := tx.Create(instance); result.Error != nil {
+		tx.Rollback()
+		if isInstanceUUIDConflict(result.Error) {
+			return models.DuplicateInstanceUUIDError{}
+		}
 		return errors.Wrap(result.Error, "Error creating instance")
 	}
+	if err := tx.Commit().Error; err != nil {
+		if isInstanceUUIDConflict(err) {
+			return models.DuplicateInstanceUUIDError{}
+		}
+		return errors.Wrap(err, "Error creating instance")
+	}
 	return nil
 }
 
+// isInstanceUUIDConflict reports whether err violates the unique index on the
+// UUIDs of instances that aren't deleted, which catches concurrent writes the
+// checks before them miss. SQLite names the column, the other databases the
+// index.
+func isInstanceUUIDConflict(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, instanceUUIDIndex()) ||
+		strings.Contains(msg, "UNIQUE constraint failed: "+(&models.Instance{}).TableName()+".uuid")
+}
+
+// UpdateInstance saves the instance if it's still at the version it was
+// loaded at, and increments its version. Otherwise an
+// InstanceVersionConflictError is returned. An instance that isn't deleted
+// may not take the UUID of another one that isn't.
 func (conn *Connection) UpdateInstance(instance *models.Instance) error {
-	if result := conn.db.Save(instance); result.Error != nil {
+	// unscoped, so deleted instances can be restored
+	tx := conn.db.Unscoped().Begin()
+	if instance.UUID != "" && instance.DeletedAt == nil {
+		var count int
+		if err := tx.Model(&models.Instance{}).Where("uuid = ? AND id <> ? AND deleted_at IS NULL", instance.UUID, instance.ID).
+			Count(&count).Error; err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "Error updating instance record")
+		}
+		if count > 0 {
+			tx.Rollback()
+			return models.DuplicateInstanceUUIDError{}
+		}
+	}
+	result := tx.Model(&models.Instance{}).Where("id = ? AND version = ?", instance.ID, instance.Version).
+		UpdateColumn("version", instance.Version+1)
+	if result.Error != nil {
+		tx.Rollback()
 		return errors.Wrap(result.Error, "Error updating instance record")
 	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return models.InstanceVersionConflictError{}
+	}
+
+	instance.Version++
+	if result := tx.Save(instance); result.Error != nil {
+		tx.Rollback()
+		instance.Version--
+		if isInstanceUUIDConflict(result.Error) {
+			return models.DuplicateInstanceUUIDError{}
+		}
+		return errors.Wrap(result.Error, "Error updating instance record")
+	}
+	if err := tx.Commit().Error; err != nil {
+		instance.Version--
+		if isInstanceUUIDConflict(err) {
+			return models.DuplicateInstanceUUIDError{}
+		}
+		return errors.Wrap(err, "Error updating instance record")
+	}
+	return nil
+}
+
+// RekeyInstance saves the configuration of an instance again, encrypting its
+// secrets with the active key. Its version and timestamps are left unchanged,
+// so the instance's ETag stays valid. An instance changed since it was read
+// fails with a version conflict.
+func (conn *Connection) RekeyInstance(instance *models.Instance) error {
+	// UpdateColumns skips the callbacks, the columns are encrypted here
+	if err := instance.BeforeSave(); err != nil {
+		return errors.Wrap(err, "Error rekeying instance record")
+	}
+	result := conn.db.Unscoped().Model(&models.Instance{}).Where("id = ? AND version = ?", instance.ID, instance.Version).
+		UpdateColumns(map[string]interface{}{
+			"raw_base_config": instance.RawBaseConfig,
+			"data_key":        instance.DataKey,
+		})
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "Error rekeying instance record")
+	}
+	if result.RowsAffected == 0 {
+		return models.InstanceVersionConflictError{}
+	}
 	return nil
 }
 
+// DeleteInstance marks the instance deleted. It's kept until purged.
 func (conn *Connection) DeleteInstance(instance *models.Instance) error {
-	return conn.db.Delete(instance).Error
+	now := time.Now()
+	err := conn.db.Unscoped().Model(instance).UpdateColumns(map[string]interface{}{
+		"state":      models.InstanceStateDeleted,
+		"deleted_at": now,
+	}).Error
+	if err != nil {
+		return errors.Wrap(err, "Error deleting instance")
+	}
+	instance.State = models.InstanceStateDeleted
+	instance.DeletedAt = &now
+	return nil
+}
+
+// PurgeInstances removes the instances deleted before a time for good,
+// along with their revisions. Audit entries are kept.
+func (conn *Connection) PurgeInstances(deletedBefore time.Time) (int64, error) {
+	tx := conn.db.Unscoped().Begin()
+	ids := []string{}
+	err := tx.Model(&models.Instance{}).Where("state = ? AND deleted_at < ?", models.InstanceStateDeleted, deletedBefore).
+		Pluck("id", &ids).Error
+	if err != nil {
+		tx.Rollback()
+		return 0, errors.Wrap(err, "error finding deleted instances")
+	}
+	if len(ids) == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	if err := tx.Where("instance_id IN (?)", ids).Delete(&models.InstanceRevision{}).Error; err != nil {
+		tx.Rollback()
+		return 0, errors.Wrap(err, "error purging instance revisions")
+	}
+	result := tx.Where("id IN (?)", ids).Delete(&models.Instance{})
+	if result.Error != nil {
+		tx.Rollback()
+		return 0, errors.Wrap(result.Error, "error purging instances")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, errors.Wrap(err, "error purging instances")
+	}
+	return result.RowsAffected, nil
+}
+
+// CreateInstanceRevision stores a new revision, numbered after the latest
+// revision of its instance.
+func (conn *Connection) CreateInstanceRevision(revision *models.InstanceRevision) error {
+	tx := conn.db.Begin()
+	latest := struct{ Max int }{}
+	if err := tx.Model(&models.InstanceRevision{}).Select("COALESCE(MAX(revision), 0) AS max").
+		Where("instance_id = ?", revision.InstanceID).Scan(&latest).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "error finding latest instance revision")
+	}
+	revision.Revision = latest.Max + 1
+	if err := tx.Create(revision).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "Error creating instance revision")
+	}
+	return errors.Wrap(tx.Commit().Error, "Error creating instance revision")
+}
+
+// UpdateInstanceRevision saves the configuration of a stored revision again,
+// encrypting its secrets with the active key. Its number and metadata are
+// left unchanged.
+func (conn *Connection) UpdateInstanceRevision(revision *models.InstanceRevision) error {
+	// UpdateColumns skips the callbacks, the columns are encrypted here
+	if err := revision.BeforeSave(); err != nil {
+		return errors.Wrap(err, "Error updating instance revision")
+	}
+	result := conn.db.Model(&models.InstanceRevision{}).Where("id = ?", revision.ID).UpdateColumns(map[string]interface{}{
+		"raw_base_config": revision.RawBaseConfig,
+		"data_key":        revision.DataKey,
+	})
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "Error updating instance revision")
+	}
+	if result.RowsAffected == 0 {
+		return models.InstanceRevisionNotFoundError{}
+	}
+	return nil
+}
+
+// GetInstanceRevision finds a revision of an instance by its number.
+func (conn *Connection) GetInstanceRevision(instanceID string, revision int) (*models.InstanceRevision, error) {
+	r := models.InstanceRevision{}
+	if rsp := conn.db.Where("instance_id = ? AND revision = ?", instanceID, revision).First(&r); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, models.InstanceRevisionNotFoundError{}
+		}
+		return nil, errors.Wrap(rsp.Error, "error finding instance revision")
+	}
+	return &r, nil
+}
+
+// FindInstanceRevisions finds the revisions of an instance, newest first.
+func (conn *Connection) FindInstanceRevisions(instanceID string, pagination *models.Pagination) ([]*models.InstanceRevision, error) {
+	q := model(conn.db, &models.InstanceRevision{}).Where("instance_id = ?", instanceID)
+	if pagination != nil {
+		var count uint64
+		if err := q.Count(&count).Error; err != nil {
+			return nil, errors.Wrap(err, "error counting instance revisions")
+		}
+		pagination.Count = count
+		q = q.Offset(pagination.Offset()).Limit(pagination.PerPage)
+	}
+
+	revisions := []*models.InstanceRevision{}
+	if err := q.Order("revision desc").Find(&revisions).Error; err != nil {
+		return nil, errors.Wrap(err, "error finding instance revisions")
+	}
+	return revisions, nil
+}
+
+// CreateAuditEntry stores a new audit entry.
+func (conn *Connection) CreateAuditEntry(entry *models.AuditEntry) error {
+	if result := conn.db.Create(entry); result.Error != nil {
+		return errors.Wrap(result.Error, "Error creating audit entry")
+	}
+	return nil
+}
+
+// FindAuditEntries finds the audit entries of an instance, newest first.
+func (conn *Connection) FindAuditEntries(instanceID string, filter *models.AuditFilter, pagination *models.Pagination) ([]*models.AuditEntry, error) {
+	q := model(conn.db, &models.AuditEntry{}).Where("instance_id = ?", instanceID)
+	if filter != nil {
+		if filter.User != "" {
+			q = q.Where("user_id = ? OR email = ?", filter.User, filter.User)
+		}
+		if !filter.From.IsZero() {
+			q = q.Where("created_at >= ?", filter.From)
+		}
+		if !filter.To.IsZero() {
+			q = q.Where("created_at <= ?", filter.To)
+		}
+		if filter.Path != "" {
+			// avoids LIKE, whose escaping differs between dialects
+			q = q.Where("SUBSTR(path, 1, ?) = ?", utf8.RuneCountInString(filter.Path), filter.Path)
+		}
+	}
+
+	if pagination != nil {
+		var count uint64
+		if err := q.Count(&count).Error; err != nil {
+			return nil, errors.Wrap(err, "error counting audit entries")
+		}
+		pagination.Count = count
+		q = q.Offset(pagination.Offset()).Limit(pagination.PerPage)
+	}
+
+	entries := []*models.AuditEntry{}
+	if err := q.Order("created_at desc").Find(&entries).Error; err != nil {
+		return nil, errors.Wrap(err, "error finding audit entries")
+	}
+	return entries, nil
 }
 
 // Dial will connect to that storage engine
@@ -1,45 +1,84 @@
 package sql
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"testing"
 
-var conn *Connection
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+func dialTestDB(t *testing.T) *Connection {
+	f, err := ioutil.TempFile("", "git-gateway-test-")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	conn, err := Dial(&conf.GlobalConfiguration{
+		DB: conf.DBConfiguration{Driver: "sqlite3", URL: f.Name()},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	// sqlite locks the whole database, concurrent writers must queue
+	conn.db.DB().SetMaxOpenConns(1)
+	return conn
+}
+
+func runSuite(t *testing.T, conn *Connection) {
+	s := &test.StorageTestSuite{
+		C: conn,
+		BeforeTest: func() {
+			require.NoError(t, conn.MigrateTo(0))
+			require.NoError(t, conn.Automigrate())
+		},
+	}
+	suite.Run(t, s)
+}
 
 func TestSQLTestSuite(t *testing.T) {
-	//f, err := ioutil.TempFile("", "git-gateway-test-")
-	//require.NoError(t, err)
-
-	//defer os.Remove(f.Name())
-	//err = f.Close()
-	//require.NoError(t, err)
-
-	//config := &conf.GlobalConfiguration{
-	//	DB: conf.DBConfiguration{
-	//		Driver:      "sqlite3",
-	//		URL:         f.Name(),
-	//		Automigrate: true,
-	//	},
-	//}
-
-	//conn, err = Dial(config)
-	//require.NoError(t, err)
-
-	//s := &test.StorageTestSuite{
-	//	C:          conn,
-	//	BeforeTest: beforeTest,
-	//	TokenID:    tokenID,
-	//}
-	//suite.Run(t, s)
+	runSuite(t, dialTestDB(t))
+}
+
+func TestSQLTestSuiteWithNamespace(t *testing.T) {
+	models.Namespace = "conformance"
+	defer func() { models.Namespace = "" }()
+
+	conn := dialTestDB(t)
+	runSuite(t, conn)
+
+	for _, table := range []string{"conformance_instances", "conformance_instance_revisions", "conformance_audit_entries", "conformance_schema_migrations"} {
+		assert.True(t, conn.db.HasTable(table), "expected table %s", table)
+	}
+	assert.False(t, conn.db.HasTable("instances"))
 }
 
-//func beforeTest() {
-//	conn.db.DropTableIfExists(&userObj{})
-//	conn.db.DropTableIfExists(&models.RefreshToken{})
-//	conn.db.DropTableIfExists(&models.Instance{})
-//	conn.db.CreateTable(&userObj{})
-//	conn.db.CreateTable(&models.RefreshToken{})
-//	conn.db.CreateTable(&models.Instance{})
-//}
-//
-//func tokenID(r *models.RefreshToken) interface{} {
-//	return r.ID
-//}
+func TestInstanceUUIDIndex(t *testing.T) {
+	conn := dialTestDB(t)
+	require.NoError(t, conn.Automigrate())
+
+	i := &models.Instance{ID: "instance-1", UUID: "uuid-1", BaseConfig: &conf.Configuration{}}
+	require.NoError(t, conn.CreateInstance(i))
+
+	// a write racing past the check in CreateInstance is stopped by the index
+	err := conn.db.Create(&models.Instance{ID: "instance-2", UUID: "uuid-1", BaseConfig: &conf.Configuration{}}).Error
+	require.Error(t, err)
+	assert.True(t, isInstanceUUIDConflict(err), "unexpected error: %v", err)
+
+	// deleted instances and instances without UUID aren't covered
+	require.NoError(t, conn.DeleteInstance(i))
+	require.NoError(t, conn.CreateInstance(&models.Instance{ID: "instance-2", UUID: "uuid-1", BaseConfig: &conf.Configuration{}}))
+	require.NoError(t, conn.CreateInstance(&models.Instance{ID: "instance-3", BaseConfig: &conf.Configuration{}}))
+	require.NoError(t, conn.CreateInstance(&models.Instance{ID: "instance-4", BaseConfig: &conf.Configuration{}}))
+
+	// migrating fails, rather than dropping instances, when UUIDs are shared
+	require.NoError(t, conn.MigrateTo(7))
+	require.NoError(t, conn.db.Unscoped().Model(i).UpdateColumn("deleted_at", nil).Error)
+	err = conn.Automigrate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "uuid-1")
+}
@@ -1,6 +1,10 @@
 package storage
 
-import "github.com/netlify/git-gateway/models"
+import (
+	"time"
+
+	"github.com/netlify/git-gateway/models"
+)
 
 // Connection is the interface a storage provider must implement.
 type Connection interface {
@@ -9,7 +13,18 @@ type Connection interface {
 
 	GetInstanceByUUID(uuid string) (*models.Instance, error)
 	GetInstance(instanceID string) (*models.Instance, error)
+	FindInstances(filter *models.InstanceFilter, sort *models.SortParams, pagination *models.Pagination) ([]*models.Instance, error)
 	CreateInstance(instance *models.Instance) error
 	DeleteInstance(instance *models.Instance) error
 	UpdateInstance(instance *models.Instance) error
+	RekeyInstance(instance *models.Instance) error
+	PurgeInstances(deletedBefore time.Time) (int64, error)
+
+	CreateInstanceRevision(revision *models.InstanceRevision) error
+	UpdateInstanceRevision(revision *models.InstanceRevision) error
+	GetInstanceRevision(instanceID string, revision int) (*models.InstanceRevision, error)
+	FindInstanceRevisions(instanceID string, pagination *models.Pagination) ([]*models.InstanceRevision, error)
+
+	CreateAuditEntry(entry *models.AuditEntry) error
+	FindAuditEntries(instanceID string, filter *models.AuditFilter, pagination *models.Pagination) ([]*models.AuditEntry, error)
 }
@@ -0,0 +1,455 @@
+// Package test holds a conformance suite every storage.Connection must pass.
+package test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/netlify/git-gateway/conf"
+	"github.com/netlify/git-gateway/models"
+	"github.com/netlify/git-gateway/storage"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// StorageTestSuite runs the conformance tests against C. BeforeTest must
+// leave C empty, it's called before every test.
+type StorageTestSuite struct {
+	suite.Suite
+	C          storage.Connection
+	BeforeTest func()
+}
+
+// SetupTest empties the store.
+func (s *StorageTestSuite) SetupTest() {
+	if s.BeforeTest != nil {
+		s.BeforeTest()
+	}
+}
+
+func (s *StorageTestSuite) createInstance(uuid string, config *conf.Configuration) *models.Instance {
+	i := &models.Instance{ID: newID(), UUID: uuid, BaseConfig: config}
+	require.NoError(s.T(), s.C.CreateInstance(i))
+	return i
+}
+
+func newID() string {
+	return uuid.NewRandom().String()
+}
+
+func (s *StorageTestSuite) TestNotFound() {
+	_, err := s.C.GetInstance("missing")
+	s.True(models.IsNotFoundError(err), "expected an instance not found error, got %v", err)
+	_, err = s.C.GetInstanceByUUID("missing")
+	s.True(models.IsNotFoundError(err), "expected an instance not found error, got %v", err)
+	_, err = s.C.GetInstanceRevision("missing", 1)
+	s.True(models.IsNotFoundError(err), "expected a revision not found error, got %v", err)
+
+	instances, err := s.C.FindInstances(nil, nil, nil)
+	s.NoError(err)
+	s.Empty(instances)
+	revisions, err := s.C.FindInstanceRevisions("missing", nil)
+	s.NoError(err)
+	s.Empty(revisions)
+	entries, err := s.C.FindAuditEntries("missing", nil, nil)
+	s.NoError(err)
+	s.Empty(entries)
+}
+
+func (s *StorageTestSuite) TestCreateInstance() {
+	config := &conf.Configuration{
+		JWT:    conf.JWTConfiguration{Secret: "jwt-secret"},
+		GitHub: conf.GitHubConfig{AccessToken: "github-token", Repo: "owner/repo"},
+		Roles:  []string{"admin"},
+	}
+	i := s.createInstance("uuid-1", config)
+	s.Equal(1, i.Version)
+	s.Equal(models.InstanceStateActive, i.State)
+	s.False(i.CreatedAt.IsZero())
+
+	byID, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err)
+	s.Equal("uuid-1", byID.UUID)
+	s.Equal(config, byID.BaseConfig)
+	s.Equal(1, byID.Version)
+	s.Nil(byID.DeletedAt)
+
+	byUUID, err := s.C.GetInstanceByUUID("uuid-1")
+	s.Require().NoError(err)
+	s.Equal(i.ID, byUUID.ID)
+
+	// the store hands out copies
+	byID.BaseConfig.GitHub.Repo = "owner/changed"
+	byID.BaseConfig.Roles[0] = "changed"
+	stored, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err)
+	s.Equal(config, stored.BaseConfig)
+}
+
+func (s *StorageTestSuite) TestEncryptedSecrets() {
+	keyring, err := models.NewKeyring(map[string][]byte{"test": make([]byte, conf.MasterKeySize)}, "test")
+	s.Require().NoError(err)
+	models.Encryption = keyring
+	defer func() { models.Encryption = nil }()
+
+	i := s.createInstance("uuid-1", &conf.Configuration{GitHub: conf.GitHubConfig{AccessToken: "github-token"}})
+	s.Equal("test", i.KeyID())
+	s.Equal("github-token", i.BaseConfig.GitHub.AccessToken, "the caller's configuration is left in the clear")
+
+	stored, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err)
+	s.Equal("test", stored.KeyID())
+	s.Equal("github-token", stored.BaseConfig.GitHub.AccessToken)
+}
+
+func (s *StorageTestSuite) TestUUIDUniqueness() {
+	first := s.createInstance("uuid-1", &conf.Configuration{})
+	err := s.C.CreateInstance(&models.Instance{ID: newID(), UUID: "uuid-1", BaseConfig: &conf.Configuration{}})
+	s.True(models.IsDuplicateUUIDError(err), "expected a duplicate UUID error, got %v", err)
+
+	// the UUID of a deleted instance can be reused
+	s.Require().NoError(s.C.DeleteInstance(first))
+	second := s.createInstance("uuid-1", &conf.Configuration{})
+	found, err := s.C.GetInstanceByUUID("uuid-1")
+	s.Require().NoError(err)
+	s.Equal(second.ID, found.ID)
+}
+
+func (s *StorageTestSuite) TestRestoreTakenUUID() {
+	first := s.createInstance("uuid-1", &conf.Configuration{})
+	s.Require().NoError(s.C.DeleteInstance(first))
+	second := s.createInstance("uuid-1", &conf.Configuration{})
+
+	deleted, err := s.C.GetInstance(first.ID)
+	s.Require().NoError(err)
+	deleted.State, deleted.DeletedAt = models.InstanceStateActive, nil
+	err = s.C.UpdateInstance(deleted)
+	s.True(models.IsDuplicateUUIDError(err), "expected a duplicate UUID error, got %v", err)
+
+	// once the UUID is released the instance can be restored
+	s.Require().NoError(s.C.DeleteInstance(second))
+	deleted, err = s.C.GetInstance(first.ID)
+	s.Require().NoError(err)
+	deleted.State, deleted.DeletedAt = models.InstanceStateActive, nil
+	s.Require().NoError(s.C.UpdateInstance(deleted))
+	found, err := s.C.GetInstanceByUUID("uuid-1")
+	s.Require().NoError(err)
+	s.Equal(first.ID, found.ID)
+}
+
+func (s *StorageTestSuite) TestUpdateInstance() {
+	i := s.createInstance("uuid-1", &conf.Configuration{GitHub: conf.GitHubConfig{Repo: "owner/repo"}})
+	stale, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err)
+
+	i.BaseConfig.GitHub.Repo = "owner/other"
+	s.Require().NoError(s.C.UpdateInstance(i))
+	s.Equal(2, i.Version)
+
+	stored, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err)
+	s.Equal(2, stored.Version)
+	s.Equal("owner/other", stored.BaseConfig.GitHub.Repo)
+	s.False(stored.UpdatedAt.Before(stored.CreatedAt))
+
+	err = s.C.UpdateInstance(stale)
+	s.True(models.IsVersionConflictError(err), "expected a version conflict, got %v", err)
+	s.Equal(1, stale.Version, "a failed update leaves the version")
+
+	err = s.C.UpdateInstance(&models.Instance{ID: "missing", Version: 1, BaseConfig: &conf.Configuration{}})
+	s.True(models.IsVersionConflictError(err), "expected a version conflict, got %v", err)
+}
+
+func (s *StorageTestSuite) TestConcurrentUpdates() {
+	i := s.createInstance("uuid-1", &conf.Configuration{})
+
+	const writers = 5
+	copies := make([]*models.Instance, writers)
+	for n := range copies {
+		c, err := s.C.GetInstance(i.ID)
+		s.Require().NoError(err)
+		c.BaseConfig.Roles = []string{fmt.Sprintf("writer-%d", n)}
+		copies[n] = c
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for n := range copies {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errs[n] = s.C.UpdateInstance(copies[n])
+		}(n)
+	}
+	wg.Wait()
+
+	winner := -1
+	for n, err := range errs {
+		if err == nil {
+			s.Equal(-1, winner, "only one update may succeed")
+			winner = n
+			continue
+		}
+		s.True(models.IsVersionConflictError(err), "expected a version conflict, got %v", err)
+	}
+	s.Require().NotEqual(-1, winner, "one update must succeed")
+
+	stored, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err)
+	s.Equal(2, stored.Version)
+	s.Equal(copies[winner].BaseConfig.Roles, stored.BaseConfig.Roles)
+}
+
+func (s *StorageTestSuite) TestFindInstances() {
+	github := s.createInstance("uuid-1", &conf.Configuration{GitHub: conf.GitHubConfig{Repo: "owner/site"}})
+	gitlab := s.createInstance("uuid-2", &conf.Configuration{GitLab: conf.GitLabConfig{Repo: "owner/site"}})
+	bitbucket := s.createInstance("uuid-3", &conf.Configuration{BitBucket: conf.BitBucketConfig{Repo: "owner/other"}})
+
+	ids := func(filter *models.InstanceFilter) []string {
+		instances, err := s.C.FindInstances(filter, nil, nil)
+		s.Require().NoError(err)
+		found := []string{}
+		for _, i := range instances {
+			found = append(found, i.ID)
+		}
+		return found
+	}
+	s.ElementsMatch([]string{github.ID, gitlab.ID, bitbucket.ID}, ids(nil))
+	s.Equal([]string{gitlab.ID}, ids(&models.InstanceFilter{UUID: "uuid-2"}))
+	s.Equal([]string{github.ID}, ids(&models.InstanceFilter{Provider: models.ProviderGitHub}))
+	s.Equal([]string{bitbucket.ID}, ids(&models.InstanceFilter{Provider: models.ProviderBitBucket}))
+	s.ElementsMatch([]string{github.ID, gitlab.ID}, ids(&models.InstanceFilter{Repo: "owner/site"}))
+	s.Equal([]string{gitlab.ID}, ids(&models.InstanceFilter{Provider: models.ProviderGitLab, Repo: "owner/site"}))
+	s.Empty(ids(&models.InstanceFilter{Repo: "owner/missing"}))
+
+	_, err := s.C.FindInstances(&models.InstanceFilter{Provider: "svn"}, nil, nil)
+	s.Error(err)
+	_, err = s.C.FindInstances(nil, &models.SortParams{Fields: []models.SortField{{Name: "uuid"}}}, nil)
+	s.Error(err)
+
+	// ties on the sort fields are broken by ID
+	sort := &models.SortParams{Fields: []models.SortField{{Name: "created_at", Dir: models.Ascending}}}
+	pagination := &models.Pagination{Page: 1, PerPage: 2}
+	page, err := s.C.FindInstances(nil, sort, pagination)
+	s.Require().NoError(err)
+	s.Len(page, 2)
+	s.EqualValues(3, pagination.Count)
+	pagination.Page = 2
+	last, err := s.C.FindInstances(nil, sort, pagination)
+	s.Require().NoError(err)
+	s.Len(last, 1)
+	s.NotContains([]string{page[0].ID, page[1].ID}, last[0].ID)
+	s.False(last[0].CreatedAt.Before(page[1].CreatedAt))
+}
+
+func (s *StorageTestSuite) TestSoftDelete() {
+	i := s.createInstance("uuid-1", &conf.Configuration{})
+	kept := s.createInstance("uuid-2", &conf.Configuration{})
+	s.Require().NoError(s.C.DeleteInstance(i))
+	s.Equal(models.InstanceStateDeleted, i.State)
+	s.NotNil(i.DeletedAt)
+
+	deleted, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err, "deleted instances are found by ID")
+	s.Equal(models.InstanceStateDeleted, deleted.State)
+	s.NotNil(deleted.DeletedAt)
+
+	_, err = s.C.GetInstanceByUUID("uuid-1")
+	s.True(models.IsNotFoundError(err), "expected an instance not found error, got %v", err)
+	instances, err := s.C.FindInstances(nil, nil, nil)
+	s.Require().NoError(err)
+	s.Require().Len(instances, 1)
+	s.Equal(kept.ID, instances[0].ID)
+	instances, err = s.C.FindInstances(&models.InstanceFilter{State: models.InstanceStateDeleted}, nil, nil)
+	s.Require().NoError(err)
+	s.Require().Len(instances, 1)
+	s.Equal(i.ID, instances[0].ID)
+
+	// restoring
+	deleted.State = models.InstanceStateActive
+	deleted.DeletedAt = nil
+	s.Require().NoError(s.C.UpdateInstance(deleted))
+	restored, err := s.C.GetInstanceByUUID("uuid-1")
+	s.Require().NoError(err)
+	s.Equal(models.InstanceStateActive, restored.State)
+	s.Nil(restored.DeletedAt)
+}
+
+func (s *StorageTestSuite) TestPurgeInstances() {
+	i := s.createInstance("uuid-1", &conf.Configuration{})
+	kept := s.createInstance("uuid-2", &conf.Configuration{})
+	for _, instance := range []*models.Instance{i, kept} {
+		s.Require().NoError(s.C.CreateInstanceRevision(&models.InstanceRevision{ID: newID(), InstanceID: instance.ID, BaseConfig: instance.BaseConfig}))
+	}
+	s.Require().NoError(s.C.CreateAuditEntry(&models.AuditEntry{ID: newID(), InstanceID: i.ID}))
+	s.Require().NoError(s.C.DeleteInstance(i))
+
+	n, err := s.C.PurgeInstances(time.Now().Add(-time.Hour))
+	s.Require().NoError(err)
+	s.EqualValues(0, n, "instances deleted after the cutoff are kept")
+
+	n, err = s.C.PurgeInstances(time.Now().Add(time.Hour))
+	s.Require().NoError(err)
+	s.EqualValues(1, n)
+	_, err = s.C.GetInstance(i.ID)
+	s.True(models.IsNotFoundError(err), "expected an instance not found error, got %v", err)
+	revisions, err := s.C.FindInstanceRevisions(i.ID, nil)
+	s.Require().NoError(err)
+	s.Empty(revisions)
+	entries, err := s.C.FindAuditEntries(i.ID, nil, nil)
+	s.Require().NoError(err)
+	s.Len(entries, 1, "audit entries are kept")
+
+	_, err = s.C.GetInstance(kept.ID)
+	s.NoError(err)
+	revisions, err = s.C.FindInstanceRevisions(kept.ID, nil)
+	s.Require().NoError(err)
+	s.Len(revisions, 1)
+}
+
+func (s *StorageTestSuite) TestInstanceRevisions() {
+	i := s.createInstance("uuid-1", &conf.Configuration{})
+	other := s.createInstance("uuid-2", &conf.Configuration{})
+	for n := 1; n <= 3; n++ {
+		revision := &models.InstanceRevision{
+			ID:         newID(),
+			InstanceID: i.ID,
+			BaseConfig: &conf.Configuration{GitHub: conf.GitHubConfig{AccessToken: "token", Repo: fmt.Sprintf("owner/repo-%d", n)}},
+			ChangedBy:  "operator",
+		}
+		s.Require().NoError(s.C.CreateInstanceRevision(revision))
+		s.Equal(n, revision.Revision)
+	}
+	revision := &models.InstanceRevision{ID: newID(), InstanceID: other.ID, BaseConfig: other.BaseConfig, RestoredFrom: 1}
+	s.Require().NoError(s.C.CreateInstanceRevision(revision))
+	s.Equal(1, revision.Revision, "revisions are numbered per instance")
+
+	second, err := s.C.GetInstanceRevision(i.ID, 2)
+	s.Require().NoError(err)
+	s.Equal("owner/repo-2", second.BaseConfig.GitHub.Repo)
+	s.Equal("token", second.BaseConfig.GitHub.AccessToken)
+	s.Equal("operator", second.ChangedBy)
+	_, err = s.C.GetInstanceRevision(i.ID, 4)
+	s.True(models.IsNotFoundError(err), "expected a revision not found error, got %v", err)
+
+	pagination := &models.Pagination{Page: 1, PerPage: 2}
+	revisions, err := s.C.FindInstanceRevisions(i.ID, pagination)
+	s.Require().NoError(err)
+	s.EqualValues(3, pagination.Count)
+	s.Require().Len(revisions, 2)
+	s.Equal(3, revisions[0].Revision)
+	s.Equal(2, revisions[1].Revision)
+
+	restored, err := s.C.GetInstanceRevision(other.ID, 1)
+	s.Require().NoError(err)
+	s.Equal(1, restored.RestoredFrom)
+}
+
+func (s *StorageTestSuite) TestUpdateInstanceRevision() {
+	i := s.createInstance("uuid-1", &conf.Configuration{})
+	revision := &models.InstanceRevision{
+		ID:         newID(),
+		InstanceID: i.ID,
+		BaseConfig: &conf.Configuration{GitHub: conf.GitHubConfig{AccessToken: "token", Repo: "owner/repo"}},
+		ChangedBy:  "operator",
+	}
+	s.Require().NoError(s.C.CreateInstanceRevision(revision))
+
+	keyring, err := models.NewKeyring(map[string][]byte{"test": make([]byte, conf.MasterKeySize)}, "test")
+	s.Require().NoError(err)
+	models.Encryption = keyring
+	defer func() { models.Encryption = nil }()
+
+	stored, err := s.C.GetInstanceRevision(i.ID, 1)
+	s.Require().NoError(err)
+	s.Require().NoError(s.C.UpdateInstanceRevision(stored))
+	s.Contains(stored.DataKey, "test:")
+
+	updated, err := s.C.GetInstanceRevision(i.ID, 1)
+	s.Require().NoError(err)
+	s.Equal(stored.DataKey, updated.DataKey)
+	s.Equal("token", updated.BaseConfig.GitHub.AccessToken)
+	s.Equal("owner/repo", updated.BaseConfig.GitHub.Repo)
+	s.Equal("operator", updated.ChangedBy)
+	s.Equal(1, updated.Revision)
+
+	err = s.C.UpdateInstanceRevision(&models.InstanceRevision{ID: newID(), InstanceID: i.ID, BaseConfig: &conf.Configuration{}})
+	s.True(models.IsNotFoundError(err), "expected a revision not found error, got %v", err)
+}
+
+func (s *StorageTestSuite) TestRekeyInstance() {
+	i := s.createInstance("uuid-1", &conf.Configuration{GitHub: conf.GitHubConfig{AccessToken: "token", Repo: "owner/repo"}})
+	s.Require().NoError(s.C.DeleteInstance(i))
+
+	keyring, err := models.NewKeyring(map[string][]byte{"test": make([]byte, conf.MasterKeySize)}, "test")
+	s.Require().NoError(err)
+	models.Encryption = keyring
+	defer func() { models.Encryption = nil }()
+
+	stored, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err)
+	s.Require().NoError(s.C.RekeyInstance(stored))
+	s.Equal("test", stored.KeyID())
+
+	rekeyed, err := s.C.GetInstance(i.ID)
+	s.Require().NoError(err)
+	s.Equal("test", rekeyed.KeyID())
+	s.Equal("token", rekeyed.BaseConfig.GitHub.AccessToken)
+	s.Equal("owner/repo", rekeyed.BaseConfig.GitHub.Repo)
+	s.Equal(i.Version, rekeyed.Version, "rekeying keeps the version, and so the ETag")
+	s.Equal(stored.UpdatedAt.Unix(), rekeyed.UpdatedAt.Unix())
+	s.Equal(models.InstanceStateDeleted, rekeyed.State)
+
+	// an instance changed in the meantime isn't overwritten
+	s.Require().NoError(s.C.UpdateInstance(rekeyed))
+	err = s.C.RekeyInstance(stored)
+	s.IsType(models.InstanceVersionConflictError{}, err)
+}
+
+func (s *StorageTestSuite) TestAuditEntries() {
+	i := s.createInstance("uuid-1", &conf.Configuration{})
+	entries := []*models.AuditEntry{
+		{UserID: "user-1", Email: "one@example.com", Path: "/repos/owner/repo/contents/content/post.md"},
+		{UserID: "user-2", Email: "two@example.com", Path: "/repos/owner/repo/contents/static/logo.png"},
+		{UserID: "user-1", Email: "one@example.com", Path: "/repos/owner/repo/git/refs"},
+	}
+	for _, e := range entries {
+		e.ID = newID()
+		e.InstanceID = i.ID
+		e.Provider = models.ProviderGitHub
+		e.Method = "PUT"
+		e.Status = 200
+		s.Require().NoError(s.C.CreateAuditEntry(e))
+		s.False(e.CreatedAt.IsZero())
+	}
+	s.Require().NoError(s.C.CreateAuditEntry(&models.AuditEntry{ID: newID(), InstanceID: "other", UserID: "user-1"}))
+
+	find := func(filter *models.AuditFilter) []*models.AuditEntry {
+		found, err := s.C.FindAuditEntries(i.ID, filter, nil)
+		s.Require().NoError(err)
+		return found
+	}
+	s.Len(find(nil), 3)
+	s.Len(find(&models.AuditFilter{User: "user-1"}), 2)
+	s.Len(find(&models.AuditFilter{User: "two@example.com"}), 1)
+	s.Len(find(&models.AuditFilter{Path: "/repos/owner/repo/contents/"}), 2)
+	s.Len(find(&models.AuditFilter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}), 3)
+	s.Empty(find(&models.AuditFilter{From: time.Now().Add(time.Hour)}))
+	s.Empty(find(&models.AuditFilter{To: time.Now().Add(-time.Hour)}))
+
+	found := find(&models.AuditFilter{Path: "/repos/owner/repo/git/"})
+	s.Require().Len(found, 1)
+	s.Equal(entries[2].ID, found[0].ID)
+	s.Equal("user-1", found[0].UserID)
+	s.Equal("one@example.com", found[0].Email)
+	s.Equal(models.ProviderGitHub, found[0].Provider)
+	s.Equal(200, found[0].Status)
+
+	pagination := &models.Pagination{Page: 2, PerPage: 2}
+	page, err := s.C.FindAuditEntries(i.ID, nil, pagination)
+	s.Require().NoError(err)
+	s.EqualValues(3, pagination.Count)
+	s.Len(page, 1)
+}